@@ -0,0 +1,61 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+// FileAttrs are the attributes of the data file, to be reapplied on restore.
+type FileAttrs = container.FileAttrs
+
+// captureAttrs returns the attributes of the file fn, with fi as its FileInfo.
+func captureAttrs(fn string, fi os.FileInfo) (*FileAttrs, error) {
+	attrs := FileAttrs{Mode: fi.Mode(), UID: -1, GID: -1, MTime: fi.ModTime()}
+	if err := captureSysAttrs(&attrs, fn, fi); err != nil {
+		return &attrs, errors.Wrap(err, fn)
+	}
+	return &attrs, nil
+}
+
+// lchown is os.Lchown, replaceable in the tests.
+var lchown = os.Lchown
+
+// applyAttrs applies the attributes to the file fn.
+//
+// If the owner cannot be changed (only root can give a file away), it is logged,
+// and the rest of the attributes are applied.
+func applyAttrs(attrs FileAttrs, fn string) error {
+	if attrs.UID >= 0 || attrs.GID >= 0 {
+		if err := lchown(fn, attrs.UID, attrs.GID); err != nil {
+			if !os.IsPermission(err) {
+				return errors.Wrap(err, "chown")
+			}
+			log.Printf("%s: keep the owner (chown %d:%d: %v)", fn, attrs.UID, attrs.GID, err)
+		}
+	}
+	if err := os.Chmod(fn, attrs.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return errors.Wrap(err, "chmod")
+	}
+	if err := applyXattrs(attrs, fn); err != nil {
+		return err
+	}
+	return errors.Wrap(os.Chtimes(fn, attrs.MTime, attrs.MTime), "chtimes")
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func captureSysAttrs(attrs *FileAttrs, fn string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		attrs.UID, attrs.GID = int(st.Uid), int(st.Gid)
+	}
+
+	names, err := listxattr(fn)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	attrs.Xattrs = make(map[string][]byte, len(names))
+	for _, name := range names {
+		value, err := getxattr(fn, name)
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		attrs.Xattrs[name] = value
+	}
+	return nil
+}
+
+func applyXattrs(attrs FileAttrs, fn string) error {
+	for name, value := range attrs.Xattrs {
+		if err := syscall.Setxattr(fn, name, value, 0); err != nil {
+			return errors.Wrapf(err, "setxattr %s", name)
+		}
+	}
+	return nil
+}
+
+func listxattr(fn string) ([]string, error) {
+	var buf []byte
+	for {
+		n, err := syscall.Listxattr(fn, buf)
+		if err != nil {
+			if err == syscall.ENOTSUP || err == syscall.ENODATA {
+				return nil, nil
+			}
+			if err == syscall.ERANGE {
+				buf = nil
+				continue
+			}
+			return nil, errors.Wrap(err, "listxattr")
+		}
+		if buf == nil {
+			if n == 0 {
+				return nil, nil
+			}
+			buf = make([]byte, n)
+			continue
+		}
+		var names []string
+		for _, b := range bytes.Split(buf[:n], []byte{0}) {
+			if len(b) != 0 {
+				names = append(names, string(b))
+			}
+		}
+		return names, nil
+	}
+}
+
+func getxattr(fn, name string) ([]byte, error) {
+	var buf []byte
+	for {
+		n, err := syscall.Getxattr(fn, name, buf)
+		if err != nil {
+			if err == syscall.ERANGE {
+				buf = nil
+				continue
+			}
+			return nil, errors.Wrap(err, "getxattr")
+		}
+		if buf == nil {
+			if n == 0 {
+				return []byte{}, nil
+			}
+			buf = make([]byte, n)
+			continue
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAttrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inp := filepath.Join(dir, "input.go")
+	if err := ioutil.WriteFile(inp, orig, 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2016, 12, 24, 15, 43, 0, 0, time.Local)
+	if err := os.Chtimes(inp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	hasXattr := syscall.Setxattr(inp, "user.par", []byte("test"), 0) == nil
+
+	for _, ver := range []version{VersionJSON, VersionTAR} {
+		parFn := filepath.Join(dir, ver.String()+".par")
+		if err := CreateParFile(ver, parFn, inp, 0, 0, 0, false, ""); err != nil {
+			t.Fatalf("%s. %+v", ver, err)
+		}
+		meta, err := ReadFileMetadata(parFn)
+		if err != nil {
+			t.Fatalf("%s. %+v", ver, err)
+		}
+		if meta.Attrs == nil {
+			t.Fatalf("%s. no attrs stored", ver)
+		}
+		if meta.Attrs.UID != os.Getuid() || meta.Attrs.GID != os.Getgid() {
+			t.Errorf("%s. got owner %d:%d", ver, meta.Attrs.UID, meta.Attrs.GID)
+		}
+		if hasXattr {
+			if want := map[string][]byte{"user.par": []byte("test")}; !reflect.DeepEqual(meta.Attrs.Xattrs, want) {
+				t.Errorf("%s. got xattrs %q, wanted %q", ver, meta.Attrs.Xattrs, want)
+			}
+		}
+
+		out := filepath.Join(dir, ver.String()+".out")
+		fh, err := os.Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RestoreParFile(fh, parFn, inp, ""); err != nil {
+			t.Fatalf("%s. Restore: %+v", ver, err)
+		}
+		if err := fh.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyAttrs(*meta.Attrs, out); err != nil {
+			t.Fatalf("%s. Apply: %+v", ver, err)
+		}
+		fi, err := os.Stat(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode(), os.FileMode(0640); got != want {
+			t.Errorf("%s. got mode %s, wanted %s", ver, got, want)
+		}
+		if got := fi.ModTime(); !got.Equal(mtime) {
+			t.Errorf("%s. got mtime %s, wanted %s", ver, got, mtime)
+		}
+		if hasXattr {
+			if got, err := getxattr(out, "user.par"); err != nil || !bytes.Equal(got, []byte("test")) {
+				t.Errorf("%s. got xattr %q (%v)", ver, got, err)
+			}
+		}
+	}
+}
+
+func TestAttrsNotOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "out")
+	if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// as a non-root user restoring a file of another user
+	defer func(f func(string, int, int) error) { lchown = f }(lchown)
+	lchown = func(name string, uid, gid int) error {
+		return &os.PathError{Op: "lchown", Path: name, Err: syscall.EPERM}
+	}
+	mtime := time.Date(2016, 12, 24, 15, 43, 0, 0, time.Local)
+	attrs := FileAttrs{Mode: 0600, UID: os.Getuid() + 1, GID: os.Getgid() + 1, MTime: mtime}
+	if err := applyAttrs(attrs, fn); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Mode(), os.FileMode(0600); got != want {
+		t.Errorf("got mode %s, wanted %s", got, want)
+	}
+	if got := fi.ModTime(); !got.Equal(mtime) {
+		t.Errorf("got mtime %s, wanted %s", got, mtime)
+	}
+}
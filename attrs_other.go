@@ -0,0 +1,26 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// captureSysAttrs is a no-op: the owner and extended attributes are captured only on Linux.
+func captureSysAttrs(attrs *FileAttrs, fn string, fi os.FileInfo) error { return nil }
+
+func applyXattrs(attrs FileAttrs, fn string) error { return nil }
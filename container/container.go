@@ -0,0 +1,182 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package container is the registry of the container formats of the parity files.
+//
+// Each format implements Format, and registers itself with Register (in an init function),
+// so a new format - even an in-house one, outside of this repository - needs just
+// a package imported by the par command, and no change in the version dispatching:
+// create, restore, locate and dump find it by its name and by its file start.
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the identifier of the format, stored in the FileMetadata.
+type Version uint8
+
+// The versions of the formats of the par command.
+// An in-house format should use a version from VersionUser up.
+const (
+	VersionJSON = Version(iota)
+	VersionPAR2
+	VersionTAR
+	VersionPAR3
+	VersionBinary
+	VersionArmor
+	VersionArmor85
+	VersionStream
+
+	VersionUser = Version(128)
+)
+
+// ErrUnknownVersion is returned for an unknown version or format name.
+var ErrUnknownVersion = errors.New("unknown version")
+
+func (v Version) String() string {
+	if f, err := Of(v); err == nil {
+		return f.Name()
+	}
+	return fmt.Sprintf("V%02d", uint8(v))
+}
+
+// FileMetadata describes the data file, and the shards protecting it.
+//
+// Need to save the metadata of:
+//  1. file (real data) size
+//  2. number of data/parity shards
+//  3. hash of each shard (to know which shard has to be reconstructeed
+//  4. order of the shards
+type FileMetadata struct {
+	Version      Version `json:"V"`
+	DataShards   uint8   `json:"DS"`
+	ParityShards uint8   `json:"PS"`
+	ShardSize    uint32  `json:"S"`
+	FileName     string  `json:"F"`
+	Size         int64   `json:"L,omitempty"`
+	OnlyParity   bool    `json:"OP"`
+	Revision     uint8   `json:"R,omitempty"`
+	// Attrs of the file, to be reapplied on restore.
+	Attrs *FileAttrs `json:"A,omitempty"`
+	// Comment is a free text, given at create.
+	Comment string `json:"C,omitempty"`
+}
+
+// ShardMetadata describes a shard: its 1-based index, size and CRC32C.
+type ShardMetadata struct {
+	Index  uint32 `json:"i"`
+	Size   uint32 `json:"s"`
+	Hash32 uint32 `json:"h"`
+}
+
+// FileAttrs are the attributes of the data file, to be reapplied on restore.
+type FileAttrs struct {
+	Mode os.FileMode `json:"M"`
+	// UID and GID are -1 if unknown.
+	UID    int               `json:"U"`
+	GID    int               `json:"G"`
+	MTime  time.Time         `json:"T"`
+	Xattrs map[string][]byte `json:"X,omitempty"`
+}
+
+// Source is the parity file to read.
+type Source struct {
+	io.Reader
+	// Name of the parity file (the path, if it is a file).
+	Name string
+	// ReaderAt is the random access view of the file (if available), of Size length.
+	io.ReaderAt
+	Size int64
+}
+
+// Head is the start of the parity file: the metadata, and the identification of the data file.
+type Head struct {
+	FileMetadata
+	// HeadHash is the hash (by NewHash) of the first HeadLength bytes of the data file, nil if unknown.
+	HeadLength int64
+	HeadHash   []byte
+	NewHash    func() hash.Hash
+}
+
+// CRC32C is the table of the ShardMetadata.Hash32 checksums.
+var CRC32C = crc32.MakeTable(crc32.Castagnoli)
+
+// ShardHead returns the Head of meta, identifying the data file by its first shard.
+func ShardHead(meta FileMetadata, first ShardMetadata) Head {
+	head := Head{FileMetadata: meta}
+	if first.Index != 1 {
+		return head
+	}
+	head.HeadLength = int64(first.Size)
+	head.HeadHash = make([]byte, 4)
+	binary.BigEndian.PutUint32(head.HeadHash, first.Hash32)
+	head.NewHash = func() hash.Hash { return crc32.New(CRC32C) }
+	return head
+}
+
+// ReadOptions are the options of Format.NewShardReader.
+type ReadOptions struct {
+	// DataName is the name of the data file (even if it is missing).
+	DataName string
+	// Set is the ID (prefix) of the recovery set to read, if the format has several in a file.
+	Set string
+}
+
+// DumpOptions are the options of Format.Dump.
+type DumpOptions struct {
+	// Set is the ID (prefix) of the set to dump, "all" or empty for all.
+	Set string
+	// Packets lists the packets one by one.
+	Packets bool
+}
+
+// Format is a container format of the parity file.
+type Format interface {
+	// Version is stored in the FileMetadata, Name is used by the -type flag (case insensitive).
+	Version() Version
+	Name() string
+	// Detect reports whether the parity file starts with b (the first DetectLength bytes, if the file is that long).
+	Detect(b []byte) bool
+	// NewWriter returns the writer of the parity file of the data described by meta.
+	NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error)
+	// ReadHead reads the metadata of the parity file, and what identifies its data file.
+	ReadHead(parity Source) (Head, error)
+	// NewShardReader returns the reader of the parity file, which writes the (repaired) data.
+	// The data is the original (maybe damaged) file, or a reader returning an error if it is missing.
+	NewShardReader(parity Source, data io.Reader, opts ReadOptions) (io.WriterTo, error)
+	// Dump writes the contents of the parity files, for debugging.
+	Dump(w io.Writer, files []string, opts DumpOptions) error
+}
+
+// Embedder is implemented by the formats which report whether they can embed the data shards
+// (write a parity file with FileMetadata.OnlyParity false). The other formats can.
+type Embedder interface {
+	CanEmbed() bool
+}
+
+// CanEmbed reports whether the format f can embed the data shards.
+func CanEmbed(f Format) bool {
+	e, ok := f.(Embedder)
+	return !ok || e.CanEmbed()
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package container_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+// lineFormat is an in-house format, registered from outside of the par command:
+// a magic line, the JSON FileMetadata and the JSON ShardMetadata of the first shard.
+type lineFormat struct{}
+
+const lineMagic = "LINEPAR\n"
+
+func (lineFormat) Version() container.Version { return container.VersionUser + 1 }
+func (lineFormat) Name() string               { return "LINE" }
+func (lineFormat) Detect(b []byte) bool       { return bytes.HasPrefix(b, []byte(lineMagic)) }
+
+func (lineFormat) NewWriter(w io.Writer, meta container.FileMetadata) (io.WriteCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (lineFormat) ReadHead(parity container.Source) (container.Head, error) {
+	var meta container.FileMetadata
+	var sm container.ShardMetadata
+	if _, err := io.ReadFull(parity, make([]byte, len(lineMagic))); err != nil {
+		return container.Head{}, err
+	}
+	dec := json.NewDecoder(parity)
+	if err := dec.Decode(&meta); err != nil {
+		return container.Head{}, err
+	}
+	if err := dec.Decode(&sm); err != nil {
+		return container.Head{}, err
+	}
+	return container.ShardHead(meta, sm), nil
+}
+
+func (lineFormat) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (lineFormat) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	return container.DumpMetadata(w, files)
+}
+
+func TestRegister(t *testing.T) {
+	container.Register(lineFormat{}, "lines")
+
+	for _, name := range []string{"line", "LINES"} {
+		if f, err := container.Lookup(name); err != nil || f != (lineFormat{}) {
+			t.Errorf("%s: got %v (%v)", name, f, err)
+		}
+	}
+	if f, err := container.Of(container.VersionUser + 1); err != nil || f != (lineFormat{}) {
+		t.Errorf("got %v (%v)", f, err)
+	}
+	if s := (container.VersionUser + 1).String(); s != "LINE" {
+		t.Errorf("got %q, wanted LINE", s)
+	}
+	if s := container.VersionUser.String(); s != "V128" {
+		t.Errorf("got %q, wanted V128", s)
+	}
+	if _, err := container.Lookup("zip"); errors.Cause(err) != container.ErrUnknownVersion {
+		t.Errorf("zip: got %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registered LINE twice")
+			}
+		}()
+		container.Register(lineFormat{})
+	}()
+
+	dir, err := ioutil.TempDir("", "container-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	parFn := filepath.Join(dir, "a.line")
+	first := []byte("the first shard")
+	var buf bytes.Buffer
+	buf.WriteString(lineMagic)
+	enc := json.NewEncoder(&buf)
+	enc.Encode(container.FileMetadata{FileName: "a.txt", Size: 99, DataShards: 2, ParityShards: 1, OnlyParity: true})
+	enc.Encode(container.ShardMetadata{Index: 1, Size: uint32(len(first)), Hash32: crc32.Checksum(first, container.CRC32C)})
+	if err := ioutil.WriteFile(parFn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err := container.DetectFile(parFn); err != nil || f != (lineFormat{}) {
+		t.Fatalf("detected %v (%v)", f, err)
+	}
+	head, err := container.ReadHead(parFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Version != (lineFormat{}).Version() || head.FileName != "a.txt" || head.Size != 99 || head.HeadLength != int64(len(first)) {
+		t.Errorf("got %+v", head)
+	}
+	hsh := head.NewHash()
+	hsh.Write(first)
+	if got := hsh.Sum(nil); !bytes.Equal(got, head.HeadHash) {
+		t.Errorf("head hash got %x, wanted %x", got, head.HeadHash)
+	}
+
+	var dump bytes.Buffer
+	if err := container.DumpMetadata(&dump, []string{parFn}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dump.Bytes(), []byte(`"F": "a.txt"`)) {
+		t.Errorf("dump: got %s", dump.Bytes())
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DetectLength is the length of the file start given to Format.Detect.
+const DetectLength = 257 + 6
+
+var (
+	formats []Format
+	aliases = make(map[string]Format)
+)
+
+// Register registers the format, by its version and name, and the aliases.
+// It panics if the version or a name is already registered.
+func Register(f Format, alias ...string) {
+	for _, g := range formats {
+		if g.Version() == f.Version() {
+			panic(fmt.Sprintf("version %d is registered by %s", f.Version(), g.Name()))
+		}
+	}
+	for _, name := range append([]string{f.Name()}, alias...) {
+		name = strings.ToLower(name)
+		if g := aliases[name]; g != nil {
+			panic(fmt.Sprintf("%q is registered by %s", name, g.Name()))
+		}
+		aliases[name] = f
+	}
+	formats = append(formats, f)
+}
+
+// Formats returns the registered formats, in the order of registration.
+func Formats() []Format { return append([]Format(nil), formats...) }
+
+// Of returns the format of the version.
+func Of(v Version) (Format, error) {
+	for _, f := range formats {
+		if f.Version() == v {
+			return f, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrUnknownVersion, "%d", uint8(v))
+}
+
+// Lookup returns the format with the name (or alias).
+func Lookup(name string) (Format, error) {
+	if f := aliases[strings.ToLower(name)]; f != nil {
+		return f, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownVersion, "%q (known: %s)", name, strings.Join(Names(), ", "))
+}
+
+// Names returns the lowercase names of the formats.
+func Names() []string {
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = strings.ToLower(f.Name())
+	}
+	return names
+}
+
+// Detect returns the format of the parity file starting with b.
+func Detect(b []byte) (Format, error) {
+	for _, f := range formats {
+		if f.Detect(b) {
+			return f, nil
+		}
+	}
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	return nil, errors.Errorf("unknown parity file start %q", b)
+}
+
+// Open opens the parity file fn, and detects its format.
+//
+// The returned Source reads the file from its start (and is a ReaderAt, if the file is a regular one);
+// the returned file has to be closed.
+func Open(fn string) (Format, Source, *os.File, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, Source{}, nil, errors.Wrap(err, fn)
+	}
+	br := bufio.NewReader(fh)
+	b, err := br.Peek(DetectLength)
+	if err != nil && len(b) < 8 {
+		fh.Close()
+		return nil, Source{}, nil, errors.Wrap(err, fn)
+	}
+	f, err := Detect(b)
+	if err != nil {
+		fh.Close()
+		return nil, Source{}, nil, errors.Wrap(err, fn)
+	}
+	src := Source{Reader: br, Name: fn}
+	if fi, err := fh.Stat(); err == nil && fi.Mode().IsRegular() {
+		src.ReaderAt, src.Size = fh, fi.Size()
+	}
+	return f, src, fh, nil
+}
+
+// DetectFile returns the format of the parity file fn.
+func DetectFile(fn string) (Format, error) {
+	f, _, fh, err := Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	fh.Close()
+	return f, nil
+}
+
+// ReadHead reads the Head of the parity file fn, by its format.
+func ReadHead(fn string) (Head, error) {
+	f, src, fh, err := Open(fn)
+	if err != nil {
+		return Head{}, err
+	}
+	defer fh.Close()
+	head, err := f.ReadHead(src)
+	if err != nil {
+		return head, errors.Wrap(err, fn)
+	}
+	head.Version = f.Version()
+	return head, nil
+}
+
+// DumpMetadata writes the FileMetadata of each file as JSON.
+func DumpMetadata(w io.Writer, files []string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	for _, fn := range files {
+		head, err := ReadHead(fn)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(head.FileMetadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -23,18 +23,37 @@ import (
 
 	"github.com/klauspost/reedsolomon"
 	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
 )
 
-func (ver version) CreateParFile(out, inp string, D, P, shardSize int) error {
+// CreateParFile creates the parity file out for inp.
+//
+// If embed is true, the data shards are stored, too, so inp can be restored from out alone.
+// The comment is stored in the metadata (in comment packets for PAR2).
+func CreateParFile(ver version, out, inp string, D, P, shardSize int, embed bool, comment string) error {
 	log.Printf("Create %q for %q.", out, inp)
 	if out == inp {
 		return errors.Errorf("inp=%q must be differ from out!", inp)
 	}
+	// check before creating out, so a refused -embed does not leave an empty file behind
+	if embed {
+		format, err := container.Of(ver)
+		if err != nil {
+			return err
+		}
+		if !container.CanEmbed(format) {
+			return errors.Errorf("%s cannot embed the data", format.Name())
+		}
+	}
 	fh, err := os.Open(inp)
 	if err != nil {
 		return errors.Wrap(err, "CreateParFile input")
 	}
 	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return errors.Wrap(err, inp)
+	}
 
 	pfh, err := os.Create(out)
 	if err != nil {
@@ -48,10 +67,18 @@ func (ver version) CreateParFile(out, inp string, D, P, shardSize int) error {
 		DataShards: uint8(D), ParityShards: uint8(P),
 		ShardSize:  uint32(shardSize),
 		FileName:   fh.Name(),
-		OnlyParity: true,
+		Size:       fi.Size(),
+		OnlyParity: !embed,
 		Version:    ver,
+		Comment:    comment,
+	}
+	if ver == VersionTAR {
+		meta.Revision = TarRevision
 	}
-	w, err := meta.NewWriter(pfh)
+	if meta.Attrs, err = captureAttrs(inp, fi); err != nil {
+		return err
+	}
+	w, err := newWriter(pfh, meta)
 	if err != nil {
 		return errors.WithMessage(err, fmt.Sprintf("%#v", meta))
 	}
@@ -74,25 +101,15 @@ type rsEnc struct {
 	writeShards           func([][]byte, int) error
 }
 
-func (meta FileMetadata) NewWriter(w io.Writer) (io.WriteCloser, error) {
-	var rw io.WriteCloser
-	var err error
-
-	switch meta.Version {
-	case VersionJSON:
-		rw, err = NewRSJSONWriter(w, meta)
-	case VersionPAR2:
-		rw, err = NewPAR2Writer(w, meta)
-	case VersionTAR:
-		rw, err = NewRSTarWriter(w, meta)
-	default:
-		err = errors.Wrapf(ErrUnknownVersion, "%s", meta.Version)
+func newWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	format, err := container.Of(meta.Version)
+	if err != nil {
+		return nil, err
 	}
-
-	return rw, err
+	return format.NewWriter(w, meta)
 }
 
-func (meta *FileMetadata) newRSEnc(writeShards func([][]byte, int) error) rsEnc {
+func newRSEnc(meta *FileMetadata, writeShards func([][]byte, int) error) rsEnc {
 	if meta.DataShards == 0 {
 		meta.DataShards = DefaultDataShards
 	}
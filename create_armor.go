@@ -0,0 +1,204 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/ascii85"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The ASCII-armored format is line oriented, for text-only channels:
+//
+//	-----BEGIN PAR BASE64-----
+//	M {"V":5,...} 1a2b3c4d
+//	S {"i":1,"s":1024,"h":...} 5e6f7a8b
+//	D <48 bytes of the shard, encoded> 9abcdef0
+//	...
+//	M {"V":5,...,"L":<real size>} 1a2b3c4d
+//	-----END PAR BASE64-----
+//
+// Each line ends with the CRC32C (hex) of the rest of the line,
+// so a damaged line is detected, and its shard is treated as missing.
+// The metadata is repeated at the end, with the real data size.
+const (
+	armorBegin     = "-----BEGIN PAR "
+	armorEnd       = "-----END PAR "
+	armorDash      = "-----"
+	armorLineBytes = 48
+)
+
+// armorEncoding is the encoding of the shard content lines.
+type armorEncoding struct {
+	Name   string
+	encode func(p []byte) string
+	decode func(s string) ([]byte, error)
+}
+
+var (
+	armorBase64 = &armorEncoding{
+		Name:   "BASE64",
+		encode: base64.StdEncoding.EncodeToString,
+		decode: base64.StdEncoding.DecodeString,
+	}
+	armorBase85 = &armorEncoding{
+		Name: "BASE85",
+		encode: func(p []byte) string {
+			b := make([]byte, ascii85.MaxEncodedLen(len(p)))
+			return string(b[:ascii85.Encode(b, p)])
+		},
+		decode: func(s string) ([]byte, error) {
+			b := make([]byte, 4*len(s))
+			n, _, err := ascii85.Decode(b, []byte(s), true)
+			return b[:n], err
+		},
+	}
+)
+
+func (e *armorEncoding) begin() string { return armorBegin + e.Name + armorDash }
+func (e *armorEncoding) end() string   { return armorEnd + e.Name + armorDash }
+
+// armorLine returns the line of the tag and the payload, with its checksum.
+func armorLine(tag byte, payload string) string {
+	line := string(tag) + " " + payload
+	return fmt.Sprintf("%s %08x\n", line, crc32.Checksum([]byte(line), crc32cTable))
+}
+
+// parseArmorLine checks the line's checksum, and returns its tag and payload.
+func parseArmorLine(line string) (byte, string, error) {
+	line = strings.TrimRight(line, " \t\r\n")
+	i := strings.LastIndexByte(line, ' ')
+	if i < 2 || line[1] != ' ' {
+		return 0, "", errors.Errorf("bad line %q", line)
+	}
+	want, err := strconv.ParseUint(line[i+1:], 16, 32)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "bad line checksum %q", line[i+1:])
+	}
+	if got := crc32.Checksum([]byte(line[:i]), crc32cTable); uint64(got) != want {
+		return 0, "", errors.Errorf("line crc mismatch (got %08x, wanted %08x)", got, want)
+	}
+	return line[0], line[2:i], nil
+}
+
+var _ = io.WriteCloser((*rsArmorWriter)(nil))
+
+// rsArmorWriter writes the ASCII-armored format.
+type rsArmorWriter struct {
+	rsEnc
+	w      *bufio.Writer
+	enc    *armorEncoding
+	meta   FileMetadata
+	Index  uint32
+	length int64
+	closed bool
+}
+
+func NewRSArmorWriter(w io.Writer, meta FileMetadata, enc *armorEncoding) (*rsArmorWriter, error) {
+	aw := rsArmorWriter{w: bufio.NewWriter(w), enc: enc}
+	aw.rsEnc = newRSEnc(&meta, aw.writeShards)
+	meta.FileName = filepath.Base(meta.FileName)
+	aw.meta = meta
+	if _, err := aw.w.WriteString(enc.begin() + "\n"); err != nil {
+		return nil, err
+	}
+	if err := aw.writeJSON('M', meta); err != nil {
+		return nil, err
+	}
+	return &aw, nil
+}
+
+func (rw *rsArmorWriter) writeJSON(tag byte, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = rw.w.WriteString(armorLine(tag, string(js)))
+	return err
+}
+
+func (rw *rsArmorWriter) Write(p []byte) (int, error) {
+	n, err := rw.rsEnc.Write(p)
+	rw.length += int64(n)
+	return n, err
+}
+
+// Close writes the last stripe, the metadata again (with the real data size) and the end line.
+func (rw *rsArmorWriter) Close() error {
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+	if rw.i != 0 {
+		if err := rw.WriteShards(); err != nil {
+			return err
+		}
+	}
+	rw.data, rw.slices = nil, nil
+	meta := rw.meta
+	meta.Size = rw.length
+	if err := rw.writeJSON('M', meta); err != nil {
+		return err
+	}
+	if _, err := rw.w.WriteString(rw.enc.end() + "\n"); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+func (rw *rsArmorWriter) writeShards(slices [][]byte, length int) error {
+	for i, b := range slices {
+		n := len(b)
+		isDataShard := i < int(rw.meta.DataShards)
+		if isDataShard {
+			if n > length {
+				n = length
+			}
+			length -= n
+		}
+		rw.Index++
+		if err := rw.writeJSON('S', ShardMetadata{
+			Index:  rw.Index,
+			Size:   uint32(n),
+			Hash32: crc32.Checksum(b[:n], crc32cTable),
+		}); err != nil {
+			return err
+		}
+		if isDataShard && rw.meta.OnlyParity {
+			continue
+		}
+		for b := b[:n]; len(b) != 0; {
+			m := armorLineBytes
+			if m > len(b) {
+				m = len(b)
+			}
+			if _, err := rw.w.WriteString(armorLine('D', rw.enc.encode(b[:m]))); err != nil {
+				return err
+			}
+			b = b[m:]
+		}
+	}
+	return rw.w.Flush()
+}
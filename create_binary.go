@@ -0,0 +1,220 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// The binary format is
+//
+//	superblock (binSuperblockLength bytes)
+//	FileMetadata as JSON (MetaLength bytes, for the name, attrs and comment)
+//	for each shard: header (binHeaderLength bytes), content (if stored)
+//	superblock again, with the real data size
+//
+// All the integers are little endian, all the checksums are CRC32C.
+const (
+	// binMagic starts the superblock, the last byte is the revision.
+	binMagic = "PARBIN\x00\x01"
+	// binSync starts each shard header, to find them after a corruption.
+	binSync = "\xb1PARSH\x1f\xd0"
+
+	binSuperblockLength = 40
+	binHeaderLength     = 24
+)
+
+const binFlagOnlyParity = 1
+
+// binSuperblock is the fixed size head (and tail) of the binary format.
+//
+//	magic[8] D[1] P[1] flags[1] reserved[1] shardSize[4] size[8] metaLength[4] metaCRC[4] reserved[4] crc[4]
+type binSuperblock struct {
+	stripeLayout
+	MetaLength, MetaCRC uint32
+}
+
+func (sb binSuperblock) encode() []byte {
+	b := make([]byte, binSuperblockLength)
+	copy(b, binMagic)
+	b[8], b[9] = sb.DataShards, sb.ParityShards
+	if sb.OnlyParity {
+		b[10] |= binFlagOnlyParity
+	}
+	binary.LittleEndian.PutUint32(b[12:], sb.ShardSize)
+	binary.LittleEndian.PutUint64(b[16:], uint64(sb.Size))
+	binary.LittleEndian.PutUint32(b[24:], sb.MetaLength)
+	binary.LittleEndian.PutUint32(b[28:], sb.MetaCRC)
+	binary.LittleEndian.PutUint32(b[36:], crc32.Checksum(b[:36], crc32cTable))
+	return b
+}
+
+func decodeBinSuperblock(b []byte) (binSuperblock, error) {
+	var sb binSuperblock
+	if len(b) < binSuperblockLength || !bytes.HasPrefix(b, []byte(binMagic)) {
+		return sb, errors.New("no superblock")
+	}
+	if got, want := crc32.Checksum(b[:36], crc32cTable), binary.LittleEndian.Uint32(b[36:]); got != want {
+		return sb, errors.Errorf("superblock crc mismatch (got %d, wanted %d)", got, want)
+	}
+	sb.DataShards, sb.ParityShards = b[8], b[9]
+	sb.OnlyParity = b[10]&binFlagOnlyParity != 0
+	sb.ShardSize = binary.LittleEndian.Uint32(b[12:])
+	sb.Size = int64(binary.LittleEndian.Uint64(b[16:]))
+	sb.MetaLength = binary.LittleEndian.Uint32(b[24:])
+	sb.MetaCRC = binary.LittleEndian.Uint32(b[28:])
+	if sb.DataShards == 0 || sb.ParityShards == 0 || sb.ShardSize == 0 {
+		return sb, errors.Errorf("bad superblock %#v", sb)
+	}
+	return sb, nil
+}
+
+// shardOffset returns the offset of the header of the index. (1-based) shard,
+// computed from the superblock (as all the shards before it are full, but the last stripe's data shards).
+func (sb binSuperblock) shardOffset(index uint32) int64 {
+	offset := int64(binSuperblockLength) + int64(sb.MetaLength)
+	first := (index - 1) / uint32(sb.stripeLength()) * uint32(sb.stripeLength())
+	full := int64(sb.stripeLength()) * binHeaderLength
+	if !sb.OnlyParity {
+		full += int64(sb.DataShards) * int64(sb.ShardSize)
+	}
+	full += int64(sb.ParityShards) * int64(sb.ShardSize)
+	offset += int64(first/uint32(sb.stripeLength())) * full
+	for j := first + 1; j < index; j++ {
+		offset += binHeaderLength
+		if sb.stored(j) {
+			offset += int64(sb.shardSize(j))
+		}
+	}
+	return offset
+}
+
+func encodeBinHeader(sm ShardMetadata) []byte {
+	b := make([]byte, binHeaderLength)
+	copy(b, binSync)
+	binary.LittleEndian.PutUint32(b[8:], sm.Index)
+	binary.LittleEndian.PutUint32(b[12:], sm.Size)
+	binary.LittleEndian.PutUint32(b[16:], sm.Hash32)
+	binary.LittleEndian.PutUint32(b[20:], crc32.Checksum(b[:20], crc32cTable))
+	return b
+}
+
+// decodeBinHeader decodes the shard header, reporting whether it is good (sync marker and crc).
+func decodeBinHeader(b []byte) (ShardMetadata, bool) {
+	var sm ShardMetadata
+	if len(b) < binHeaderLength || !bytes.HasPrefix(b, []byte(binSync)) ||
+		crc32.Checksum(b[:20], crc32cTable) != binary.LittleEndian.Uint32(b[20:]) {
+		return sm, false
+	}
+	sm.Index = binary.LittleEndian.Uint32(b[8:])
+	sm.Size = binary.LittleEndian.Uint32(b[12:])
+	sm.Hash32 = binary.LittleEndian.Uint32(b[16:])
+	return sm, sm.Index != 0
+}
+
+var _ = io.WriteCloser((*rsBinaryWriter)(nil))
+
+// rsBinaryWriter writes the compact binary format: a checksummed superblock,
+// then the shards with 24 byte headers.
+type rsBinaryWriter struct {
+	rsEnc
+	w      io.Writer
+	meta   FileMetadata
+	sb     binSuperblock
+	Index  uint32
+	length int64
+	closed bool
+}
+
+func NewRSBinaryWriter(w io.Writer, meta FileMetadata) (*rsBinaryWriter, error) {
+	bw := rsBinaryWriter{w: w}
+	bw.rsEnc = newRSEnc(&meta, bw.writeShards)
+	bw.meta = meta
+	meta.FileName = filepath.Base(meta.FileName)
+	js, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	bw.sb = binSuperblock{
+		stripeLayout: stripeLayoutOf(meta),
+		MetaLength:   uint32(len(js)), MetaCRC: crc32.Checksum(js, crc32cTable),
+	}
+	if _, err := w.Write(bw.sb.encode()); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(js); err != nil {
+		return nil, err
+	}
+	return &bw, nil
+}
+
+func (rw *rsBinaryWriter) Write(p []byte) (int, error) {
+	n, err := rw.rsEnc.Write(p)
+	rw.length += int64(n)
+	return n, err
+}
+
+// Close writes the last stripe, and the superblock again, with the real data size.
+func (rw *rsBinaryWriter) Close() error {
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+	if rw.i != 0 {
+		if err := rw.WriteShards(); err != nil {
+			return err
+		}
+	}
+	rw.data, rw.slices = nil, nil
+	sb := rw.sb
+	sb.Size = rw.length
+	_, err := rw.w.Write(sb.encode())
+	return err
+}
+
+func (rw *rsBinaryWriter) writeShards(slices [][]byte, length int) error {
+	for i, b := range slices {
+		n := len(b)
+		isDataShard := i < int(rw.meta.DataShards)
+		if isDataShard {
+			if n > length {
+				n = length
+			}
+			length -= n
+		}
+		rw.Index++
+		if _, err := rw.w.Write(encodeBinHeader(ShardMetadata{
+			Index:  rw.Index,
+			Size:   uint32(n),
+			Hash32: crc32.Checksum(b[:n], crc32cTable),
+		})); err != nil {
+			return err
+		}
+		if !isDataShard || !rw.meta.OnlyParity {
+			if _, err := rw.w.Write(b[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
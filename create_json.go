@@ -33,7 +33,7 @@ type rsJSONWriter struct {
 
 func NewRSJSONWriter(w io.Writer, meta FileMetadata) (*rsJSONWriter, error) {
 	jsw := rsJSONWriter{w: w}
-	jsw.rsEnc = meta.newRSEnc(jsw.writeShards)
+	jsw.rsEnc = newRSEnc(&meta, jsw.writeShards)
 	jsw.meta = meta
 	meta.FileName = filepath.Base(meta.FileName)
 	if err := json.NewEncoder(w).Encode(meta); err != nil {
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/tgulacsi/par/par2"
 )
 
@@ -24,8 +27,8 @@ func TestRecoveryPkt(t *testing.T) {
 	}
 	defer os.Remove(out.Name())
 	defer out.Close()
-	if err := VersionPAR2.CreateParFile(
-		out.Name(), "par2/testdata/input.txt", 10, 3, int(want.Main.BlockSize),
+	if err := CreateParFile(VersionPAR2,
+		out.Name(), "par2/testdata/input.txt", 10, 3, int(want.Main.BlockSize), false, "",
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -47,29 +50,254 @@ func TestRecoveryPkt(t *testing.T) {
 		t.Errorf("got %v, wanted %v", g, w)
 	}
 
-	if g, w := got.RecoveryData, want.RecoveryData; !reflect.DeepEqual(g, w) {
-		t.Errorf("got %v, wanted %v", g, w)
+	if g, w := len(got.RecoveryData), len(want.RecoveryData); g != w {
+		t.Fatalf("got %d recovery slices, wanted %d", g, w)
+	}
+	for i, w := range want.RecoveryData {
+		g := got.RecoveryData[i]
+		gd, err := g.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wd, err := w.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.Exponent != w.Exponent || g.PacketMD5 != w.PacketMD5 || !bytes.Equal(gd, wd) {
+			t.Errorf("%d. got %v, wanted %v", i, g, w)
+		}
+	}
+}
+
+func TestPAR2Restore(t *testing.T) {
+	orig, err := ioutil.ReadFile("par2/testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged, err := ioutil.TempFile("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(damaged.Name())
+	defer damaged.Close()
+	b := append([]byte(nil), orig...)
+	b[2048+10]++
+	if _, err := damaged.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// par2cmdline's recovery set
+	var restored bytes.Buffer
+	if err := RestoreParFile(&restored, "par2/testdata/input.txt.par2", damaged.Name(), ""); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(restored.Bytes(), orig) {
+		t.Errorf("restored mismatch")
+	}
+
+	// ours, with more damage
+	out, err := ioutil.TempFile("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	if err := CreateParFile(VersionPAR2, out.Name(), "par2/testdata/input.txt", 10, 7, 1024, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	b[10]++
+	b[4096+10]++
+	if _, err := damaged.WriteAt(b[:len(b)-100], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := damaged.Truncate(int64(len(b) - 100)); err != nil {
+		t.Fatal(err)
+	}
+	restored.Reset()
+	if err := RestoreParFile(&restored, out.Name(), damaged.Name(), ""); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(restored.Bytes(), orig) {
+		t.Errorf("restored mismatch")
+	}
+}
+
+func TestPAR2RestoreMulti(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origs := make(map[string][]byte)
+	for src, dst := range map[string]string{"par2/testdata/input.txt": "a.txt", "main.go": "b.go"} {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		origs[dst] = b
+		if err := ioutil.WriteFile(filepath.Join(dir, dst), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parFn := filepath.Join(dir, "set.par2")
+	if _, err := par2.Create(par2.CreateOptions{
+		Output: parFn, Files: []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.go")},
+		BlockSize: 1024, Redundancy: 100,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	damage := func(fn string, off int) {
+		b := append([]byte(nil), origs[fn]...)
+		b[off]++
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	damage("a.txt", 10)
+	damage("b.go", 1024+10)
+	for _, fn := range []string{"a.txt", "b.go"} {
+		var restored bytes.Buffer
+		if err := RestoreParFile(&restored, parFn, filepath.Join(dir, fn), ""); err != nil {
+			t.Fatalf("%s: %+v", fn, err)
+		}
+		if !bytes.Equal(restored.Bytes(), origs[fn]) {
+			t.Errorf("%s: restored mismatch", fn)
+		}
+	}
+
+	// a missing file is restored from the recovery slices
+	if err := os.Remove(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	var restored bytes.Buffer
+	if err := RestoreParFile(&restored, parFn, filepath.Join(dir, "a.txt"), ""); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(restored.Bytes(), origs["a.txt"]) {
+		t.Errorf("restored mismatch")
+	}
+}
+
+func TestPAR2Unicode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("par2/testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name, comment = "árvíztűrő tükörfúrógép.txt", "Üdvözlet, ő"
+	inp := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(inp, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	parFn := filepath.Join(dir, "set.par2")
+	if err := CreateParFile(VersionPAR2, parFn, inp, 10, 3, 1024, false, comment); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := par2.Stat(parFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Files) != 1 {
+		t.Fatalf("got %d files, wanted 1", len(info.Files))
+	}
+	if f := info.Files[0]; f.UnicodeName == nil || f.Name() != name {
+		t.Errorf("got name %q (%v), wanted %q", f.Name(), f.UnicodeName, name)
+	}
+	if got := info.CommentTexts(); len(got) != 1 || got[0] != comment {
+		t.Errorf("got comments %q, wanted %q", got, comment)
+	}
+	if len(info.Comments) != 2 {
+		t.Errorf("got %d comment packets, wanted 2 (ASCII and Unicode)", len(info.Comments))
 	}
 }
 
-func TestExpCount(t *testing.T) {
-	var e expCount
-	for i, want := range []uint32{
-		2,
-		4,
-		16,
-		128,
-		256,
-		2048,
-		8192,
-		16384,
-		4107,
-		32856,
-		17132,
-	} {
-
-		if got := e.Next(); got != want {
-			t.Errorf("%d. got %d, want %d.", i, got, want)
+func TestPAR2Sets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origs := make(map[string][]byte)
+	for src, dst := range map[string]string{"par2/testdata/input.txt": "a.txt", "main.go": "b.go"} {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		origs[dst] = b
+		if err := ioutil.WriteFile(filepath.Join(dir, dst), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two sets, which are found together by the set.*par2 glob
+	parFn := filepath.Join(dir, "set.par2")
+	if err := CreateParFile(VersionPAR2, parFn, filepath.Join(dir, "a.txt"), 10, 3, 1024, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateParFile(VersionPAR2, filepath.Join(dir, "set.b.par2"), filepath.Join(dir, "b.go"), 10, 3, 1024, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := par2.Stat(parFn); errors.Cause(err) != par2.ErrMultipleSets {
+		t.Errorf("got %v, wanted %v", err, par2.ErrMultipleSets)
+	}
+	sets, err := par2.StatSets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 {
+		t.Fatalf("got %d sets, wanted 2", len(sets))
+	}
+	for _, set := range sets {
+		if len(set.Files) != 1 || len(set.ParFiles) != 1 {
+			t.Errorf("set %s: got %d files in %q", set.RecoverySetID, len(set.Files), set.ParFiles)
+		}
+		found, err := par2.FindSet(sets, set.RecoverySetID.String()[:8])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != set {
+			t.Errorf("FindSet: got %s, wanted %s", found.RecoverySetID, set.RecoverySetID)
+		}
+	}
+
+	for fn, b := range origs {
+		damaged := append([]byte(nil), b...)
+		damaged[10]++
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var restored bytes.Buffer
+		if err := RestoreParFile(&restored, parFn, filepath.Join(dir, fn), ""); err != nil {
+			t.Fatalf("%s: %+v", fn, err)
+		}
+		if !bytes.Equal(restored.Bytes(), b) {
+			t.Errorf("%s: restored mismatch", fn)
+		}
+	}
+
+	// -set chooses the set
+	for _, set := range sets {
+		fn := filepath.Join(dir, set.Files[0].Name())
+		var restored bytes.Buffer
+		if err := RestoreParFile(&restored, parFn, fn, set.RecoverySetID.String()[:8]); err != nil {
+			t.Fatalf("%s: %+v", fn, err)
+		}
+		if !bytes.Equal(restored.Bytes(), origs[set.Files[0].Name()]) {
+			t.Errorf("%s: restored mismatch", fn)
+		}
+		other := sets[0]
+		if other == set {
+			other = sets[1]
+		}
+		if err := RestoreParFile(ioutil.Discard, parFn, fn, other.RecoverySetID.String()[:8]); err == nil {
+			t.Errorf("%s: restored from set %s", fn, other.RecoverySetID)
 		}
 	}
 }
@@ -0,0 +1,51 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/par3"
+)
+
+// NewPAR3Writer returns a writer of the PAR3 input set of the data, with ShardSize blocks,
+// and DataShards:ParityShards redundancy.
+//
+// The recovery blocks depend on all the input blocks, so the packets are written on Close.
+func NewPAR3Writer(w io.Writer, meta FileMetadata) (*par3.Writer, error) {
+	if !meta.OnlyParity {
+		return nil, errors.New("PAR3 cannot embed the data")
+	}
+	if meta.DataShards == 0 {
+		meta.DataShards = DefaultDataShards
+	}
+	if meta.ParityShards == 0 {
+		meta.ParityShards = DefaultParityShards
+	}
+	if meta.ShardSize == 0 {
+		meta.ShardSize = DefaultShardSize
+	}
+	blocks := int((meta.Size + int64(meta.ShardSize) - 1) / int64(meta.ShardSize))
+	recovery := (blocks*int(meta.ParityShards) + int(meta.DataShards) - 1) / int(meta.DataShards)
+	pw, err := par3.NewWriter(w, filepath.Base(meta.FileName), meta.Size, int(meta.ShardSize), recovery)
+	if err != nil {
+		return nil, err
+	}
+	pw.Creator, pw.Comment = Creator, meta.Comment
+	return pw, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tgulacsi/par/par3"
+)
+
+func TestPAR3Restore(t *testing.T) {
+	orig, err := ioutil.ReadFile("par2/testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "par3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inp := filepath.Join(dir, "input.txt")
+	if err := ioutil.WriteFile(inp, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := inp + ".par3"
+	if err := CreateParFile(VersionPAR3, out, inp, 10, 7, 1024, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := par3.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Files) != 1 || info.Files[0].Path != "input.txt" || info.BlockSize() != 1024 ||
+		len(info.Recovery) != (info.BlockCount()*7+9)/10 {
+		t.Errorf("got %d files, block size %d, %d/%d blocks", len(info.Files), info.BlockSize(), info.BlockCount(), len(info.Recovery))
+	}
+	if fn, err := LocateDataFile(out, ""); err != nil || fn != inp {
+		t.Errorf("located %q (%v), wanted %q", fn, err, inp)
+	}
+
+	damaged := filepath.Join(dir, "damaged")
+	b := append([]byte(nil), orig...)
+	b[10]++
+	b[2048+10]++
+	if err := ioutil.WriteFile(damaged, b[:len(b)-100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	var restored bytes.Buffer
+	if err := RestoreParFile(&restored, out, damaged, ""); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(restored.Bytes(), orig) {
+		t.Errorf("restored mismatch")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// The stream format is a sequence of self-synchronising frames, for pipes and tapes:
+//
+//	metadata frame (FileMetadata as JSON)
+//	for each stripe: the frames of the data shards, then of the parity shards
+//	end frame, twice
+//
+// Each frame header has the geometry (data and parity shard count, shard size),
+// the stripe, the index in the stripe and the data length of the stripe,
+// so the decoder can start at any good frame, and needs no seeking and no trailer:
+//
+//	sync[8] stripe[4] idx[1] D[1] P[1] flags[1] shardSize[4] stripeLength[4] contentCRC[4] crc[4]
+//
+// All the integers are little endian, all the checksums are CRC32C.
+const (
+	// streamSync starts each frame.
+	streamSync = "\xc3PARSTM\x1e"
+
+	streamHeaderLength = 32
+	// streamMaxShardSize bounds the memory of the decoder.
+	streamMaxShardSize = 1 << 26
+)
+
+const (
+	streamFlagMeta = 1 << iota
+	streamFlagEnd
+)
+
+// streamFrame is the header of a frame.
+type streamFrame struct {
+	Stripe                   uint32
+	Idx                      uint8
+	DataShards, ParityShards uint8
+	Flags                    uint8
+	ShardSize                uint32
+	// StripeLength is the data length of the stripe (the length of the content for a metadata frame).
+	// The Stripe of the end frame is the number of stripes.
+	StripeLength uint32
+	ContentCRC   uint32
+}
+
+func (f streamFrame) encode() []byte {
+	b := make([]byte, streamHeaderLength)
+	copy(b, streamSync)
+	binary.LittleEndian.PutUint32(b[8:], f.Stripe)
+	b[12], b[13], b[14], b[15] = f.Idx, f.DataShards, f.ParityShards, f.Flags
+	binary.LittleEndian.PutUint32(b[16:], f.ShardSize)
+	binary.LittleEndian.PutUint32(b[20:], f.StripeLength)
+	binary.LittleEndian.PutUint32(b[24:], f.ContentCRC)
+	binary.LittleEndian.PutUint32(b[28:], crc32.Checksum(b[:28], crc32cTable))
+	return b
+}
+
+// decodeStreamFrame decodes the frame header, reporting whether it is good (sync marker, crc and geometry).
+func decodeStreamFrame(b []byte) (streamFrame, bool) {
+	var f streamFrame
+	if len(b) < streamHeaderLength || !bytes.HasPrefix(b, []byte(streamSync)) ||
+		crc32.Checksum(b[:28], crc32cTable) != binary.LittleEndian.Uint32(b[28:]) {
+		return f, false
+	}
+	f.Stripe = binary.LittleEndian.Uint32(b[8:])
+	f.Idx, f.DataShards, f.ParityShards, f.Flags = b[12], b[13], b[14], b[15]
+	f.ShardSize = binary.LittleEndian.Uint32(b[16:])
+	f.StripeLength = binary.LittleEndian.Uint32(b[20:])
+	f.ContentCRC = binary.LittleEndian.Uint32(b[24:])
+	if f.Flags&(streamFlagMeta|streamFlagEnd) != 0 {
+		return f, f.Flags&streamFlagMeta == 0 || f.StripeLength <= streamMaxShardSize
+	}
+	return f, f.DataShards != 0 && f.ParityShards != 0 &&
+		int(f.Idx) < int(f.DataShards)+int(f.ParityShards) &&
+		f.ShardSize != 0 && f.ShardSize <= streamMaxShardSize &&
+		uint64(f.StripeLength) <= uint64(f.DataShards)*uint64(f.ShardSize)
+}
+
+// contentLength returns the length of the content of the frame:
+// the data shards are cut at the stripe length.
+func (f streamFrame) contentLength() int {
+	switch {
+	case f.Flags&streamFlagMeta != 0:
+		return int(f.StripeLength)
+	case f.Flags&streamFlagEnd != 0:
+		return 0
+	case f.Idx >= f.DataShards:
+		return int(f.ShardSize)
+	}
+	rest := int64(f.StripeLength) - int64(f.Idx)*int64(f.ShardSize)
+	if rest <= 0 {
+		return 0
+	}
+	if rest < int64(f.ShardSize) {
+		return int(rest)
+	}
+	return int(f.ShardSize)
+}
+
+var _ = io.WriteCloser((*rsStreamWriter)(nil))
+
+// rsStreamWriter writes the stream format: each stripe's data and parity shards in frames.
+// The data shards are always stored.
+type rsStreamWriter struct {
+	rsEnc
+	w      *bufio.Writer
+	frame  streamFrame
+	closed bool
+}
+
+func NewRSStreamWriter(w io.Writer, meta FileMetadata) (*rsStreamWriter, error) {
+	if meta.ShardSize > streamMaxShardSize {
+		return nil, errors.Errorf("shard size %d is bigger than %d", meta.ShardSize, streamMaxShardSize)
+	}
+	meta.OnlyParity = false
+	sw := rsStreamWriter{w: bufio.NewWriter(w)}
+	sw.rsEnc = newRSEnc(&meta, sw.writeShards)
+	if meta.FileName != "" {
+		meta.FileName = filepath.Base(meta.FileName)
+	}
+	sw.frame = streamFrame{DataShards: meta.DataShards, ParityShards: meta.ParityShards, ShardSize: meta.ShardSize}
+	js, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	mf := sw.frame
+	mf.Flags, mf.StripeLength = streamFlagMeta, uint32(len(js))
+	if err := sw.writeFrame(mf, js); err != nil {
+		return nil, err
+	}
+	return &sw, sw.w.Flush()
+}
+
+func (rw *rsStreamWriter) writeFrame(f streamFrame, content []byte) error {
+	f.ContentCRC = crc32.Checksum(content, crc32cTable)
+	if _, err := rw.w.Write(f.encode()); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(content)
+	return err
+}
+
+// Close writes the last stripe and the end frame (twice, for it may be damaged, too).
+func (rw *rsStreamWriter) Close() error {
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+	if rw.i != 0 {
+		if err := rw.WriteShards(); err != nil {
+			return err
+		}
+	}
+	rw.data, rw.slices = nil, nil
+	ef := rw.frame
+	ef.Flags = streamFlagEnd
+	for i := 0; i < 2; i++ {
+		if err := rw.writeFrame(ef, nil); err != nil {
+			return err
+		}
+	}
+	return rw.w.Flush()
+}
+
+// writeShards writes the frames of the stripe, and flushes them, so the stream does not stall.
+func (rw *rsStreamWriter) writeShards(slices [][]byte, length int) error {
+	f := rw.frame
+	f.StripeLength = uint32(length)
+	for i, b := range slices {
+		f.Idx = uint8(i)
+		if err := rw.writeFrame(f, b[:f.contentLength()]); err != nil {
+			return err
+		}
+	}
+	rw.frame.Stripe++
+	return rw.w.Flush()
+}
+
+// EncodeStream writes the stream format of r to w, and returns the length of the data.
+func EncodeStream(w io.Writer, r io.Reader, D, P, shardSize int, comment string) (int64, error) {
+	if n := shardSize % 4; n != 0 {
+		shardSize += 4 - n
+	}
+	sw, err := NewRSStreamWriter(w, FileMetadata{
+		Version:    VersionStream,
+		DataShards: uint8(D), ParityShards: uint8(P),
+		ShardSize: uint32(shardSize),
+		Comment:   comment,
+	})
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(sw, r)
+	if err != nil {
+		return n, errors.Wrap(err, "copy")
+	}
+	return n, errors.Wrap(sw.Close(), "close")
+}
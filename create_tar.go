@@ -18,35 +18,82 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	// TarRevisionName encodes the ShardMetadata as JSON in the member name.
+	TarRevisionName = iota
+	// TarRevisionPAX uses clean member names (shard-000001.dat),
+	// and stores the ShardMetadata in PAX extended records.
+	TarRevisionPAX
+	// TarRevisionIndex appends an index.json member with the offset of each shard,
+	// and a fixed-size footer pointing at it.
+	TarRevisionIndex
+
+	// TarRevision is the revision CreateParFile writes.
+	TarRevision = TarRevisionIndex
+)
+
+// PAX record keys of the shard metadata.
+const (
+	paxIndex  = "PAR.index"
+	paxSize   = "PAR.size"
+	paxHash   = "PAR.hash"
+	paxStripe = "PAR.stripe"
+)
+
+const (
+	tarIndexName   = "index.json"
+	tarFooterName  = "index.footer"
+	tarFooterMagic = "PARTIDX1"
+	// tarFooterLength is the length of the footer: magic, offset and length of the index.json member.
+	tarFooterLength = len(tarFooterMagic) + 8 + 8
+	// tarFooterTail is the distance of the footer's content from the end of the archive:
+	// the footer's data block and the two zero blocks closing the archive.
+	tarFooterTail = 3 * 512
+)
+
+// tarIndexEntry is the position of a shard in the tar stream.
+type tarIndexEntry struct {
+	ShardMetadata
+	// Offset of the shard's (first) header in the tar stream.
+	Offset int64 `json:"o"`
+}
+
 var _ = io.WriteCloser((*rsTarWriter)(nil))
 
 type rsTarWriter struct {
 	rsEnc
 	w     *tar.Writer
+	cw    *countingWriter
 	meta  FileMetadata
 	Index uint32
+	index []tarIndexEntry
 }
 
 func NewRSTarWriter(w io.Writer, meta FileMetadata) (*rsTarWriter, error) {
-	tw := rsTarWriter{w: tar.NewWriter(w)}
-	tw.rsEnc = meta.newRSEnc(tw.writeShards)
+	cw := &countingWriter{w: w}
+	tw := rsTarWriter{w: tar.NewWriter(cw), cw: cw}
+	tw.rsEnc = newRSEnc(&meta, tw.writeShards)
 	tw.meta = meta
 	meta.FileName = filepath.Base(meta.FileName)
 	b, err := json.Marshal(meta)
 	if err != nil {
 		return nil, err
 	}
-	return &tw, tw.add("FileMetadata.json", b)
+	_, err = tw.add("FileMetadata.json", b, nil)
+	return &tw, err
 }
 
 var (
@@ -55,37 +102,69 @@ var (
 	now = time.Now()
 )
 
-func (rw *rsTarWriter) add(name string, data []byte) error {
-	if err := rw.w.WriteHeader(&tar.Header{
+// add the data as a new member, returning the offset of its header.
+func (rw *rsTarWriter) add(name string, data []byte, pax map[string]string) (int64, error) {
+	if err := rw.w.Flush(); err != nil {
+		return rw.cw.N, errors.Wrap(err, name)
+	}
+	offset := rw.cw.N
+	th := tar.Header{
 		Name: name,
 		Mode: 0444, Uid: uid, Gid: gid, Size: int64(len(data)),
 		ModTime: now,
-	}); err != nil {
-		return errors.Wrap(err, name)
+	}
+	if pax != nil {
+		th.Format, th.PAXRecords = tar.FormatPAX, pax
+	}
+	if err := rw.w.WriteHeader(&th); err != nil {
+		return offset, errors.Wrap(err, name)
 	}
 	_, err := rw.w.Write(data)
-	return err
+	return offset, err
 }
 
 func (rw *rsTarWriter) Close() error {
 	if rw.w == nil {
 		return nil
 	}
-	if rw.i == 0 {
-		return rw.w.Close()
+	var err error
+	if rw.i != 0 {
+		err = rw.WriteShards()
+	}
+	if err == nil && rw.meta.Revision >= TarRevisionIndex {
+		err = rw.writeIndex()
 	}
-	err := rw.WriteShards()
 	if closeErr := rw.w.Close(); closeErr != nil && err == nil {
 		err = closeErr
 	}
 	rw.data = nil
 	rw.slices = nil
 	rw.w = nil
+	rw.index = nil
+	return err
+}
+
+// writeIndex writes the index.json member, and the footer pointing at it.
+func (rw *rsTarWriter) writeIndex() error {
+	b, err := json.Marshal(rw.index)
+	if err != nil {
+		return errors.Wrap(err, "marshal index")
+	}
+	offset, err := rw.add(tarIndexName, b, nil)
+	if err != nil {
+		return err
+	}
+	footer := make([]byte, tarFooterLength)
+	copy(footer, tarFooterMagic)
+	binary.LittleEndian.PutUint64(footer[len(tarFooterMagic):], uint64(offset))
+	binary.LittleEndian.PutUint64(footer[len(tarFooterMagic)+8:], uint64(rw.cw.N-offset))
+	_, err = rw.add(tarFooterName, footer, nil)
 	return err
 }
 
 func (rw *rsTarWriter) writeShards(slices [][]byte, length int) error {
 	var buf bytes.Buffer
+	stripe := rw.Index / uint32(len(slices))
 	for i, b := range slices {
 		n := len(b)
 		isDataShard := i < int(rw.meta.DataShards)
@@ -106,18 +185,45 @@ func (rw *rsTarWriter) writeShards(slices [][]byte, length int) error {
 			Size:   uint32(n),
 			Hash32: hsh.Sum32(),
 		}
-		buf.Reset()
-		buf.WriteString("shard-")
-		if err := json.NewEncoder(&buf).Encode(sm); err != nil {
-			return errors.Wrapf(err, "marshal %#v", sm)
+		var fn string
+		var pax map[string]string
+		if rw.meta.Revision >= TarRevisionPAX {
+			fn = fmt.Sprintf("shard-%06d.dat", sm.Index)
+			pax = map[string]string{
+				paxIndex:  strconv.FormatUint(uint64(sm.Index), 10),
+				paxSize:   strconv.FormatUint(uint64(sm.Size), 10),
+				paxHash:   strconv.FormatUint(uint64(sm.Hash32), 10),
+				paxStripe: strconv.FormatUint(uint64(stripe), 10),
+			}
+		} else {
+			buf.Reset()
+			buf.WriteString("shard-")
+			if err := json.NewEncoder(&buf).Encode(sm); err != nil {
+				return errors.Wrapf(err, "marshal %#v", sm)
+			}
+			fn = string(append(bytes.TrimSpace(buf.Bytes()), []byte(".dat")...))
 		}
-		fn := string(append(bytes.TrimSpace(buf.Bytes()), []byte(".dat")...))
 		if isDataShard && rw.meta.OnlyParity {
 			b = nil
 		}
-		if err := rw.add(fn, b); err != nil {
+		offset, err := rw.add(fn, b, pax)
+		if err != nil {
 			return err
 		}
+		if rw.meta.Revision >= TarRevisionIndex {
+			rw.index = append(rw.index, tarIndexEntry{ShardMetadata: sm, Offset: offset})
+		}
 	}
 	return nil
 }
+
+type countingWriter struct {
+	w io.Writer
+	N int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+func init() {
+	container.Register(armorFormat{name: "ARMOR", version: VersionArmor, enc: armorBase64}, "armor64", "base64")
+	container.Register(armorFormat{name: "ARMOR85", version: VersionArmor85, enc: armorBase85}, "base85")
+}
+
+// armorFormat is the ASCII-armored format: checksummed lines of the metadata,
+// the shard headers and the content (base64 or base85 encoded), for text-only channels.
+type armorFormat struct {
+	name    string
+	version version
+	enc     *armorEncoding
+}
+
+func (f armorFormat) Version() container.Version { return f.version }
+func (f armorFormat) Name() string               { return f.name }
+
+func (f armorFormat) Detect(b []byte) bool { return strings.HasPrefix(string(b), f.enc.begin()) }
+
+func (f armorFormat) NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	meta.Version = f.version
+	aw, err := NewRSArmorWriter(w, meta, f.enc)
+	if err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// ReadHead reads the metadata line, and the header of the first shard.
+func (f armorFormat) ReadHead(parity container.Source) (container.Head, error) {
+	meta, br, err := readArmorHead(parity, f.enc)
+	if err != nil {
+		return container.Head{}, err
+	}
+	sm, err := firstShard(newArmorShardReader(parity.Name, f.enc, br))
+	return container.ShardHead(meta, sm), err
+}
+
+func (f armorFormat) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	meta, br, err := readArmorHead(parity, f.enc)
+	if err != nil {
+		return nil, errors.Wrap(err, parity.Name)
+	}
+	meta.Version = f.version
+	sr := &shardSequencer{src: newArmorShardReader(parity.Name, f.enc, br), layout: stripeLayoutOf(meta), data: data}
+	return newRSWriterTo(&meta, func(FileMetadata) nextShardFunc { return sr.next }), nil
+}
+
+// Dump writes the metadata of each file, or with opts.Packets,
+// each line with its state.
+func (f armorFormat) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	if !opts.Packets {
+		return container.DumpMetadata(w, files)
+	}
+	for _, fn := range files {
+		if err := dumpArmorLines(w, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpArmorLines lists the metadata and shard header lines of the file, and the damaged lines.
+func dumpArmorLines(w io.Writer, fn string) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	sc := bufio.NewScanner(fh)
+	sc.Buffer(nil, armorTailLength)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := sc.Text()
+		if strings.HasPrefix(line, armorBegin) || strings.HasPrefix(line, armorEnd) {
+			continue
+		}
+		tag, payload, err := parseArmorLine(line)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%d\tDAMAGED\t%v\n", fn, lineno, err)
+			continue
+		}
+		if tag != 'D' {
+			fmt.Fprintf(w, "%s\t%d\t%c\t%s\n", fn, lineno, tag, payload)
+		}
+	}
+	return errors.Wrap(sc.Err(), fn)
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+func init() { container.Register(binaryFormat{}, "binary") }
+
+// binaryFormat is the compact binary format: a checksummed superblock,
+// and the shards with fixed size headers and sync markers.
+type binaryFormat struct{}
+
+func (binaryFormat) Version() container.Version { return VersionBinary }
+func (binaryFormat) Name() string               { return "BIN" }
+
+func (binaryFormat) Detect(b []byte) bool { return bytes.HasPrefix(b, []byte(binMagic[:6])) }
+
+func (binaryFormat) NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	bw, err := NewRSBinaryWriter(w, meta)
+	if err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+// ReadHead reads the superblock and the metadata, and the header of the first shard.
+func (binaryFormat) ReadHead(parity container.Source) (container.Head, error) {
+	meta, sb, br, err := readBinaryHead(parity)
+	if err != nil {
+		return container.Head{}, err
+	}
+	sm, err := firstShard(newBinShardReader(parity.Name, sb, br))
+	return container.ShardHead(meta, sm), err
+}
+
+func (binaryFormat) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	meta, sb, br, err := readBinaryHead(parity)
+	if err != nil {
+		return nil, errors.Wrap(err, parity.Name)
+	}
+	sr := &shardSequencer{src: newBinShardReader(parity.Name, sb, br), layout: sb.stripeLayout, data: data}
+	return newRSWriterTo(&meta, func(FileMetadata) nextShardFunc { return sr.next }), nil
+}
+
+// Dump writes the metadata of each file, or with opts.Packets,
+// the shard headers at their offsets (computed from the superblock).
+func (binaryFormat) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	if !opts.Packets {
+		return container.DumpMetadata(w, files)
+	}
+	for _, fn := range files {
+		if err := dumpBinaryShards(w, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpBinaryShards lists the shard headers of the file, at the offsets computed from the superblock.
+func dumpBinaryShards(w io.Writer, fn string) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	_, sb, _, err := readBinaryHead(container.Source{Reader: bufio.NewReader(fh), Name: fn, ReaderAt: fh, Size: fi.Size()})
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	fmt.Fprintf(w, "%s\t0\tsuperblock\t%+v\n", fn, sb)
+	b := make([]byte, binHeaderLength)
+	for index := uint32(1); sb.Size >= 0 && int64(index) <= sb.shardCount(); index++ {
+		offset := sb.shardOffset(index)
+		state := "ok"
+		sm, ok := ShardMetadata{}, false
+		if _, err := fh.ReadAt(b, offset); err == nil {
+			sm, ok = decodeBinHeader(b)
+		}
+		if !ok || sm.Index != index {
+			state = "DAMAGED"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\n", fn, offset, state, index, sm.Size, sm.Hash32)
+	}
+	return nil
+}
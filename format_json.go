@@ -0,0 +1,76 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+func init() { container.Register(jsonFormat{}) }
+
+// jsonFormat is the stream of the JSON metadata and shards.
+type jsonFormat struct{}
+
+func (jsonFormat) Version() container.Version { return VersionJSON }
+func (jsonFormat) Name() string               { return "JSON" }
+
+func (jsonFormat) Detect(b []byte) bool { return len(b) > 0 && b[0] == '{' }
+
+func (jsonFormat) NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	jw, err := NewRSJSONWriter(w, meta)
+	if err != nil {
+		return nil, err
+	}
+	return jw, nil
+}
+
+// ReadHead reads the metadata, and the first shard metadata.
+func (jsonFormat) ReadHead(parity container.Source) (container.Head, error) {
+	var meta FileMetadata
+	var sm ShardMetadata
+	dec := json.NewDecoder(parity)
+	if err := dec.Decode(&meta); err != nil {
+		return container.Head{}, errors.Wrap(err, "read metadata")
+	}
+	if err := dec.Decode(&sm); err != nil && err != io.EOF {
+		return container.Head{FileMetadata: meta}, errors.Wrap(err, "read shard metadata")
+	}
+	return container.ShardHead(meta, sm), nil
+}
+
+func (jsonFormat) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	var meta FileMetadata
+	var buf bytes.Buffer
+	dec := json.NewDecoder(io.TeeReader(parity, &buf))
+	if err := dec.Decode(&meta); err != nil {
+		return nil, errors.Wrapf(err, "read metadata %s", buf.Bytes())
+	}
+	meta.Version = VersionJSON
+	rest := rewind(dec.Buffered(), parity)
+	return newRSWriterTo(&meta, func(meta FileMetadata) nextShardFunc {
+		return newJSONNextShard(meta, bufio.NewReader(rest), data)
+	}), nil
+}
+
+func (jsonFormat) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	return container.DumpMetadata(w, files)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+	"github.com/tgulacsi/par/par2"
+)
+
+func init() { container.Register(par2Format{}, "par") }
+
+// par2Format is the PAR2 recovery set.
+type par2Format struct{}
+
+func (par2Format) Version() container.Version { return VersionPAR2 }
+func (par2Format) Name() string               { return "PAR2" }
+
+func (par2Format) Detect(b []byte) bool { return bytes.HasPrefix(b, []byte("PAR2\000")) }
+
+// CanEmbed is false: the recovery set stores only the recovery slices.
+func (par2Format) CanEmbed() bool { return false }
+
+func (par2Format) NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	pw, err := NewPAR2Writer(w, meta)
+	if err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// ReadHead makes up the metadata from the first file of the recovery set,
+// which is identified by the MD5 of its first 16KiB.
+func (par2Format) ReadHead(parity container.Source) (container.Head, error) {
+	info := par2.ParInfo{ParFiles: []string{parity.Name}}
+	if err := info.Parse(); err != nil {
+		return container.Head{}, err
+	}
+	if len(info.Files) == 0 || info.Main == nil {
+		return container.Head{}, errors.New("empty par file: " + parity.Name)
+	}
+	file := info.Files[0]
+	fd := file.FileDescPacket
+	head := container.Head{FileMetadata: FileMetadata{
+		FileName: file.Name(), Size: int64(fd.FileLength),
+		ShardSize: uint32(info.Main.BlockSize), OnlyParity: true,
+	}}
+	head.HeadLength, head.HeadHash, head.NewHash = 16<<10, fd.MiniMD5[:], md5.New
+	if head.Size < head.HeadLength {
+		head.HeadLength = head.Size
+	}
+	return head, nil
+}
+
+func (par2Format) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	return newPAR2WriterTo(parity, data, opts.DataName, opts.Set)
+}
+
+// Dump writes each recovery set (or the one chosen by opts.Set) as JSON,
+// or with opts.Packets, each packet with its offset.
+func (par2Format) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	if opts.Packets {
+		for _, fn := range files {
+			if err := dumpPAR2Packets(w, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sets, err := par2.ParseSets(files)
+	if err != nil {
+		return err
+	}
+	if opts.Set != "" && opts.Set != "all" {
+		set, err := par2.FindSet(sets, opts.Set)
+		if err != nil {
+			return err
+		}
+		sets = []*par2.ParInfo{set}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	for _, set := range sets {
+		if err := enc.Encode(set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpPAR2Packets lists the packets of the PAR2 file, with their offsets and damage.
+func dumpPAR2Packets(w io.Writer, fn string) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	scanner := par2.NewScanner(fh)
+	for scanner.Scan() {
+		h := scanner.Header()
+		state := "ok"
+		if h.Damaged {
+			state = "DAMAGED"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%q\t%s\n", fn, scanner.Offset(), state, h.Type[:],
+			strings.Replace(fmt.Sprint(scanner.Packet()), "\n", " ", -1))
+	}
+	if n := scanner.Skipped(); n != 0 {
+		fmt.Fprintf(w, "%s\tskipped %d bytes of garbage\n", fn, n)
+	}
+	return scanner.Err()
+}
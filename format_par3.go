@@ -0,0 +1,109 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+	"github.com/tgulacsi/par/par3"
+)
+
+func init() { container.Register(par3Format{}) }
+
+// par3Format is the PAR3 input set.
+type par3Format struct{}
+
+func (par3Format) Version() container.Version { return VersionPAR3 }
+func (par3Format) Name() string               { return "PAR3" }
+
+func (par3Format) Detect(b []byte) bool { return bytes.HasPrefix(b, []byte("PAR3\000PKT")) }
+
+// CanEmbed is false: the recovery set stores only the recovery blocks.
+func (par3Format) CanEmbed() bool { return false }
+
+func (par3Format) NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	pw, err := NewPAR3Writer(w, meta)
+	if err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// ReadHead makes up the metadata from the first file of the input set,
+// which is identified by the CRC64 of its first 16KiB.
+func (par3Format) ReadHead(parity container.Source) (container.Head, error) {
+	info, err := par3.Stat(parity.Name)
+	if err != nil {
+		return container.Head{}, err
+	}
+	if len(info.Files) == 0 {
+		return container.Head{}, errors.New("empty par file: " + parity.Name)
+	}
+	file := info.Files[0]
+	head := container.Head{FileMetadata: FileMetadata{
+		FileName: file.Path, Size: file.Size(),
+		ShardSize: uint32(info.BlockSize()), OnlyParity: true,
+	}}
+	head.HeadLength = 16 << 10
+	if head.Size < head.HeadLength {
+		head.HeadLength = head.Size
+	}
+	head.HeadHash = make([]byte, 8)
+	binary.BigEndian.PutUint64(head.HeadHash, file.Hash16k)
+	head.NewHash = func() hash.Hash { return crc64.New(par3CRC64Table) }
+	return head, nil
+}
+
+func (par3Format) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	return newPAR3WriterTo(parity, data, opts.DataName)
+}
+
+// Dump writes the input set as JSON, or with opts.Packets, the good packets one by one.
+func (par3Format) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	if opts.Packets {
+		for _, fn := range files {
+			if err := dumpPAR3Packets(w, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	info := par3.ParInfo{ParFiles: files, BaseDir: filepath.Dir(files[0])}
+	if err := info.Parse(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+// dumpPAR3Packets lists the good packets of the PAR3 file (the damaged ones are logged).
+func dumpPAR3Packets(w io.Writer, fn string) error {
+	packets, err := par3.ReadFile(fn)
+	for _, p := range packets {
+		fmt.Fprintf(w, "%s\t%v\n", fn, p)
+	}
+	return err
+}
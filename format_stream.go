@@ -0,0 +1,98 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+func init() { container.Register(streamFormat{}) }
+
+// streamFormat is the stream of self-synchronising frames of the data and parity shards,
+// for pipes and tapes (par encode | par decode).
+type streamFormat struct{}
+
+func (streamFormat) Version() container.Version { return VersionStream }
+func (streamFormat) Name() string               { return "STREAM" }
+
+func (streamFormat) Detect(b []byte) bool { return bytes.HasPrefix(b, []byte(streamSync)) }
+
+func (streamFormat) NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	meta.Version = VersionStream
+	sw, err := NewRSStreamWriter(w, meta)
+	if err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// ReadHead reads the metadata frame, and the first shard frame.
+func (streamFormat) ReadHead(parity container.Source) (container.Head, error) {
+	meta, sm, err := readStreamHead(parity.Name, parity)
+	return container.ShardHead(meta, sm), err
+}
+
+// NewShardReader returns the decoder of the stream; the data is not needed, as it is in the stream.
+func (streamFormat) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	return newStreamDecoder(parity.Name, parity.Reader), nil
+}
+
+// Dump writes the metadata of each file, or with opts.Packets,
+// each good frame with its offset.
+func (streamFormat) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	if !opts.Packets {
+		return container.DumpMetadata(w, files)
+	}
+	for _, fn := range files {
+		if err := dumpStreamFrames(w, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpStreamFrames lists the good frames of the file, with their offsets.
+func dumpStreamFrames(w io.Writer, fn string) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	sr := newStreamReader(fn, fh)
+	for {
+		f, content, err := sr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, fn)
+		}
+		switch {
+		case f.Flags&streamFlagMeta != 0:
+			fmt.Fprintf(w, "%s\t%d\tmeta\t%s\n", fn, sr.at, content)
+		case f.Flags&streamFlagEnd != 0:
+			fmt.Fprintf(w, "%s\t%d\tend\t%d\n", fn, sr.at, f.Stripe)
+		default:
+			fmt.Fprintf(w, "%s\t%d\tshard\t%d\t%d\t%d\t%d\n", fn, sr.at, f.Stripe, f.Idx, len(content), f.ContentCRC)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+func init() { container.Register(tarFormat{}) }
+
+// tarFormat is the TAR archive of the shards, with the metadata in FileMetadata.json.
+type tarFormat struct{}
+
+func (tarFormat) Version() container.Version { return VersionTAR }
+func (tarFormat) Name() string               { return "TAR" }
+
+func (tarFormat) Detect(b []byte) bool {
+	// "ustar\000" + "00" (POSIX) or "ustar  \000" (GNU) at byte offset 257
+	return len(b) >= 257+5 && bytes.Equal(b[257:257+5], []byte("ustar"))
+}
+
+func (tarFormat) NewWriter(w io.Writer, meta FileMetadata) (io.WriteCloser, error) {
+	tw, err := NewRSTarWriter(w, meta)
+	if err != nil {
+		return nil, err
+	}
+	return tw, nil
+}
+
+// ReadHead reads FileMetadata.json, and the metadata of the first shard.
+func (tarFormat) ReadHead(parity container.Source) (container.Head, error) {
+	var meta FileMetadata
+	tr := tar.NewReader(parity)
+	if _, err := tr.Next(); err != nil {
+		return container.Head{}, err
+	}
+	if err := json.NewDecoder(tr).Decode(&meta); err != nil {
+		return container.Head{}, errors.Wrap(err, "read metadata")
+	}
+	for {
+		th, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return container.Head{FileMetadata: meta}, nil
+			}
+			return container.Head{FileMetadata: meta}, err
+		}
+		sm, ok, err := tarShardMetadata(th, int(meta.DataShards)+int(meta.ParityShards))
+		if err != nil {
+			return container.Head{FileMetadata: meta}, err
+		} else if ok {
+			return container.ShardHead(meta, sm), nil
+		}
+	}
+}
+
+func (tarFormat) NewShardReader(parity container.Source, data io.Reader, opts container.ReadOptions) (io.WriterTo, error) {
+	var meta FileMetadata
+	tr := tar.NewReader(parity)
+	th, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if th.Name != "FileMetadata.json" {
+		return nil, errors.Errorf("First item should be FileMetadata.json, got %q", th.Name)
+	}
+	var buf bytes.Buffer
+	if err = json.NewDecoder(io.TeeReader(tr, &buf)).Decode(&meta); err != nil {
+		return nil, errors.Wrap(err, buf.String())
+	}
+	meta.Version = VersionTAR
+	if parity.ReaderAt != nil {
+		ix, err := readTarIndex(parity.ReaderAt, parity.Size, int(meta.DataShards)+int(meta.ParityShards))
+		if err == nil {
+			ix.Reader = tr
+			return newRSWriterTo(&meta, func(meta FileMetadata) nextShardFunc {
+				return newTarIndexNextShard(meta, ix, data)
+			}), nil
+		}
+		if err != errNoTarIndex {
+			log.Printf("read index: %v", err)
+		}
+	}
+	return newRSWriterTo(&meta, func(meta FileMetadata) nextShardFunc {
+		return newTarNextShard(meta, tr, data)
+	}), nil
+}
+
+func (tarFormat) Dump(w io.Writer, files []string, opts container.DumpOptions) error {
+	return container.DumpMetadata(w, files)
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+var errDataFileNotFound = errors.New("data file not found")
+
+// dataFileID identifies the data file of a parity file by its size and head.
+type dataFileID struct {
+	Name string
+	// Size of the data file, -1 if unknown.
+	Size int64
+	// HeadHash is the hash of the first HeadLength bytes, computed by NewHash.
+	HeadLength int64
+	HeadHash   []byte
+	NewHash    func() hash.Hash
+	// Embedded is true if the data is embedded in the parity file.
+	Embedded bool
+}
+
+// LocateDataFile returns the data file of the parity file parFn.
+//
+// The stored file name is tried first (next to parFn, then in the current directory),
+// then the name of the parity file without its extension.
+// If none of them has the same size and first shard, but one exists, it is returned
+// (as the damaged data file, to be repaired by the restore);
+// only if none exists, the files under searchDir (if not empty) are checked by their size and first shard.
+//
+// Returns an empty name if the data is embedded in the parity file.
+func LocateDataFile(parFn, searchDir string) (string, error) {
+	id, err := readDataFileID(parFn)
+	if err != nil {
+		return "", err
+	}
+	if id.Embedded {
+		return "", nil
+	}
+	var damaged string
+	for _, fn := range []string{
+		filepath.Join(filepath.Dir(parFn), id.Name),
+		id.Name,
+		strings.TrimSuffix(parFn, filepath.Ext(parFn)),
+	} {
+		if fn == parFn {
+			continue
+		}
+		if ok, err := id.Matches(fn); ok {
+			return fn, nil
+		} else if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			log.Printf("check %q: %v", fn, err)
+		}
+		if fi, err := os.Stat(fn); damaged == "" && err == nil && fi.Mode().IsRegular() {
+			damaged = fn
+		}
+	}
+	if damaged != "" {
+		log.Printf("%q does not match the parity file, restoring it as damaged.", damaged)
+		return damaged, nil
+	}
+	if searchDir == "" {
+		return "", errors.Wrap(errDataFileNotFound, id.Name)
+	}
+
+	var found string
+	errFound := errors.New("found")
+	err = filepath.Walk(searchDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("walk %q: %v", path, err)
+			return nil
+		}
+		if !fi.Mode().IsRegular() || id.Size >= 0 && fi.Size() != id.Size {
+			return nil
+		}
+		if ok, err := id.Matches(path); err != nil {
+			log.Printf("check %q: %v", path, err)
+		} else if ok {
+			found = path
+			return errFound
+		}
+		return nil
+	})
+	if found != "" {
+		log.Printf("Found %q as %q.", id.Name, found)
+		return found, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", errors.Wrapf(errDataFileNotFound, "%s in %s", id.Name, searchDir)
+}
+
+// Matches reports whether the file fn has the same size and head as the data file.
+func (id dataFileID) Matches(fn string) (bool, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return false, errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, fn)
+	}
+	if !fi.Mode().IsRegular() || id.Size >= 0 && fi.Size() != id.Size {
+		return false, nil
+	}
+	if id.NewHash == nil { // the head is unknown
+		return true, nil
+	}
+	hsh := id.NewHash()
+	if n, err := io.CopyN(hsh, fh, id.HeadLength); err != nil {
+		if err != io.EOF || n != id.HeadLength {
+			return false, nil
+		}
+	}
+	return bytes.Equal(hsh.Sum(nil), id.HeadHash), nil
+}
+
+// readDataFileID reads the identification of the data file from the parity file.
+func readDataFileID(parFn string) (dataFileID, error) {
+	id := dataFileID{Size: -1}
+	head, err := container.ReadHead(parFn)
+	if err != nil {
+		return id, err
+	}
+	id.Name, id.Embedded = head.FileName, !head.OnlyParity
+	if head.Size > 0 {
+		id.Size = head.Size
+	}
+	id.HeadLength, id.HeadHash, id.NewHash = head.HeadLength, head.HeadHash, head.NewHash
+	return id, nil
+}
+
+// ReadFileMetadata reads the FileMetadata stored in the parity file.
+func ReadFileMetadata(parFn string) (FileMetadata, error) {
+	head, err := container.ReadHead(parFn)
+	return head.FileMetadata, err
+}
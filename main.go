@@ -16,24 +16,36 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"log"
 	"os"
 	"strings"
 
-	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
 	"github.com/tgulacsi/par/par2"
+	"github.com/tgulacsi/par/par3"
+)
+
+// The formats, and their metadata are in the container package.
+type (
+	version       = container.Version
+	FileMetadata  = container.FileMetadata
+	ShardMetadata = container.ShardMetadata
 )
 
 const (
-	VersionJSON = version(iota)
-	VersionPAR2
-	VersionTAR
+	VersionJSON    = container.VersionJSON
+	VersionPAR2    = container.VersionPAR2
+	VersionTAR     = container.VersionTAR
+	VersionPAR3    = container.VersionPAR3
+	VersionBinary  = container.VersionBinary
+	VersionArmor   = container.VersionArmor
+	VersionArmor85 = container.VersionArmor85
+	VersionStream  = container.VersionStream
 
 	DefaultVersion      = VersionTAR
 	DefaultShardSize    = 128 << 10
@@ -41,42 +53,7 @@ const (
 	DefaultParityShards = 3
 )
 
-var ErrUnknownVersion = errors.New("unknown version")
-
-type version uint8
-
-func (v version) String() string {
-	switch v {
-	case VersionJSON:
-		return "JSON"
-	case VersionPAR2:
-		return "PAR2"
-	case VersionTAR:
-		return "TAR"
-	default:
-		return fmt.Sprintf("V%02", v)
-	}
-}
-
-// Need to save the metadata of:
-//   1. file (real data) size
-//   2. number of data/parity shards
-//   3. hash of each shard (to know which shard has to be reconstructeed
-//   4. order of the shards
-//
-type FileMetadata struct {
-	Version      version `json:"V"`
-	DataShards   uint8   `json:"DS"`
-	ParityShards uint8   `json:"PS"`
-	ShardSize    uint32  `json:"S"`
-	FileName     string  `json:"F"`
-	OnlyParity   bool    `json:"OP"`
-}
-type ShardMetadata struct {
-	Index  uint32 `json:"i"`
-	Size   uint32 `json:"s"`
-	Hash32 uint32 `json:"h"`
-}
+var ErrUnknownVersion = container.ErrUnknownVersion
 
 func main() {
 	todo := "create"
@@ -85,16 +62,41 @@ func main() {
 		os.Args = os.Args[1:]
 	}
 	var redundancy, shardSize int
-	var verS string
+	var verS, comment string
+	var embed bool
 	createFlags := flag.NewFlagSet("create", flag.ExitOnError)
 	createFlags.IntVar(&redundancy, "r", 30, "data shards")
 	createFlags.IntVar(&shardSize, "s", DefaultShardSize, "shard size")
-	createFlags.StringVar(&verS, "type", "tar", "version to create (tar|json|par3)")
+	createFlags.StringVar(&verS, "type", "tar", "version to create ("+strings.Join(container.Names(), "|")+")")
+	createFlags.BoolVar(&embed, "embed", false, "embed the data shards, too (restore won't need the original file)")
+	createFlags.StringVar(&comment, "comment", "", "comment to store in the parity file")
 
 	restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
 	flagOut := restoreFlags.String("o", "-", "output")
+	flagDir := restoreFlags.String("dir", "", "directory to search the (renamed/moved) file in")
+	flagAttrs := restoreFlags.Bool("attrs", false, "restore the file attributes (mode, owner, mtime, xattrs) of the output")
+	flagRestoreSet := restoreFlags.String("set", "", "PAR2 recovery set ID (prefix) to restore from, if there are several")
+
+	repairFlags := flag.NewFlagSet("repair", flag.ExitOnError)
+	flagRepairSet := repairFlags.String("set", "", "PAR2 recovery set ID (prefix) to repair, if there are several")
+	flagNoBackup := repairFlags.Bool("nobackup", false, "remove the damaged files, instead of keeping them as .1")
+	flagScan := repairFlags.Bool("scan", false, "search the directory for the misnamed files")
+
+	planFlags := flag.NewFlagSet("plan", flag.ExitOnError)
+	flagPlanSet := planFlags.String("set", "", "PAR2 recovery set ID (prefix) to plan the repair of, if there are several")
+	flagPlanScan := planFlags.Bool("scan", false, "search the directory for the misnamed files")
+	flagPlanJSON := planFlags.Bool("json", false, "print the plan as JSON")
+
+	encodeFlags := flag.NewFlagSet("encode", flag.ExitOnError)
+	encodeFlags.IntVar(&redundancy, "r", 30, "data shards")
+	encodeFlags.IntVar(&shardSize, "s", DefaultShardSize, "shard size")
+	encodeFlags.StringVar(&comment, "comment", "", "comment to store in the stream")
+
+	decodeFlags := flag.NewFlagSet("decode", flag.ExitOnError)
 
 	dumpFlags := flag.NewFlagSet("dump", flag.ExitOnError)
+	flagDumpSet := dumpFlags.String("set", "all", "PAR2 recovery set ID (prefix) to dump, or all")
+	flagDumpPackets := dumpFlags.Bool("packets", false, "list the PAR2 packets one by one, with their offsets (for damaged or partial files)")
 
 	var flagSet *flag.FlagSet
 	switch todo {
@@ -102,6 +104,14 @@ func main() {
 		todo, flagSet = "create", createFlags
 	case "r", "restore":
 		todo, flagSet = "restore", restoreFlags
+	case "repair":
+		todo, flagSet = "repair", repairFlags
+	case "plan":
+		todo, flagSet = "plan", planFlags
+	case "encode":
+		todo, flagSet = "encode", encodeFlags
+	case "decode":
+		todo, flagSet = "decode", decodeFlags
 	case "d", "dump":
 		todo, flagSet = "dump", dumpFlags
 	default:
@@ -114,13 +124,51 @@ func main() {
 Restore the file from the parity:
 
 	par restore <file.par> [file]
+
+The file is not needed if the data is embedded (create -embed).
+Without the file, the stored name is tried first, then the -dir is searched
+for a file with the same size and first shard.
 `)
 		restoreFlags.PrintDefaults()
 		fmt.Fprintf(os.Stderr, `
 
+Repair the files of a PAR2 recovery set in place (the damaged ones are kept as .1):
+
+	par repair <file.par2> [candidate...]
+	par repair <file.par3>
+
+The missing or damaged files are searched among the candidates (and with -scan,
+all the files in the directory) by their size and MD5, and renamed if found.
+The still missing blocks are searched at any offset of the damaged files and the candidates.
+A PAR3 input set is repaired with its directory tree (the chunks of the damaged files are reused).
+`)
+		repairFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, `
+
+List the missing blocks, the recovery blocks in each vol file,
+and the fewest vol files needed for the repair:
+
+	par plan <file.par2> [candidate...]
+`)
+		planFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, `
+
+Encode the standard input to a stream of the data and parity shards, and decode it
+(repairing the lost or damaged frames on the fly, without seeking), for pipes and tapes:
+
+	tar c dir | par encode | ssh host 'par decode | tar x'
+`)
+		encodeFlags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, `
+
 Dump the file's contents for debugging:
 
-	par dump <file.par>
+	par dump <file.par>...
+
+For PAR2, each recovery set (or just the one chosen with -set) is dumped,
+or with -packets, each packet with its offset; for TAR, JSON, BIN, ARMOR and STREAM, the metadata
+(for BIN with -packets, each shard header at its offset; for ARMOR, the header lines and the damaged lines;
+for STREAM, each good frame at its offset).
 `)
 		dumpFlags.PrintDefaults()
 
@@ -135,66 +183,151 @@ Dump the file's contents for debugging:
 		if len(flagSet.Args()) > 1 {
 			out = flagSet.Arg(1)
 		}
-		ver := VersionTAR
-		switch verS {
-		case "json":
-			ver = VersionJSON
-		case "par", "par2":
-			ver = VersionPAR2
-		case "tar":
-			ver = VersionTAR
-		default:
-			fmt.Fprintf(os.Stderr, "Unknown version %q. Known versions: json, tar, par2.")
-			os.Exit(1)
-		}
-		var dataShards, parityShards int
-		if redundancy%10 == 0 {
-			dataShards, parityShards = 10, redundancy/10
-		} else {
-			dataShards, parityShards = 100, redundancy
-		}
-		if err := ver.CreateParFile(out, inp, dataShards, parityShards, shardSize); err != nil {
+		format, err := container.Lookup(verS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ver := format.Version()
+		dataShards, parityShards := shardCounts(redundancy)
+		if err := CreateParFile(ver, out, inp, dataShards, parityShards, shardSize, embed, comment); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "encode":
+		dataShards, parityShards := shardCounts(redundancy)
+		w := bufio.NewWriter(os.Stdout)
+		if _, err := EncodeStream(w, os.Stdin, dataShards, parityShards, shardSize, comment); err != nil {
+			log.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "decode":
+		w := bufio.NewWriter(os.Stdout)
+		n, err := DecodeStream(w, os.Stdin, "stdin")
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+		log.Printf("Written %d bytes.", n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "repair":
+		if flagSet.NArg() == 0 {
+			log.Fatal("the par2 file is needed")
+		}
+		if format, err := container.DetectFile(flagSet.Arg(0)); err == nil && format.Version() == VersionPAR3 {
+			info, err := par3.Stat(flagSet.Arg(0))
+			if err != nil {
+				log.Fatal(err)
+			}
+			names, err := par3.Repair(info, par3.RepairOptions{NoBackup: *flagNoBackup})
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(names) == 0 {
+				log.Printf("Input set %s: repair not needed.", info.InputSetID)
+			}
+			return
+		}
+		sets, err := par2.StatSets(flagSet.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *flagRepairSet != "" {
+			set, err := par2.FindSet(sets, *flagRepairSet)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sets = []*par2.ParInfo{set}
+		}
+		for _, set := range sets {
+			names, err := par2.Repair(set, par2.RepairOptions{
+				NoBackup: *flagNoBackup, ScanDir: *flagScan, Candidates: flagSet.Args()[1:],
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(names) == 0 {
+				log.Printf("Recovery set %s: repair not needed.", set.RecoverySetID)
+			}
+		}
+		return
+	case "plan":
+		if flagSet.NArg() == 0 {
+			log.Fatal("the par2 file is needed")
+		}
+		sets, err := par2.StatSets(flagSet.Arg(0))
+		if err != nil {
 			log.Fatal(err)
 		}
+		if *flagPlanSet != "" {
+			set, err := par2.FindSet(sets, *flagPlanSet)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sets = []*par2.ParInfo{set}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		for _, set := range sets {
+			candidates := flagSet.Args()[1:]
+			if *flagPlanScan {
+				dirCandidates, err := set.DirCandidates()
+				if err != nil {
+					log.Fatal(err)
+				}
+				candidates = append(candidates[:len(candidates):len(candidates)], dirCandidates...)
+			}
+			plan := par2.NewPlan(set, par2.Verify(set, candidates...))
+			if *flagPlanJSON {
+				enc.Encode(plan)
+				continue
+			}
+			fmt.Printf("Recovery set %s:\n", set.RecoverySetID)
+			plan.WriteTo(os.Stdout)
+		}
 		return
 	case "dump":
+		if flagSet.NArg() == 0 {
+			log.Fatal("the parity file is needed")
+		}
 		files := flagSet.Args()
 		fh, err := os.Open(files[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fh.Close()
 		var a [1024]byte
 		n, err := io.ReadAtLeast(fh, a[:], 512)
 		if err != nil && n < 8 {
 			log.Fatal(err)
 		}
-		b := a[:n]
-		ver := VersionTAR
-		if len(b) > 256 && bytes.Contains(b[256:], []byte("\000ustar  \000")) {
-			ver = VersionTAR
-		} else if len(b) > 1 && b[0] == '{' {
-			ver = VersionJSON
-		} else {
-			ver = VersionPAR2
+		format, err := container.Detect(a[:n])
+		if err != nil {
+			// the PAR2 packets are found after garbage, too
+			format = par2Format{}
 		}
-
-		switch ver {
-		case VersionPAR2:
-			stat := &par2.ParInfo{
-				ParFiles: files,
-			}
-			if err := stat.Parse(); err != nil {
-				log.Fatal(err)
-			}
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetIndent("", "  ")
-			enc.Encode(stat)
-		default:
-			log.Fatal(errors.Errorf("dumping version %s not implemented", ver))
+		if err := format.Dump(os.Stdout, files, container.DumpOptions{Set: *flagDumpSet, Packets: *flagDumpPackets}); err != nil {
+			log.Fatal(err)
 		}
 		return
 	}
+	// before writing the whole file to the standard output
+	if *flagAttrs && (*flagOut == "" || *flagOut == "-") {
+		log.Fatal("-attrs needs an output file (-o)")
+	}
 	parFn := flagSet.Arg(0)
-	fileName := strings.TrimSuffix(parFn, ".par")
+	var fileName string
 	if len(flagSet.Args()) > 1 {
 		fileName = flagSet.Arg(1)
+	} else {
+		var err error
+		if fileName, err = LocateDataFile(parFn, *flagDir); err != nil {
+			log.Fatal(err)
+		}
 	}
 	w := io.WriteCloser(os.Stdout)
 	if !(*flagOut == "" || *flagOut == "-") {
@@ -204,12 +337,31 @@ Dump the file's contents for debugging:
 		}
 		defer w.Close()
 	}
-	if err := RestoreParFile(w, parFn, fileName); err != nil {
+	if err := RestoreParFile(w, parFn, fileName, *flagRestoreSet); err != nil {
 		log.Fatal(err)
 	}
 	if err := w.Close(); err != nil {
 		log.Fatal(err)
 	}
+	if *flagAttrs {
+		meta, err := ReadFileMetadata(parFn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if meta.Attrs == nil {
+			log.Printf("No file attributes stored in %q.", parFn)
+		} else if err := applyAttrs(*meta.Attrs, *flagOut); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// shardCounts returns the data and parity shard counts of the redundancy (in percent).
+func shardCounts(redundancy int) (int, int) {
+	if redundancy%10 == 0 {
+		return 10, redundancy / 10
+	}
+	return 100, redundancy
 }
 
 func zero(p []byte) {
@@ -218,7 +370,7 @@ func zero(p []byte) {
 	}
 }
 
-var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+var crc32cTable = container.CRC32C
 
 type errReader struct{ err error }
 
@@ -0,0 +1,281 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// BlockLocation is the place of a block.
+type BlockLocation struct {
+	File   string
+	Offset int64
+}
+
+// blockRef identifies a block of the recovery set: the index of the file, and of the block in the file.
+type blockRef struct{ file, block int }
+
+// blockScanner searches the missing blocks at any offset of files,
+// with a rolling CRC32 window, the hits are confirmed with MD5.
+type blockScanner struct {
+	blockSize int
+	files     []*File
+	// full are the missing full blocks by their CRC32,
+	// tails the missing (shorter) last blocks by their length.
+	full  map[uint32][]blockRef
+	tails map[int][]blockRef
+	// filter has the bits of the low 16 bits of the CRC32s in full.
+	filter    [1 << 16 / 64]uint64
+	found     map[blockRef]BlockLocation
+	remaining int
+
+	// outTable[b] is the CRC (without conditioning) of b followed by blockSize zeros,
+	// zeroCRC is the CRC32 of blockSize zeros.
+	outTable [256]uint32
+	zeroCRC  uint32
+}
+
+func newBlockScanner(files []*File, blockSize int, missing []blockRef) *blockScanner {
+	s := blockScanner{
+		blockSize: blockSize, files: files,
+		full: make(map[uint32][]blockRef), tails: make(map[int][]blockRef),
+		found: make(map[blockRef]BlockLocation, len(missing)),
+	}
+	for _, ref := range missing {
+		file := files[ref.file]
+		if length := file.BlockLength(blockSize, ref.block); length < blockSize {
+			s.tails[length] = append(s.tails[length], ref)
+		} else {
+			crc := binary.LittleEndian.Uint32(file.Pairs[ref.block].CRC32[:])
+			s.full[crc] = append(s.full[crc], ref)
+			s.filter[(crc&0xffff)/64] |= 1 << (crc % 64)
+		}
+	}
+	s.remaining = len(missing)
+
+	zeros := make([]byte, blockSize)
+	s.zeroCRC = crc32.ChecksumIEEE(zeros)
+	// the table is linear in the bits of the byte
+	var bitTable [8]uint32
+	for k := range bitTable {
+		r := crcUpdate(0, byte(1<<uint(k)))
+		for range zeros {
+			r = crcUpdate(r, 0)
+		}
+		bitTable[k] = r
+	}
+	for b := range s.outTable {
+		for k, t := range bitTable {
+			if b&(1<<uint(k)) != 0 {
+				s.outTable[b] ^= t
+			}
+		}
+	}
+	return &s
+}
+
+// crcUpdate is the CRC32 (IEEE) update of the register with the byte, without the pre- and post-conditioning.
+func crcUpdate(r uint32, c byte) uint32 {
+	return crc32.IEEETable[byte(r)^c] ^ (r >> 8)
+}
+
+// Found returns the location of the found block.
+func (s *blockScanner) Found(ref blockRef) (BlockLocation, bool) {
+	loc, ok := s.found[ref]
+	return loc, ok
+}
+
+// scanFile searches the missing blocks in the file.
+func (s *blockScanner) scanFile(fn string) error {
+	if s.remaining == 0 {
+		return nil
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	br := bufio.NewReaderSize(fh, 1<<20)
+
+	n := s.blockSize
+	ring := make([]byte, n)
+	var r uint32
+	var count, pos int
+	var offset int64
+	// after a found block, its successor may be the shorter last block
+	var expect []blockRef
+	for s.remaining > 0 {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrap(err, fn)
+		}
+		offset++
+		out := ring[pos]
+		ring[pos] = c
+		if pos++; pos == n {
+			pos = 0
+		}
+		r = crcUpdate(r, c)
+		if count < n {
+			count++
+			if len(expect) != 0 && count == s.files[expect[0].file].BlockLength(n, expect[0].block) {
+				s.matchTail(expect, ring[:count], fn, offset-int64(count))
+				expect = nil
+			}
+			if count < n {
+				continue
+			}
+		} else {
+			r ^= s.outTable[out]
+		}
+
+		crc := r ^ s.zeroCRC
+		if s.filter[(crc&0xffff)/64]&(1<<(crc%64)) == 0 {
+			continue
+		}
+		refs := s.full[crc]
+		if len(refs) == 0 {
+			continue
+		}
+		window := append(append(make([]byte, 0, n), ring[pos:]...), ring[:pos]...)
+		if !s.match(refs, md5.Sum(window), fn, offset-int64(n)) {
+			continue
+		}
+		// skip the found block, and expect the successor
+		count, r, pos = 0, 0, 0
+		expect = expect[:0]
+		for _, ref := range refs {
+			next := blockRef{file: ref.file, block: ref.block + 1}
+			if next.block < len(s.files[next.file].Pairs) && s.files[next.file].BlockLength(n, next.block) < n {
+				if _, ok := s.found[next]; !ok {
+					expect = append(expect, next)
+				}
+			}
+		}
+	}
+
+	// the shorter last blocks at the end of the file
+	fi, err := fh.Stat()
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	for length, refs := range s.tails {
+		if s.remaining == 0 {
+			break
+		}
+		if int64(length) > fi.Size() {
+			continue
+		}
+		b := make([]byte, length)
+		if _, err := fh.ReadAt(b, fi.Size()-int64(length)); err != nil {
+			return errors.Wrap(err, fn)
+		}
+		s.matchTail(refs, b, fn, fi.Size()-int64(length))
+	}
+	return nil
+}
+
+// match records the location of the not yet found blocks of refs with the MD5.
+func (s *blockScanner) match(refs []blockRef, sum [md5.Size]byte, fn string, offset int64) bool {
+	var ok bool
+	for _, ref := range refs {
+		if _, found := s.found[ref]; found || s.files[ref.file].Pairs[ref.block].MD5 != MD5(sum) {
+			continue
+		}
+		s.found[ref] = BlockLocation{File: fn, Offset: offset}
+		s.remaining--
+		ok = true
+	}
+	return ok
+}
+
+// matchTail checks whether b (padded with zeros) is one of the shorter last blocks.
+func (s *blockScanner) matchTail(refs []blockRef, b []byte, fn string, offset int64) {
+	block := make([]byte, s.blockSize)
+	copy(block, b)
+	pair := NewChecksumPair(block)
+	for _, ref := range refs {
+		file := s.files[ref.file]
+		if _, found := s.found[ref]; found || file.BlockLength(s.blockSize, ref.block) != len(b) || file.Pairs[ref.block] != pair {
+			continue
+		}
+		s.found[ref] = BlockLocation{File: fn, Offset: offset}
+		s.remaining--
+	}
+}
+
+// scanDisplaced searches the bad blocks of the reports (of files, except the non-recovery ones) in the fns,
+// and marks the found ones good, with their location in Displaced.
+func scanDisplaced(files []*File, blockSize int, reports []FileReport, fns []string) {
+	var missing []blockRef
+	for i, file := range files {
+		if !file.Valid() || reports[i].NonRecovery {
+			continue
+		}
+		for _, j := range reports[i].BadBlocks {
+			missing = append(missing, blockRef{file: i, block: j})
+		}
+	}
+	if len(missing) == 0 || len(fns) == 0 {
+		return
+	}
+	s := newBlockScanner(files, blockSize, missing)
+	for _, fn := range fns {
+		if err := s.scanFile(fn); err != nil {
+			log.Printf("scan %q: %v", fn, err)
+		}
+	}
+	if len(s.found) == 0 {
+		return
+	}
+	for i := range files {
+		fr := &reports[i]
+		bad := fr.BadBlocks[:0]
+		for _, j := range fr.BadBlocks {
+			loc, ok := s.Found(blockRef{file: i, block: j})
+			if !ok {
+				bad = append(bad, j)
+				continue
+			}
+			if fr.Displaced == nil {
+				fr.Displaced = make(map[int]BlockLocation)
+			}
+			fr.Displaced[j] = loc
+			fr.GoodBlocks = append(fr.GoodBlocks, j)
+		}
+		fr.BadBlocks = bad
+		sort.Ints(fr.GoodBlocks)
+	}
+}
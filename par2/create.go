@@ -24,11 +24,13 @@ package par2
 
 import (
 	"crypto/md5"
+	"encoding/binary"
 	"hash"
 	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -37,6 +39,11 @@ type mainBuilder struct {
 	Main            *MainPacket
 	FileDescriptors []*FileDescPacket
 	IFSCs           []*IFSCPacket
+	// UnicodeNames holds the UnicodeFileNamePackets of the non-ASCII file names.
+	UnicodeNames []*UnicodeFileNamePacket
+	// BaseDir is the directory the stored names are relative to (with "/" separators);
+	// if empty (or the file is not under it), just the base name is stored.
+	BaseDir string
 }
 
 // NewMainBuilder returns a new writer which helps writing the needed packets.
@@ -74,15 +81,73 @@ func (pw *mainBuilder) AddFile(name string) (*FileDescPacket, *IFSCPacket, error
 	return fDesc, ifsc, err
 }
 
+// AddNonRecoveryFile adds the file as a non-recovery set file:
+// it can be verified, but it is not protected by the recovery slices.
+func (mb *mainBuilder) AddNonRecoveryFile(name string) (*FileDescPacket, *IFSCPacket, error) {
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, name)
+	}
+	fDesc, ifsc, err := mb.addReader(name, fh, false)
+	_ = fh.Close()
+	return fDesc, ifsc, err
+}
+
 // AddReader adds the reader with the given filename to the recovery set.
 //
 // Creates the FileDescPacket and appends it to the Main packet's RecoverySetFileIDs.
-// Also creates the IFSCPacket.
+// Also creates the IFSCPacket, and an UnicodeFileNamePacket for a non-ASCII name.
 func (mb *mainBuilder) AddReader(name string, r io.Reader) (*FileDescPacket, *IFSCPacket, error) {
+	return mb.addReader(name, r, true)
+}
+
+// AddDirectory adds a directory entry (an empty non-recovery set file, with a name ending in "/"),
+// to keep the empty directories.
+func (mb *mainBuilder) AddDirectory(name string) *FileDescPacket {
+	h := mb.Main.Header
+	h.SetType(TypeFileDescPacket)
+	fDesc := h.Create().(*FileDescPacket)
+	fDesc.FileName = strings.TrimSuffix(mb.storedName(name), "/") + "/"
+	fDesc.MD5 = MD5(md5.Sum(nil))
+	fDesc.MiniMD5 = fDesc.MD5
+	fDesc.recalc()
+	mb.addDesc(fDesc, false)
+	return fDesc
+}
+
+// storedName returns the name of the file to be stored: relative to BaseDir, or the base name.
+func (mb *mainBuilder) storedName(name string) string {
+	if mb.BaseDir != "" {
+		if rel, err := filepath.Rel(mb.BaseDir, name); err == nil && filepath.IsLocal(rel) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(name)
+}
+
+// addDesc adds the file description (and an UnicodeFileNamePacket for a non-ASCII name)
+// to the recovery set or to the non-recovery set files.
+func (mb *mainBuilder) addDesc(fDesc *FileDescPacket, recovery bool) {
+	mb.FileDescriptors = append(mb.FileDescriptors, fDesc)
+	if _, isASCII := toASCII(fDesc.FileName); !isASCII {
+		h := mb.Main.Header
+		h.SetType(TypeUnicodeFileNamePacket)
+		u := h.Create().(*UnicodeFileNamePacket)
+		u.FileID, u.FileName = fDesc.FileID, fDesc.FileName
+		mb.UnicodeNames = append(mb.UnicodeNames, u)
+	}
+	if recovery {
+		mb.Main.RecoverySetFileIDs = append(mb.Main.RecoverySetFileIDs, fDesc.FileID)
+	} else {
+		mb.Main.NonRecoverySetFileIDs = append(mb.Main.NonRecoverySetFileIDs, fDesc.FileID)
+	}
+}
+
+func (mb *mainBuilder) addReader(name string, r io.Reader, recovery bool) (*FileDescPacket, *IFSCPacket, error) {
 	h := mb.Main.Header
 	h.SetType(TypeFileDescPacket)
 	fDesc := h.Create().(*FileDescPacket)
-	fDesc.FileName = filepath.Base(name)
+	fDesc.FileName = mb.storedName(name)
 	h.SetType(TypeIFSCPacket)
 	ifsc := h.Create().(*IFSCPacket)
 
@@ -113,14 +178,16 @@ func (mb *mainBuilder) AddReader(name string, r io.Reader) (*FileDescPacket, *IF
 	fDesc.recalc()
 	ifsc.FileID = fDesc.FileID
 	mb.IFSCs = append(mb.IFSCs, ifsc)
-	mb.FileDescriptors = append(mb.FileDescriptors, fDesc)
-	mb.Main.RecoverySetFileIDs = append(mb.Main.RecoverySetFileIDs, fDesc.FileID)
+	mb.addDesc(fDesc, recovery)
 
 	return fDesc, ifsc, nil
 }
 
 // Finish the adding of new files, calculate the RecoverySetID and return the Main packet.
 func (mb *mainBuilder) Finish() *MainPacket {
+	// The input blocks are ordered by the sorted File IDs.
+	sortMD5s(mb.Main.RecoverySetFileIDs)
+	sortMD5s(mb.Main.NonRecoverySetFileIDs)
 	b := bytesPool.Get()
 	mb.Main.writeBody(b)
 	bytesPool.Put(b)
@@ -131,6 +198,9 @@ func (mb *mainBuilder) Finish() *MainPacket {
 	for _, ifsc := range mb.IFSCs {
 		ifsc.RecoverySetID = mb.Main.RecoverySetID
 	}
+	for _, u := range mb.UnicodeNames {
+		u.RecoverySetID = mb.Main.RecoverySetID
+	}
 
 	return mb.Main
 }
@@ -229,3 +299,10 @@ func (w *checksumPairWriter) Write(p []byte) (int, error) {
 	w.Pairs = append(w.Pairs, pair)
 	return n, nil
 }
+
+// NewChecksumPair returns the checksums of the (padded) block.
+func NewChecksumPair(block []byte) ChecksumPair {
+	pair := ChecksumPair{MD5: MD5(md5.Sum(block))}
+	binary.LittleEndian.PutUint32(pair.CRC32[:], crc32.ChecksumIEEE(block))
+	return pair
+}
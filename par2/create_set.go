@@ -0,0 +1,393 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBlockCount is the number of input blocks Create aims for, if no block size is given.
+const DefaultBlockCount = 2000
+
+// DefaultCreator is the creator written by Create, if none is given.
+const DefaultCreator = "github.com/tgulacsi/par"
+
+// maxInputBlocks is the maximal number of input blocks: the number of usable constants.
+const maxInputBlocks = 32768
+
+// VolumeScheme tells how the recovery blocks are distributed among the vol files.
+type VolumeScheme uint8
+
+const (
+	// VolumesExponential doubles the number of recovery blocks in each vol file (1, 2, 4, ...), as par2cmdline does.
+	VolumesExponential = VolumeScheme(iota)
+	// VolumesUniform puts the same number of recovery blocks (VolumeCount) into each vol file.
+	VolumesUniform
+	// VolumesSingle puts all the recovery blocks into one vol file.
+	VolumesSingle
+)
+
+// CreateOptions are the options of Create.
+type CreateOptions struct {
+	// Output is the name of the index file, the vol files are named after it.
+	Output string
+	// Files to protect: the directories are walked, and their empty subdirectories are kept as directory entries.
+	Files []string
+	// NonRecovery are the files (or directories) to describe, but not to protect:
+	// they can be verified, but not repaired.
+	NonRecovery []string
+	// BaseDir is the directory the stored file names are relative to (the directory of Output if empty).
+	BaseDir string
+	// BlockSize is the size of the input blocks, rounded up to a multiple of 4.
+	// If zero, it is computed to have about BlockCount (DefaultBlockCount if zero) input blocks.
+	BlockSize, BlockCount int
+	// Redundancy is the number of recovery blocks, in the percent of the input blocks.
+	Redundancy int
+	// Volumes is the volume scheme, VolumeCount the number of blocks per vol file for VolumesUniform.
+	Volumes     VolumeScheme
+	VolumeCount int
+	// Creator is stored in the creator packet (DefaultCreator if empty),
+	// Comment in comment packets (if not empty).
+	Creator, Comment string
+}
+
+// Create the recovery set of the files: the index file (the critical packets only),
+// and the vol files with the recovery slices and the critical packets repeated.
+//
+// Returns the names of the written files.
+func Create(opts CreateOptions) ([]string, error) {
+	if len(opts.Files) == 0 {
+		return nil, errors.New("no files given")
+	}
+	if opts.Output == "" {
+		opts.Output = opts.Files[0] + ".par2"
+	}
+	if opts.BaseDir == "" {
+		opts.BaseDir = filepath.Dir(opts.Output)
+	}
+	set, err := buildSet(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	written := make([]string, 0, 8)
+	if err := writePacketFile(opts.Output, set.critical, set.extra); err != nil {
+		return written, err
+	}
+	written = append(written, opts.Output)
+
+	counts := volumeCounts(len(set.recovery), opts.Volumes, opts.VolumeCount)
+	base := strings.TrimSuffix(opts.Output, ".par2")
+	lowDigits, countDigits := 1, 1
+	for start, i := 0, 0; i < len(counts); start, i = start+counts[i], i+1 {
+		lowDigits, countDigits = maxInt(lowDigits, len(fmt.Sprint(start))), maxInt(countDigits, len(fmt.Sprint(counts[i])))
+	}
+	for start, i := 0, 0; i < len(counts); start, i = start+counts[i], i+1 {
+		fn := fmt.Sprintf("%s.vol%0*d+%0*d.par2", base, lowDigits, start, countDigits, counts[i])
+		if err := writePacketFile(fn, volumePackets(set.recovery[start:start+counts[i]], set.critical), set.extra); err != nil {
+			return written, err
+		}
+		written = append(written, fn)
+	}
+	return written, nil
+}
+
+// WriteSet writes the recovery set of the files into w, as one stream:
+// the critical packets, then the recovery slices with the critical packets repeated among them.
+// The Output and the volume options are not used.
+func WriteSet(w io.Writer, opts CreateOptions) error {
+	if len(opts.Files) == 0 {
+		return errors.New("no files given")
+	}
+	if opts.BaseDir == "" {
+		opts.BaseDir = filepath.Dir(opts.Files[0])
+	}
+	set, err := buildSet(opts)
+	if err != nil {
+		return err
+	}
+	for _, pkts := range [][]Packet{set.critical, set.extra, volumePackets(set.recovery, set.critical)} {
+		for _, p := range pkts {
+			if _, err := WritePacket(w, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverySet is the packets of a recovery set.
+type recoverySet struct {
+	// critical are the main, file description and IFSC packets,
+	// extra are the unicode name, creator and comment packets.
+	critical, extra []Packet
+	recovery        []*RecoverySlicePacket
+}
+
+// buildSet reads the files, and computes the packets of their recovery set.
+func buildSet(opts CreateOptions) (*recoverySet, error) {
+	files, dirs, err := walkFiles(opts.Files)
+	if err != nil {
+		return nil, err
+	}
+	nonRecovery, nonRecoveryDirs, err := walkFiles(opts.NonRecovery)
+	if err != nil {
+		return nil, err
+	}
+	dirs = append(dirs, nonRecoveryDirs...)
+	if opts.BlockSize == 0 {
+		if opts.BlockSize, err = blockSizeFor(files, opts.BlockCount); err != nil {
+			return nil, err
+		}
+	}
+	if n := opts.BlockSize % 4; n != 0 {
+		opts.BlockSize += 4 - n
+	}
+
+	mb := NewMainBuilder(opts.BlockSize)
+	mb.BaseDir = opts.BaseDir
+	names := make(map[string]bool, len(files)+len(nonRecovery)+len(dirs))
+	checkName := func(fn string) error {
+		name := mb.storedName(fn)
+		if names[name] {
+			return errors.Errorf("%s: duplicate file name %q", fn, name)
+		}
+		names[name] = true
+		return nil
+	}
+	paths := make(map[MD5]string, len(files))
+	var blocks int
+	for _, fn := range files {
+		if err := checkName(fn); err != nil {
+			return nil, err
+		}
+		fDesc, ifsc, err := mb.AddFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		paths[fDesc.FileID] = fn
+		blocks += len(ifsc.Pairs)
+	}
+	for _, fn := range nonRecovery {
+		if err := checkName(fn); err != nil {
+			return nil, err
+		}
+		if _, _, err := mb.AddNonRecoveryFile(fn); err != nil {
+			return nil, err
+		}
+	}
+	for _, fn := range dirs {
+		if err := checkName(fn); err != nil {
+			return nil, err
+		}
+		mb.AddDirectory(fn)
+	}
+	if blocks > maxInputBlocks {
+		return nil, errors.Errorf("%d input blocks, the maximum is %d: use a bigger block size", blocks, maxInputBlocks)
+	}
+	mainPkt := mb.Finish()
+
+	// the input blocks are in the order of the sorted file IDs
+	exponents := make([]uint32, (blocks*opts.Redundancy+99)/100)
+	for i := range exponents {
+		exponents[i] = uint32(i)
+	}
+	enc := NewEncoder(opts.BlockSize, exponents)
+	for _, id := range mainPkt.RecoverySetFileIDs {
+		if err := encodeFile(enc, paths[id]); err != nil {
+			return nil, err
+		}
+	}
+
+	ifscs := make(map[MD5]*IFSCPacket, len(mb.IFSCs))
+	for _, ifsc := range mb.IFSCs {
+		ifscs[ifsc.FileID] = ifsc
+	}
+	critical := []Packet{mainPkt}
+	for _, fDesc := range mb.FileDescriptors {
+		critical = append(critical, fDesc)
+		if ifsc := ifscs[fDesc.FileID]; ifsc != nil {
+			critical = append(critical, ifsc)
+		}
+	}
+	var extra []Packet
+	for _, u := range mb.UnicodeNames {
+		extra = append(extra, u)
+	}
+	if opts.Creator == "" {
+		opts.Creator = DefaultCreator
+	}
+	crPkt := CreatePacket(TypeCreatorPacket).(*CreatorPacket)
+	crPkt.RecoverySetID, crPkt.Creator = mainPkt.RecoverySetID, opts.Creator
+	extra = append(extra, crPkt)
+	if opts.Comment != "" {
+		extra = append(extra, NewCommentPackets(mainPkt.RecoverySetID, opts.Comment)...)
+	}
+	return &recoverySet{critical: critical, extra: extra, recovery: enc.Packets(mainPkt.RecoverySetID)}, nil
+}
+
+// walkFiles returns the files, with the regular files of the directories (recursively),
+// and the empty directories.
+func walkFiles(names []string) (files, emptyDirs []string, err error) {
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return files, emptyDirs, errors.Wrap(err, name)
+		}
+		if !fi.IsDir() {
+			files = append(files, name)
+			continue
+		}
+		if err := filepath.Walk(name, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			switch {
+			case fi.Mode().IsRegular():
+				files = append(files, path)
+			case fi.IsDir():
+				if entries, err := os.ReadDir(path); err != nil {
+					return err
+				} else if len(entries) == 0 {
+					emptyDirs = append(emptyDirs, path)
+				}
+			}
+			return nil
+		}); err != nil {
+			return files, emptyDirs, errors.Wrap(err, name)
+		}
+	}
+	return files, emptyDirs, nil
+}
+
+// blockSizeFor returns the block size for about count blocks of the files.
+func blockSizeFor(files []string, count int) (int, error) {
+	if count <= 0 {
+		count = DefaultBlockCount
+	}
+	var total int64
+	for _, fn := range files {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return 0, errors.Wrap(err, fn)
+		}
+		total += fi.Size()
+	}
+	size := (total + int64(count) - 1) / int64(count)
+	if size < 4 {
+		size = 4
+	}
+	return int(size), nil
+}
+
+// encodeFile writes the blocks of the file (the last padded with zeros) to the encoder.
+func encodeFile(enc *Encoder, fn string) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	cw := NewChunkWriter(enc, enc.BlockSize)
+	cw.Pad = true
+	if _, err := io.Copy(cw, fh); err != nil {
+		return errors.Wrap(err, fn)
+	}
+	return cw.Close()
+}
+
+// volumeCounts returns the number of recovery blocks in each vol file.
+func volumeCounts(n int, scheme VolumeScheme, perVolume int) []int {
+	var counts []int
+	switch scheme {
+	case VolumesSingle:
+		if n > 0 {
+			counts = append(counts, n)
+		}
+	case VolumesUniform:
+		if perVolume <= 0 {
+			perVolume = 1
+		}
+		for ; n > 0; n -= perVolume {
+			counts = append(counts, minInt(n, perVolume))
+		}
+	default:
+		for k := 1; n > 0; k *= 2 {
+			counts = append(counts, minInt(n, k))
+			n -= k
+		}
+	}
+	return counts
+}
+
+// volumePackets returns the recovery slices interleaved with copies of the critical packets:
+// more copies for bigger files, as par2cmdline does.
+func volumePackets(recovery []*RecoverySlicePacket, critical []Packet) []Packet {
+	copies := bits.Len(uint(len(recovery)))
+	packets := make([]Packet, 0, len(recovery)+copies*len(critical))
+	c := 1
+	for i, r := range recovery {
+		packets = append(packets, r)
+		if (i+1)*copies >= c*len(recovery) {
+			packets = append(packets, critical...)
+			c++
+		}
+	}
+	return packets
+}
+
+// writePacketFile writes the packets to the file.
+func writePacketFile(fn string, packets ...[]Packet) error {
+	fh, err := os.Create(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	for _, pkts := range packets {
+		for _, p := range pkts {
+			if _, err := WritePacket(fh, p); err != nil {
+				return errors.Wrap(err, fn)
+			}
+		}
+	}
+	return errors.Wrap(fh.Close(), fn)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
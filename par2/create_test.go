@@ -21,3 +21,211 @@
 // THE SOFTWARE.
 
 package par2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVolumeCounts(t *testing.T) {
+	for _, tc := range []struct {
+		N, PerVolume int
+		Scheme       VolumeScheme
+		Want         []int
+	}{
+		{10, 0, VolumesExponential, []int{1, 2, 4, 3}},
+		{10, 4, VolumesUniform, []int{4, 4, 2}},
+		{10, 0, VolumesSingle, []int{10}},
+		{0, 0, VolumesExponential, nil},
+	} {
+		if got := volumeCounts(tc.N, tc.Scheme, tc.PerVolume); !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("%d/%d/%d: got %v, wanted %v", tc.N, tc.Scheme, tc.PerVolume, got, tc.Want)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []string
+	for src, dst := range map[string]string{"testdata/input.txt": "a.txt", "create.go": "b.go"} {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := filepath.Join(dir, dst)
+		if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+
+	written, err := Create(CreateOptions{
+		Output: filepath.Join(dir, "set.par2"), Files: files,
+		BlockCount: 20, Redundancy: 30, Comment: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(written)
+	if len(written) < 2 || filepath.Base(written[1]) != "set.vol0+1.par2" {
+		t.Errorf("got %q", written)
+	}
+
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.ParFiles) != len(written) {
+		t.Errorf("got par files %q, wanted %q", info.ParFiles, written)
+	}
+	if len(info.Files) != 2 || info.Creator == nil || info.Creator.Creator != DefaultCreator {
+		t.Errorf("got %d files, creator %v", len(info.Files), info.Creator)
+	}
+	if got, want := len(info.RecoveryData), (int(info.BlockCount)*30+99)/100; got != want {
+		t.Errorf("got %d recovery blocks, wanted %d", got, want)
+	}
+	if rep := Verify(info); rep.Status != RepairNotNeeded {
+		t.Errorf("got %#v", rep)
+	}
+
+	// the index file alone has all the critical packets
+	index := ParInfo{ParFiles: written[:1]}
+	if err := index.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if index.Main == nil || len(index.Files) != 2 || len(index.RecoveryData) != 0 {
+		t.Errorf("index file: got %#v", index)
+	}
+	// and so does each vol file
+	for _, fn := range written[1:] {
+		vol := ParInfo{ParFiles: []string{fn}}
+		if err := vol.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		if vol.Main == nil || len(vol.Files) != 2 || len(vol.RecoveryData) == 0 {
+			t.Errorf("%s: got %#v", fn, vol)
+		}
+	}
+
+	// WriteSet writes the same set into one stream
+	var buf bytes.Buffer
+	if err := WriteSet(&buf, CreateOptions{Files: files, BlockCount: 20, Redundancy: 30, Comment: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	one := filepath.Join(dir, "one.par2")
+	if err := ioutil.WriteFile(one, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	single := ParInfo{ParFiles: []string{one}}
+	if err := single.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if single.Main == nil || single.Main.RecoverySetID != info.Main.RecoverySetID || len(single.Files) != 2 {
+		t.Fatalf("WriteSet: got %#v", single)
+	}
+	if len(single.RecoveryData) != len(info.RecoveryData) {
+		t.Fatalf("WriteSet: got %d recovery slices, wanted %d", len(single.RecoveryData), len(info.RecoveryData))
+	}
+	for i, r := range info.RecoveryData {
+		if g := single.RecoveryData[i]; g.Exponent != r.Exponent || g.PacketMD5 != r.PacketMD5 {
+			t.Errorf("WriteSet: %d. got %v, wanted %v", i, g, r)
+		}
+	}
+}
+
+func TestCreateTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var second bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&second, "the %d. line of the second file\n", i)
+	}
+	contents := map[string][]byte{
+		"a.txt":     []byte("the first file\n"),
+		"sub/b.txt": second.Bytes(),
+		"empty":     nil,
+		"notes.txt": []byte("not protected\n"),
+	}
+	for name, b := range contents {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emptyDir := filepath.Join(dir, "sub", "emptydir")
+	if err := os.Mkdir(emptyDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := Create(CreateOptions{
+		Output: filepath.Join(dir, "set.par2"), BlockSize: 256, Redundancy: 50,
+		Files:       []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub"), filepath.Join(dir, "empty")},
+		NonRecovery: []string{filepath.Join(dir, "notes.txt")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Main.RecoverySetFileIDs) != 3 || len(info.Main.NonRecoverySetFileIDs) != 2 {
+		t.Errorf("got main packet %s", info.Main)
+	}
+	names := make(map[string]bool)
+	for _, f := range info.Files {
+		names[f.Name()] = info.IsNonRecovery(f)
+	}
+	if want := map[string]bool{"a.txt": false, "sub/b.txt": false, "empty": false, "notes.txt": true, "sub/emptydir/": true}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got files %v, wanted %v", names, want)
+	}
+	if rep := Verify(info); rep.Status != RepairNotNeeded || rep.Unprotected != 0 {
+		t.Errorf("got %#v", rep)
+	}
+
+	// remove the empty file and directory, damage the others
+	for _, fn := range []string{filepath.Join(dir, "empty"), emptyDir} {
+		if err := os.Remove(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"sub/b.txt", "notes.txt"} {
+		b := append([]byte(nil), contents[name]...)
+		b[0]++
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rep := Verify(info); rep.Status != RepairRequired || rep.MissingBlocks != 1 || rep.Unprotected != 1 {
+		t.Errorf("got %#v", rep)
+	}
+	if _, err := Repair(info, RepairOptions{NoBackup: true}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if rep := Verify(info); rep.Status != RepairNotNeeded || rep.Unprotected != 1 {
+		t.Errorf("after repair: got %#v", rep)
+	}
+	if fi, err := os.Stat(emptyDir); err != nil || !fi.IsDir() {
+		t.Errorf("%s: %v", emptyDir, err)
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt", "empty"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err != nil || !bytes.Equal(got, contents[name]) {
+			t.Errorf("%s: mismatch (%v)", name, err)
+		}
+	}
+}
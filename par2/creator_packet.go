@@ -41,8 +41,9 @@ func (c *CreatorPacket) packetHeader() Header {
 	return c.Header
 }
 
-func (c *CreatorPacket) readBody(body []byte) {
+func (c *CreatorPacket) readBody(body []byte) error {
 	c.Creator = string(bytes.TrimRight(body, "\000"))
+	return nil
 }
 
 func (c *CreatorPacket) writeBody(dest []byte) []byte {
@@ -0,0 +1,196 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotEnoughRecovery is returned when there are less recovery blocks than missing input blocks.
+var ErrNotEnoughRecovery = errors.New("not enough recovery blocks")
+
+// Decoder reconstructs the missing input blocks from the available input blocks
+// and the recovery slices, by solving the equations of the recovery slices' exponents.
+//
+// The good input blocks are added one by one, so only the recovery blocks are held in memory.
+type Decoder struct {
+	BlockSize int
+	exponents []uint32
+	// sums are the recovery blocks minus the contributions of the added input blocks.
+	sums [][]byte
+}
+
+// NewDecoder returns a Decoder using the first need (all if need <= 0) undamaged recovery slices.
+//
+// Only the used slices are read (from their file, if not loaded), an unreadable slice is skipped.
+func NewDecoder(blockSize int, recovery []*RecoverySlicePacket, need int) *Decoder {
+	dec := Decoder{BlockSize: blockSize}
+	for _, rd := range recovery {
+		if need > 0 && len(dec.sums) == need {
+			break
+		}
+		if rd.Damaged || rd.Len() != blockSize {
+			continue
+		}
+		data, err := rd.Data()
+		if err != nil {
+			log.Printf("recovery slice %d: %v", rd.Exponent, err)
+			continue
+		}
+		dec.exponents = append(dec.exponents, rd.Exponent)
+		dec.sums = append(dec.sums, append(make([]byte, 0, blockSize), data...))
+	}
+	return &dec
+}
+
+// Available returns the number of usable recovery blocks.
+func (dec *Decoder) Available() int { return len(dec.sums) }
+
+// Add the i-th (0-based) good input block. Shorter blocks are padded with zeros.
+func (dec *Decoder) Add(i int, block []byte) {
+	logBase := inputLogBase(i)
+	for j, e := range dec.exponents {
+		gfMulAdd(dec.sums[j], block, gfPow(logBase, e))
+	}
+}
+
+// Reconstruct returns the missing input blocks (with the given indexes, in the same order),
+// assuming that all the other input blocks has been added.
+func (dec *Decoder) Reconstruct(missing []int) ([][]byte, error) {
+	m := len(missing)
+	if m == 0 {
+		return nil, nil
+	}
+	if m > len(dec.sums) {
+		return nil, errors.Wrapf(ErrNotEnoughRecovery, "%d missing, %d available", m, len(dec.sums))
+	}
+	logBases := make([]uint32, m)
+	for k, i := range missing {
+		logBases[k] = inputLogBase(i)
+	}
+	coeffs := func(e uint32) []uint16 {
+		row := make([]uint16, m)
+		for k, l := range logBases {
+			row[k] = gfPow(l, e)
+		}
+		return row
+	}
+
+	// Choose m independent equations: the pivot rows of the elimination.
+	rows := make([][]uint16, len(dec.exponents))
+	for j, e := range dec.exponents {
+		rows[j] = coeffs(e)
+	}
+	used := make([]bool, len(rows))
+	chosen := make([]int, 0, m)
+	for k := 0; k < m; k++ {
+		p := -1
+		for j, row := range rows {
+			if !used[j] && row[k] != 0 {
+				p = j
+				break
+			}
+		}
+		if p < 0 {
+			return nil, errors.Wrapf(ErrNotEnoughRecovery, "singular matrix at column %d", k)
+		}
+		used[p] = true
+		chosen = append(chosen, p)
+		inv := gfDiv(1, rows[p][k])
+		for j, row := range rows {
+			if used[j] || row[k] == 0 {
+				continue
+			}
+			f := gfMul(row[k], inv)
+			for c := k; c < m; c++ {
+				row[c] ^= gfMul(f, rows[p][c])
+			}
+		}
+	}
+
+	// Invert the matrix of the chosen equations.
+	a := make([][]uint16, m)
+	b := make([][]uint16, m)
+	for r, j := range chosen {
+		a[r] = coeffs(dec.exponents[j])
+		b[r] = make([]uint16, m)
+		b[r][r] = 1
+	}
+	if err := gfInvert(a, b); err != nil {
+		return nil, err
+	}
+
+	blocks := make([][]byte, m)
+	for k := range blocks {
+		blocks[k] = make([]byte, dec.BlockSize)
+		for r, j := range chosen {
+			gfMulAdd(blocks[k], dec.sums[j], b[k][r])
+		}
+	}
+	return blocks, nil
+}
+
+// inputLogBase returns the log of the i-th (0-based) input block's constant.
+func inputLogBase(i int) uint32 {
+	if i < len(inputLogs) {
+		return inputLogs[i]
+	}
+	return inputLogBases(i + 1)[i]
+}
+
+// inputLogs are the logs of the constants of the maximal number of input blocks.
+var inputLogs = inputLogBases(32768)
+
+// gfInvert inverts a in place, with Gauss-Jordan elimination, applying the same row operations to b.
+func gfInvert(a, b [][]uint16) error {
+	n := len(a)
+	for k := 0; k < n; k++ {
+		p := k
+		for p < n && a[p][k] == 0 {
+			p++
+		}
+		if p == n {
+			return errors.Wrapf(ErrNotEnoughRecovery, "singular matrix at column %d", k)
+		}
+		a[k], a[p] = a[p], a[k]
+		b[k], b[p] = b[p], b[k]
+		inv := gfDiv(1, a[k][k])
+		for c := 0; c < n; c++ {
+			a[k][c] = gfMul(a[k][c], inv)
+			b[k][c] = gfMul(b[k][c], inv)
+		}
+		for r := 0; r < n; r++ {
+			if r == k || a[r][k] == 0 {
+				continue
+			}
+			f := a[r][k]
+			for c := 0; c < n; c++ {
+				a[r][c] ^= gfMul(f, a[k][c])
+				b[r][c] ^= gfMul(f, b[k][c])
+			}
+		}
+	}
+	return nil
+}
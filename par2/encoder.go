@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import "github.com/pkg/errors"
+
+// Encoder computes the recovery blocks of the given exponents,
+// from the input blocks written in order (see the Input Slice ordering in the main packet).
+type Encoder struct {
+	BlockSize int
+	Exponents []uint32
+	// Blocks are the recovery blocks, one for each exponent.
+	Blocks [][]byte
+
+	// logBase is the log of the next input block's constant.
+	logBase uint32
+}
+
+// NewEncoder returns an Encoder for the given exponents.
+func NewEncoder(blockSize int, exponents []uint32) *Encoder {
+	enc := Encoder{BlockSize: blockSize, Exponents: exponents, Blocks: make([][]byte, len(exponents))}
+	data := make([]byte, len(exponents)*blockSize)
+	for i := range enc.Blocks {
+		enc.Blocks[i] = data[i*blockSize : (i+1)*blockSize : (i+1)*blockSize]
+	}
+	return &enc
+}
+
+// Write the next input block. Shorter blocks are padded with zeros.
+func (enc *Encoder) Write(p []byte) (int, error) {
+	if len(p) > enc.BlockSize {
+		return 0, errors.Errorf("block is too big (%d > %d)", len(p), enc.BlockSize)
+	}
+	enc.logBase = nextLogBase(enc.logBase)
+	if enc.logBase >= gfLimit {
+		return 0, errors.New("too many input blocks")
+	}
+	for i, e := range enc.Exponents {
+		gfMulAdd(enc.Blocks[i], p, gfPow(enc.logBase, e))
+	}
+	enc.logBase++
+	return len(p), nil
+}
+
+// Packets returns the recovery slice packets of the recovery set.
+func (enc *Encoder) Packets(recoverySetID MD5) []*RecoverySlicePacket {
+	packets := make([]*RecoverySlicePacket, len(enc.Blocks))
+	for i, b := range enc.Blocks {
+		p := CreatePacket(TypeRecoverySlicePacket).(*RecoverySlicePacket)
+		p.RecoverySetID = recoverySetID
+		p.Exponent = enc.Exponents[i]
+		p.RecoveryData = b
+		packets[i] = p
+	}
+	return packets
+}
@@ -23,17 +23,54 @@
 
 package par2
 
-import "fmt"
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
 
 type File struct {
 	*FileDescPacket
 	*IFSCPacket
+	UnicodeName *UnicodeFileNamePacket `json:",omitempty"`
+}
+
+// Name returns the Unicode file name if present, the ASCII name otherwise.
+func (f *File) Name() string {
+	if f.UnicodeName != nil && f.UnicodeName.FileName != "" {
+		return f.UnicodeName.FileName
+	}
+	return f.FileName
 }
 
 func (f *File) ID() string {
 	return f.FileDescPacket.FileID.String()
 }
 
+// BlockLength returns the length of the i-th block of the file, without the padding.
+func (f *File) BlockLength(blockSize, i int) int {
+	if rest := int64(f.FileLength) - int64(i)*int64(blockSize); rest < int64(blockSize) {
+		return int(rest)
+	}
+	return blockSize
+}
+
+// IsDir reports whether the file is a directory entry: an empty file with a name ending in "/".
+func (f *File) IsDir() bool {
+	return f.FileDescPacket != nil && f.FileLength == 0 && strings.HasSuffix(f.Name(), "/")
+}
+
+// IsLocal reports whether the name is a local path (relative, not escaping the base directory),
+// so the file can be accessed under the base directory.
+func (f *File) IsLocal() bool {
+	return filepath.IsLocal(filepath.FromSlash(f.Name()))
+}
+
+// Path returns the path of the file under baseDir (the names are relative, with "/" separators).
+func (f *File) Path(baseDir string) string {
+	return filepath.Join(baseDir, filepath.FromSlash(f.Name()))
+}
+
 func (f *File) Valid() bool {
 	return f.FileDescPacket != nil && f.IFSCPacket != nil
 }
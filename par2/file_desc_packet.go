@@ -29,6 +29,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+
+	"github.com/pkg/errors"
 )
 
 type FileDescPacket struct {
@@ -48,7 +50,10 @@ func (f *FileDescPacket) packetHeader() Header {
 	return f.Header
 }
 
-func (f *FileDescPacket) readBody(body []byte) {
+func (f *FileDescPacket) readBody(body []byte) error {
+	if len(body) < 56 {
+		return errors.Wrapf(errBadBody, "file description packet of %d bytes", len(body))
+	}
 	copy(f.FileID[:], body)
 	body = body[16:]
 	copy(f.MD5[:], body)
@@ -58,6 +63,7 @@ func (f *FileDescPacket) readBody(body []byte) {
 	f.FileLength = binary.LittleEndian.Uint64(body)
 	body = body[8:]
 	f.FileName = string(bytes.TrimRight(body, "\000"))
+	return nil
 }
 
 func (f *FileDescPacket) recalc() {
@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+// The Reed-Solomon code of PAR2 works on 16-bit little-endian words,
+// in GF(2^16) with the 0x1100B generator polynomial.
+//
+// Each input block gets a constant c = 2^n, where n is coprime to 65535,
+// and the recovery block of exponent e is the sum of c^e * block over all the input blocks.
+const (
+	gfPoly  = 0x1100B
+	gfLimit = 1<<16 - 1
+)
+
+var gfLog, gfExp = gfTables()
+
+func gfTables() (log [1 << 16]uint16, exp [2 * gfLimit]uint16) {
+	b := uint32(1)
+	for i := 0; i < gfLimit; i++ {
+		log[b] = uint16(i)
+		exp[i], exp[i+gfLimit] = uint16(b), uint16(b)
+		if b <<= 1; b&(1<<16) != 0 {
+			b ^= gfPoly
+		}
+	}
+	return log, exp
+}
+
+func gfMul(a, b uint16) uint16 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[uint32(gfLog[a])+uint32(gfLog[b])]
+}
+
+func gfDiv(a, b uint16) uint16 {
+	if b == 0 {
+		panic("division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[uint32(gfLog[a])+gfLimit-uint32(gfLog[b])]
+}
+
+// gfPow returns 2^(logBase * e).
+func gfPow(logBase, e uint32) uint16 {
+	return gfExp[uint64(logBase)*uint64(e)%gfLimit]
+}
+
+// nextLogBase returns the first log of an input constant not less than n:
+// the ones coprime to 65535 = 3 * 5 * 17 * 257.
+func nextLogBase(n uint32) uint32 {
+	for n%3 == 0 || n%5 == 0 || n%17 == 0 || n%257 == 0 {
+		n++
+	}
+	return n
+}
+
+// inputLogBases returns the logs of the constants of the first n input blocks.
+func inputLogBases(n int) []uint32 {
+	logs := make([]uint32, n)
+	var l uint32
+	for i := range logs {
+		l = nextLogBase(l)
+		logs[i] = l
+		l++
+	}
+	return logs
+}
+
+// InputConstant returns the constant of the i-th (0-based) input block.
+func InputConstant(i int) uint16 {
+	return gfExp[inputLogBase(i)]
+}
+
+// gfMulAdd adds c * src to dst, word by word.
+func gfMulAdd(dst, src []byte, c uint16) {
+	if c == 0 {
+		return
+	}
+	if len(src) > len(dst) {
+		src = src[:len(dst)]
+	}
+	if c == 1 {
+		for i, b := range src {
+			dst[i] ^= b
+		}
+		return
+	}
+	// c * (hi<<8 ^ lo) = c*(hi<<8) ^ c*lo
+	var lo, hi [256]uint16
+	for i := 1; i < 256; i++ {
+		lo[i] = gfMul(c, uint16(i))
+		hi[i] = gfMul(c, uint16(i)<<8)
+	}
+	n := len(src) &^ 1
+	for i := 0; i < n; i += 2 {
+		v := lo[src[i]] ^ hi[src[i+1]]
+		dst[i] ^= byte(v)
+		dst[i+1] ^= byte(v >> 8)
+	}
+	if n < len(src) {
+		// odd length: the missing high byte is zero
+		v := lo[src[n]]
+		dst[n] ^= byte(v)
+		if n+1 < len(dst) {
+			dst[n+1] ^= byte(v >> 8)
+		}
+	}
+}
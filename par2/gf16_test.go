@@ -0,0 +1,245 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestGFTables(t *testing.T) {
+	seen := make(map[uint16]bool, gfLimit)
+	for i := 0; i < gfLimit; i++ {
+		v := gfExp[i]
+		if v == 0 || seen[v] {
+			t.Fatalf("%d. 2^%d=%d is not unique", i, i, v)
+		}
+		seen[v] = true
+		if gfLog[v] != uint16(i) {
+			t.Errorf("log(%d)=%d, wanted %d", v, gfLog[v], i)
+		}
+	}
+	for _, a := range []uint16{1, 2, 3, 0x100B, 0x8000, 0xffff} {
+		for _, b := range []uint16{1, 2, 7, 0x1234, 0xffff} {
+			if got := gfDiv(gfMul(a, b), b); got != a {
+				t.Errorf("%d*%d/%d=%d", a, b, b, got)
+			}
+		}
+	}
+	// 2^16 = x^12 + x^3 + x + 1
+	if got := gfMul(0x8000, 2); got != 0x100B {
+		t.Errorf("2^16=%#x, wanted 0x100B", got)
+	}
+}
+
+func TestInputConstants(t *testing.T) {
+	for i, want := range []uint16{
+		2,
+		4,
+		16,
+		128,
+		256,
+		2048,
+		8192,
+		16384,
+		4107,
+		32856,
+		17132,
+	} {
+		if got := InputConstant(i); got != want {
+			t.Errorf("%d. got %d, want %d.", i, got, want)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	info, err := Stat("testdata/input.txt.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exponents := make([]uint32, len(info.RecoveryData))
+	for i, rd := range info.RecoveryData {
+		exponents[i] = rd.Exponent
+	}
+	enc := NewEncoder(int(info.Main.BlockSize), exponents)
+	cw := NewChunkWriter(enc, enc.BlockSize)
+	cw.Pad = true
+	if _, err := cw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, rd := range info.RecoveryData {
+		data, err := rd.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(enc.Blocks[i], data) {
+			t.Errorf("%d. recovery block of exponent %d mismatch", i, rd.Exponent)
+		}
+	}
+
+	// c^e * c^-e = 1
+	for i := 0; i < 10; i++ {
+		c := InputConstant(i)
+		var got [2]byte
+		gfMulAdd(got[:], []byte{byte(c), byte(c >> 8)}, gfDiv(1, c))
+		if got != [2]byte{1, 0} {
+			t.Errorf("%d. c=%d * 1/c = %v", i, c, got)
+		}
+	}
+}
+
+// refMul multiplies in GF(2^16) bit by bit, with the generator of the spec (x^16 + x^12 + x^3 + x + 1).
+func refMul(a, b uint16) uint16 {
+	var p uint32
+	x := uint32(a)
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= x
+		}
+		if x <<= 1; x&0x10000 != 0 {
+			x ^= 0x1100B
+		}
+	}
+	return uint16(p)
+}
+
+func refPow(a uint16, e uint32) uint16 {
+	p := uint16(1)
+	for ; e != 0; e-- {
+		p = refMul(p, a)
+	}
+	return p
+}
+
+// TestEncoderExponents checks the recovery slices of several exponents
+// (not only 0, where the slice is the plain XOR of the input slices)
+// against the definition of the spec, computed without the tables:
+// recovery[e] = sum of c_i^e * input_i, where c_i = 2^n_i, and n_i is the i. n not divisible by 3, 5, 17 and 257.
+func TestEncoderExponents(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const blockSize = 1024
+	var inputs [][]byte
+	for len(data) > 0 {
+		b := make([]byte, blockSize)
+		data = data[copy(b, data):]
+		inputs = append(inputs, b)
+	}
+	var constants []uint16
+	for n := uint32(1); len(constants) < len(inputs); n++ {
+		if n%3 != 0 && n%5 != 0 && n%17 != 0 && n%257 != 0 {
+			constants = append(constants, refPow(2, n))
+		}
+	}
+
+	exponents := []uint32{0, 1, 2, 3, 7, 100, 1000, 65534}
+	enc := NewEncoder(blockSize, exponents)
+	for _, b := range inputs {
+		if _, err := enc.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, e := range exponents {
+		want := make([]byte, blockSize)
+		for i, b := range inputs {
+			c := refPow(constants[i], e)
+			for j := 0; j < blockSize; j += 2 {
+				v := refMul(c, uint16(b[j])|uint16(b[j+1])<<8)
+				want[j] ^= byte(v)
+				want[j+1] ^= byte(v >> 8)
+			}
+		}
+		if !bytes.Equal(enc.Blocks[k], want) {
+			t.Errorf("recovery slice of exponent %d mismatch", e)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	info, err := Stat("testdata/input.txt.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockSize := int(info.Main.BlockSize)
+	blocks := make([][]byte, 0, len(data)/blockSize+1)
+	for len(data) > 0 {
+		b := make([]byte, blockSize)
+		data = data[copy(b, data):]
+		blocks = append(blocks, b)
+	}
+
+	// par2cmdline's recovery set
+	for missing := range blocks {
+		dec := NewDecoder(blockSize, info.RecoveryData, 0)
+		for i, b := range blocks {
+			if i != missing {
+				dec.Add(i, b)
+			}
+		}
+		got, err := dec.Reconstruct([]int{missing})
+		if err != nil {
+			t.Fatalf("%d. %+v", missing, err)
+		}
+		if !bytes.Equal(got[0], blocks[missing]) {
+			t.Errorf("%d. reconstructed block mismatch", missing)
+		}
+	}
+
+	// more missing blocks, with more recovery slices
+	enc := NewEncoder(blockSize, []uint32{0, 3, 1, 7})
+	for _, b := range blocks {
+		enc.Write(b)
+	}
+	recovery := enc.Packets(info.Main.RecoverySetID)
+	recovery[1].Damaged = true
+	dec := NewDecoder(blockSize, recovery, 0)
+	if got := dec.Available(); got != 3 {
+		t.Errorf("got %d available, wanted 3", got)
+	}
+	got, err := dec.Reconstruct([]int{0, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range got {
+		if !bytes.Equal(b, blocks[i]) {
+			t.Errorf("%d. reconstructed block mismatch", i)
+		}
+	}
+	if _, err := NewDecoder(blockSize, recovery[:2], 0).Reconstruct([]int{0, 1, 2}); err == nil {
+		t.Errorf("wanted error for too few recovery blocks")
+	}
+}
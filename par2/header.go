@@ -70,17 +70,25 @@ func (t Type) MarshalText() ([]byte, error)   { return t[:], nil }
 
 func (h *Header) SetType(typ PacketType) { copy(h.Type[:], typ[:16]) }
 
+// readFrom reads the header from r.
+//
+// Returns io.EOF only if nothing could be read, io.ErrUnexpectedEOF for a truncated header.
 func (h *Header) readFrom(r io.Reader) error {
-	_, err := io.ReadFull(r, h.Sequence[:])
-	if err != nil {
+	var b [headerLength]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
 		return err
 	}
+	h.decode(b[:])
+	return nil
+}
 
-	binary.Read(r, binary.LittleEndian, &h.Length)
-	io.ReadFull(r, h.PacketMD5[:])
-	io.ReadFull(r, h.RecoverySetID[:])
-	io.ReadFull(r, h.Type[:])
-	return err
+// decode the header from the headerLength long b.
+func (h *Header) decode(b []byte) {
+	copy(h.Sequence[:], b[:8])
+	h.Length = binary.LittleEndian.Uint64(b[8:16])
+	copy(h.PacketMD5[:], b[16:32])
+	copy(h.RecoverySetID[:], b[32:48])
+	copy(h.Type[:], b[48:64])
 }
 
 func (h Header) ValidSequence() bool {
@@ -26,6 +26,8 @@ package par2
 import (
 	"bytes"
 	"fmt"
+
+	"github.com/pkg/errors"
 )
 
 type IFSCPacket struct {
@@ -47,7 +49,10 @@ func (i *IFSCPacket) packetHeader() Header {
 	return i.Header
 }
 
-func (i *IFSCPacket) readBody(body []byte) {
+func (i *IFSCPacket) readBody(body []byte) error {
+	if len(body) < 16 || (len(body)-16)%20 != 0 {
+		return errors.Wrapf(errBadBody, "IFSC packet of %d bytes", len(body))
+	}
 	copy(i.FileID[:], body)
 	body = body[16:]
 
@@ -61,6 +66,7 @@ func (i *IFSCPacket) readBody(body []byte) {
 		body = body[4:]
 		i.Pairs = append(i.Pairs, pair)
 	}
+	return nil
 }
 
 func (i *IFSCPacket) writeBody(dest []byte) []byte {
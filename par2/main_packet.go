@@ -29,6 +29,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"sort"
+
+	"github.com/pkg/errors"
 )
 
 type MainPacket struct {
@@ -53,12 +55,18 @@ func (m *MainPacket) packetHeader() Header {
 	return m.Header
 }
 
-func (m *MainPacket) readBody(body []byte) {
+func (m *MainPacket) readBody(body []byte) error {
+	if len(body) < 12 || (len(body)-12)%16 != 0 {
+		return errors.Wrapf(errBadBody, "main packet of %d bytes", len(body))
+	}
 	m.BlockSize = binary.LittleEndian.Uint64(body)
 	body = body[8:]
 	m.RecoverySetCount = binary.LittleEndian.Uint32(body)
 	body = body[4:]
 
+	if uint64(m.RecoverySetCount) > uint64(len(body)>>4) {
+		return errors.Wrapf(errBadBody, "main packet with %d recovery set files in %d bytes", m.RecoverySetCount, len(body))
+	}
 	nonRecCount := (len(body) >> 4) - int(m.RecoverySetCount)
 	m.RecoverySetFileIDs = make([]MD5, m.RecoverySetCount)
 	m.NonRecoverySetFileIDs = make([]MD5, nonRecCount)
@@ -68,6 +76,7 @@ func (m *MainPacket) readBody(body []byte) {
 			body = body[16:]
 		}
 	}
+	return nil
 }
 
 // "The MD5 hash of the body of the main packet is used as the Recovery Set ID",
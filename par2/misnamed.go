@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// miniLength is the length of the file's head hashed into MiniMD5.
+const miniLength = 16 << 10
+
+// DirCandidates returns the regular files of BaseDir, which are not the files or the par files of the set:
+// the candidates for the misnamed files.
+func (stat *ParInfo) DirCandidates() ([]string, error) {
+	fis, err := ioutil.ReadDir(stat.BaseDir)
+	if err != nil {
+		return nil, errors.Wrap(err, stat.BaseDir)
+	}
+	own := make(map[string]bool, len(stat.Files)+len(stat.ParFiles))
+	for _, f := range stat.Files {
+		own[f.Name()] = true
+	}
+	for _, fn := range stat.ParFiles {
+		own[filepath.Base(fn)] = true
+	}
+	candidates := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && !own[fi.Name()] {
+			candidates = append(candidates, filepath.Join(stat.BaseDir, fi.Name()))
+		}
+	}
+	return candidates, nil
+}
+
+// FindMisnamed returns the candidates which have the same content as files of the set,
+// keyed by the file names.
+//
+// The candidates are matched by size and MiniMD5 (of the first 16KiB) first,
+// then by the MD5 of the whole file.
+func (stat *ParInfo) FindMisnamed(candidates []string) (map[string]string, error) {
+	found := make(map[string]string)
+	if len(candidates) == 0 {
+		return found, nil
+	}
+	bySize := make(map[int64][]*File, len(stat.Files))
+	for _, f := range stat.Files {
+		// any empty file would match the empty files and the directory entries
+		if f.FileDescPacket != nil && f.FileLength != 0 {
+			bySize[int64(f.FileLength)] = append(bySize[int64(f.FileLength)], f)
+		}
+	}
+	used := make(map[string]bool, len(candidates))
+	for _, fn := range candidates {
+		fi, err := os.Stat(fn)
+		if err != nil || !fi.Mode().IsRegular() || used[fn] {
+			continue
+		}
+		files := bySize[fi.Size()]
+		if len(files) == 0 {
+			continue
+		}
+		mini, full, err := hashFile(fn)
+		if err != nil {
+			return found, err
+		}
+		for _, f := range files {
+			if _, ok := found[f.Name()]; ok || f.MiniMD5 != mini || f.MD5 != full {
+				continue
+			}
+			found[f.Name()] = fn
+			used[fn] = true
+			break
+		}
+	}
+	return found, nil
+}
+
+// hashFile returns the MD5 of the first 16KiB and of the whole file.
+func hashFile(fn string) (MD5, MD5, error) {
+	var mini, full MD5
+	fh, err := os.Open(fn)
+	if err != nil {
+		return mini, full, errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	hsh := md5.New()
+	if _, err := io.CopyN(hsh, fh, miniLength); err != nil && err != io.EOF {
+		return mini, full, errors.Wrap(err, fn)
+	}
+	hsh.Sum(mini[:0])
+	if _, err := io.Copy(hsh, fh); err != nil {
+		return mini, full, errors.Wrap(err, fn)
+	}
+	hsh.Sum(full[:0])
+	return mini, full, nil
+}
@@ -31,11 +31,11 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/base64"
-	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -49,25 +49,32 @@ const (
 	TypeIFSCPacket          = PacketType("PAR 2.0\000IFSC\000\000\000\000")
 	TypeRecoverySlicePacket = PacketType("PAR 2.0\000RecvSlic")
 	TypeCreatorPacket       = PacketType("PAR 2.0\000Creator\000")
+
+	TypeUnicodeFileNamePacket = PacketType("PAR 2.0\000UniFileN")
+	TypeASCIICommentPacket    = PacketType("PAR 2.0\000CommASCI")
+	TypeUnicodeCommentPacket  = PacketType("PAR 2.0\000CommUni\000")
 )
 
 type PacketType string
 
 type Packet interface {
-	readBody([]byte)
+	readBody([]byte) error
 	writeBody([]byte) []byte
 	packetHeader() Header
 }
 
+// ParInfo is a recovery set.
 type ParInfo struct {
-	Main         *MainPacket
-	Creator      *CreatorPacket
-	Files        []*File
-	RecoveryData []*RecoverySlicePacket
-	ParFiles     []string
-	BlockCount   uint32
-	TotalSize    uint64
-	BaseDir      string
+	RecoverySetID MD5
+	Main          *MainPacket
+	Creator       *CreatorPacket
+	Comments      []Packet
+	Files         []*File
+	RecoveryData  []*RecoverySlicePacket
+	ParFiles      []string
+	BlockCount    uint32
+	TotalSize     uint64
+	BaseDir       string
 }
 
 type MD5 [16]byte
@@ -107,22 +114,132 @@ func Stat(file string) (*ParInfo, error) {
 	return stat, stat.Parse()
 }
 
+// ErrMultipleSets is returned by Parse when the files contain more than one recovery set,
+// and RecoverySetID does not select one of them.
+var ErrMultipleSets = errors.New("multiple recovery sets")
+
+// Parse the ParFiles.
+//
+// If RecoverySetID is not zero, only that recovery set is read,
+// otherwise the files must contain only one recovery set.
 func (stat *ParInfo) Parse() error {
-	packets, err := readPackets(nil, stat.ParFiles)
+	sets, err := ParseSets(stat.ParFiles)
+	if err != nil {
+		return err
+	}
+	if len(sets) == 0 {
+		if len(stat.ParFiles) != 0 {
+			stat.BaseDir = filepath.Dir(stat.ParFiles[0])
+		}
+		return nil
+	}
+	set := sets[0]
+	if !stat.RecoverySetID.IsZero() {
+		if set, err = FindSet(sets, stat.RecoverySetID.String()); err != nil {
+			return err
+		}
+	} else if len(sets) > 1 {
+		return errors.Wrapf(ErrMultipleSets, "%s", setIDs(sets))
+	}
+	*stat = *set
+	return nil
+}
+
+// ParseSets reads the packets of the files, grouped by their recovery set.
+//
+// The sets are in the order of their first packet.
+func ParseSets(parFiles []string) ([]*ParInfo, error) {
+	var sets []*ParInfo
+	byID := make(map[MD5]*ParInfo)
+	packetsOf := make(map[MD5][]Packet)
+	for _, fn := range parFiles {
+		packets, err := readPacketsFile(nil, fn)
+		if err != nil {
+			return sets, errors.WithMessage(err, "read packets")
+		}
+		for _, p := range packets {
+			id := p.packetHeader().RecoverySetID
+			set := byID[id]
+			if set == nil {
+				set = &ParInfo{RecoverySetID: id, BaseDir: filepath.Dir(fn)}
+				byID[id] = set
+				sets = append(sets, set)
+			}
+			if n := len(set.ParFiles); n == 0 || set.ParFiles[n-1] != fn {
+				set.ParFiles = append(set.ParFiles, fn)
+			}
+			if !contains(packetsOf[id], p) {
+				packetsOf[id] = append(packetsOf[id], p)
+			}
+		}
+	}
+	for _, set := range sets {
+		set.addPackets(packetsOf[set.RecoverySetID])
+	}
+	return sets, nil
+}
+
+// StatSets returns the recovery sets of the par2 file and its volumes,
+// or of all the par2 files in the directory.
+func StatSets(file string) ([]*ParInfo, error) {
+	var parFiles []string
+	var err error
+	if fi, statErr := os.Stat(file); statErr == nil && fi.IsDir() {
+		parFiles, err = filepath.Glob(filepath.Join(file, "*.par2"))
+	} else {
+		parFiles, err = allParFiles(file)
+	}
 	if err != nil {
-		return errors.WithMessage(err, "read packets")
+		return nil, errors.WithMessage(err, "list par files")
+	}
+	if len(parFiles) == 0 {
+		return nil, errors.New("No par file found")
+	}
+	return ParseSets(parFiles)
+}
+
+// FindSet returns the set whose ID (as string) starts with the given prefix.
+func FindSet(sets []*ParInfo, prefix string) (*ParInfo, error) {
+	var found *ParInfo
+	for _, set := range sets {
+		if strings.HasPrefix(set.RecoverySetID.String(), prefix) {
+			if found != nil {
+				return nil, errors.Errorf("recovery set %q is ambiguous (%s)", prefix, setIDs(sets))
+			}
+			found = set
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("recovery set %q not found (%s)", prefix, setIDs(sets))
+	}
+	return found, nil
+}
+
+func setIDs(sets []*ParInfo) string {
+	ids := make([]string, len(sets))
+	for i, set := range sets {
+		ids[i] = set.RecoverySetID.String()
 	}
+	return strings.Join(ids, ", ")
+}
+
+// addPackets fills the set from the packets of the set.
+func (stat *ParInfo) addPackets(packets []Packet) {
 	stat.Files = make([]*File, 0, len(packets))
 	stat.RecoveryData = make([]*RecoverySlicePacket, 0, len(packets))
 
-	stat.BaseDir = filepath.Dir(stat.ParFiles[0])
 	table := make(map[MD5]*File)
+	var unicodeNames []*UnicodeFileNamePacket
 	for _, p := range packets {
 		switch x := p.(type) {
 		case *MainPacket:
 			stat.Main = x
 		case *CreatorPacket:
 			stat.Creator = x
+		case *ASCIICommentPacket, *UnicodeCommentPacket:
+			stat.Comments = append(stat.Comments, x)
+		case *UnicodeFileNamePacket:
+			unicodeNames = append(unicodeNames, x)
 		case *RecoverySlicePacket:
 			stat.RecoveryData = append(stat.RecoveryData, x)
 		case *FileDescPacket:
@@ -145,129 +262,134 @@ func (stat *ParInfo) Parse() error {
 			}
 		}
 	}
-
-	return nil
+	for _, u := range unicodeNames {
+		if f := table[u.FileID]; f != nil {
+			f.UnicodeName = u
+		}
+	}
+	// empty files and directory entries need no checksums
+	for _, p := range packets {
+		if x, ok := p.(*FileDescPacket); ok && x.FileLength == 0 {
+			if f := table[x.FileID]; f.IFSCPacket == nil {
+				f.IFSCPacket = &IFSCPacket{FileID: x.FileID}
+				f.IFSCPacket.RecoverySetID = x.RecoverySetID
+				f.IFSCPacket.SetType(TypeIFSCPacket)
+				stat.Files = append(stat.Files, f)
+			}
+		}
+	}
+	// the non-recovery set files are not part of the input blocks
+	if stat.Main != nil && len(stat.Main.NonRecoverySetFileIDs) != 0 {
+		stat.BlockCount = 0
+		for _, id := range stat.Main.RecoverySetFileIDs {
+			if f := table[id]; f != nil && f.IFSCPacket != nil {
+				stat.BlockCount += uint32(len(f.Pairs))
+			}
+		}
+	}
 }
 
-func Verify(info *ParInfo) {
-	totalGood := 0
-	hash := md5.New()
-	var hshBuf MD5
-
-FilesLoop:
-	for _, file := range info.Files {
-		fname := fmt.Sprintf("%s/%s", info.BaseDir, file.FileName)
-		if _, err := os.Stat(fname); os.IsNotExist(err) {
-			fmt.Printf("\t%s: missing\n", file.FileName)
-			continue
+// IsNonRecovery reports whether the file is a non-recovery set file:
+// verified by its checksums, but not protected by the recovery slices.
+func (stat *ParInfo) IsNonRecovery(f *File) bool {
+	if stat.Main == nil || f.FileDescPacket == nil {
+		return false
+	}
+	for _, id := range stat.Main.NonRecoverySetFileIDs {
+		if id == f.FileDescPacket.FileID {
+			return true
 		}
+	}
+	return false
+}
 
-		goodBlocks := 0
-		f, err := os.Open(fname)
-		if err != nil {
-			fmt.Printf("\t%s: open: %v\n", fname, err)
-			continue
+// CommentTexts returns the texts of the comments.
+// An ASCII comment is omitted if its Unicode version is present.
+func (stat *ParInfo) CommentTexts() []string {
+	replaced := make(map[MD5]bool)
+	for _, p := range stat.Comments {
+		if uc, ok := p.(*UnicodeCommentPacket); ok && !uc.ASCIIPacketMD5.IsZero() {
+			replaced[uc.ASCIIPacketMD5] = true
 		}
-
-		for _, pair := range file.Pairs {
-			if _, err := io.CopyN(hash, f, int64(info.Main.BlockSize)); err != nil {
-				fmt.Printf("\t%s: read: %v\n", fname, err)
-				f.Close()
-				continue FilesLoop
-			}
-			hash.Sum(hshBuf[:0])
-			if hshBuf == pair.MD5 {
-				goodBlocks++
+	}
+	texts := make([]string, 0, len(stat.Comments))
+	for _, p := range stat.Comments {
+		switch x := p.(type) {
+		case *ASCIICommentPacket:
+			if !replaced[x.PacketMD5] {
+				texts = append(texts, x.Comment)
 			}
-			hash.Reset()
+		case *UnicodeCommentPacket:
+			texts = append(texts, x.Comment)
 		}
-		totalGood += goodBlocks
-		f.Close()
-
-		fmt.Printf("\t%s: %d/%d blocks available\n", file.FileName, goodBlocks, len(file.Pairs))
 	}
-	missing := info.BlockCount - uint32(totalGood)
-	fmt.Printf("\t-------\n\t%d missing blocks, %d recovery blocks: ", missing, len(info.RecoveryData))
+	return texts
+}
 
-	if missing == 0 {
-		fmt.Println("Repair not needed.")
-	} else if missing > uint32(len(info.RecoveryData)) {
-		fmt.Println("Repair not possible.")
-	} else {
-		fmt.Println("Repair is required.")
+// InputFiles returns the files of the recovery set, in the order of the input blocks:
+// the order of the main packet's (sorted) RecoverySetFileIDs.
+func (stat *ParInfo) InputFiles() ([]*File, error) {
+	if stat.Main == nil {
+		return nil, errors.New("no main packet")
+	}
+	byID := make(map[MD5]*File, len(stat.Files))
+	for _, f := range stat.Files {
+		byID[f.FileDescPacket.FileID] = f
 	}
+	files := make([]*File, len(stat.Main.RecoverySetFileIDs))
+	for i, id := range stat.Main.RecoverySetFileIDs {
+		if files[i] = byID[id]; files[i] == nil {
+			return files, errors.Errorf("no file description or checksums for %s", id)
+		}
+	}
+	return files, nil
 }
 
+// allParFiles returns file and the volumes of the same recovery set (base.*par2).
 func allParFiles(file string) ([]string, error) {
 	dir, fname := filepath.Split(file)
 	ext := filepath.Ext(fname)
 	glob := dir + fname[:len(fname)-len(ext)] + ".*par2"
 	files, err := filepath.Glob(glob)
-	return files, errors.Wrap(err, glob)
+	if err != nil {
+		return files, errors.Wrap(err, glob)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return files, nil
+	}
+	for _, f := range files {
+		if f == file {
+			return files, nil
+		}
+	}
+	return append([]string{file}, files...), nil
 }
 
-func readPackets(packets []Packet, files []string) ([]Packet, error) {
-	if len(files) == 0 {
-		log.Printf("No files provided.")
-		return nil, nil
+// readPacketsFile appends the undamaged packets of the file to packets.
+func readPacketsFile(packets []Packet, par string) ([]Packet, error) {
+	f, err := os.Open(par)
+	if err != nil {
+		return packets, errors.Wrap(err, par)
 	}
-	packets = packets[:0]
-	buf := bytesPool.Get()
-	defer bytesPool.Put(buf)
-	for _, par := range files {
-		f, err := os.Open(par)
-		if err != nil {
-			return packets, errors.Wrap(err, par)
-		}
+	defer f.Close()
 
-		defer f.Close()
-		stat, err := f.Stat()
-		if err != nil {
-			return packets, errors.Wrap(err, "stat "+f.Name())
+	scanner := NewScanner(f)
+	for scanner.Scan() {
+		p := scanner.Packet()
+		if scanner.Header().Damaged || contains(packets, p) {
+			continue
 		}
-		parSize := stat.Size()
-
-		for {
-			var h Header
-			if err := h.readFrom(f); err == io.EOF {
-				break
-			} else if err != nil {
-				return packets, errors.Wrapf(err, "readFrom %q", f.Name())
-			}
-			if !h.ValidSequence() {
-				r, err := f.Seek(-7, io.SeekCurrent)
-				if err != nil {
-					return packets, errors.Wrap(err, "Seek -7")
-				}
-				if (parSize - r) < 8 {
-					break
-				}
-				continue
-			}
-
-			n := int(h.Length - headerLength)
-			if cap(buf) < n {
-				buf = make([]byte, n)
-				defer bytesPool.Put(buf)
-			} else {
-				buf = buf[:n]
-			}
-			if _, err := io.ReadFull(f, buf); err != nil {
-				return packets, errors.Wrapf(err, "read %d bytes from %q", n, f.Name())
-			}
-
-			p := h.Create()
-			h.verifyPacket(buf)
-			p.readBody(buf)
-
-			if h.Damaged || contains(packets, p) {
-				continue
-			}
-			packets = append(packets, p)
+		packets = append(packets, p)
+	}
+	if scanner.Skipped() != 0 {
+		log.Printf("%s: skipped %d bytes of garbage.", par, scanner.Skipped())
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Cause(err) != ErrTruncated {
+			return packets, errors.Wrap(err, par)
 		}
-		f.Close()
+		log.Printf("%s: %v", par, err)
 	}
-
 	return packets, nil
 }
 
@@ -287,8 +409,10 @@ func (h Header) Create() Packet {
 	switch PacketType(h.Type[:]) {
 	case TypeMainPacket:
 		m := MainPacket{Header: h}
-		if _, err := rand.Read(m.RecoverySetID[:]); err != nil {
-			panic(err)
+		if m.RecoverySetID.IsZero() {
+			if _, err := rand.Read(m.RecoverySetID[:]); err != nil {
+				panic(err)
+			}
 		}
 		return &m
 	case TypeFileDescPacket:
@@ -299,6 +423,12 @@ func (h Header) Create() Packet {
 		return &RecoverySlicePacket{Header: h}
 	case TypeCreatorPacket:
 		return &CreatorPacket{Header: h}
+	case TypeUnicodeFileNamePacket:
+		return &UnicodeFileNamePacket{Header: h}
+	case TypeASCIICommentPacket:
+		return &ASCIICommentPacket{Header: h}
+	case TypeUnicodeCommentPacket:
+		return &UnicodeCommentPacket{Header: h}
 	}
 
 	return &UnknownPacket{Header: h}
@@ -311,6 +441,17 @@ func CreatePacket(typ PacketType) Packet {
 }
 
 func WritePacket(w io.Writer, p Packet) (int64, error) {
+	if r, ok := p.(*RecoverySlicePacket); ok && r.RecoveryData == nil && r.File != "" {
+		data, err := r.Data()
+		if err != nil {
+			return 0, err
+		}
+		loaded := *r
+		loaded.RecoveryData = data
+		n, err := WritePacket(w, &loaded)
+		r.Header = loaded.Header
+		return n, err
+	}
 	b := bytesPool.Get()
 	defer bytesPool.Put(b)
 	return p.(interface {
@@ -318,7 +459,8 @@ func WritePacket(w io.Writer, p Packet) (int64, error) {
 	}).writeTo(w, p.writeBody(b))
 }
 
-func (h Header) verifyPacket(body []byte) {
+// verifyPacket reports whether the body matches the packet's checksum.
+func (h Header) verifyPacket(body []byte) bool {
 	hash := md5.New()
 	hash.Write(h.RecoverySetID[:])
 	hash.Write(h.Type[:])
@@ -326,7 +468,7 @@ func (h Header) verifyPacket(body []byte) {
 
 	b := bytesPool.Get()
 	defer bytesPool.Put(b)
-	h.Damaged = (len(body)%4) != 0 || !bytes.Equal(hash.Sum(b), h.PacketMD5[:])
+	return len(body)%4 == 0 && bytes.Equal(hash.Sum(b), h.PacketMD5[:])
 }
 
 var bytesPool = byteSlices{Pool: sync.Pool{New: func() interface{} { return make([]byte, 0, 1024) }}}
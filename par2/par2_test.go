@@ -1,6 +1,16 @@
 package par2
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
 
 //go:generate rm -f testdata/input.txt.vol*.par2
 //go:generate par2create -r30 -s2048 -n1 -a testdata/input.txt.par2 testdata/input.txt
@@ -72,3 +82,112 @@ func TestFileInfo(t *testing.T) {
 		}
 	}
 }
+
+// TestChecksumPair checks the checksums of the blocks against par2cmdline's:
+// the CRC32 is stored little-endian.
+func TestChecksumPair(t *testing.T) {
+	info, err := Stat("testdata/input.txt.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockSize := int(info.Main.BlockSize)
+	want := info.Files[0].IFSCPacket.Pairs
+	cw := NewChecksumPairWriter()
+	for i := 0; len(data) > 0; i++ {
+		block := make([]byte, blockSize)
+		data = data[copy(block, data):]
+		if i >= len(want) {
+			t.Fatalf("got more than %d blocks", len(want))
+		}
+		if got := NewChecksumPair(block); got != want[i] {
+			t.Errorf("%d. got %v, wanted %v", i, got, want[i])
+		}
+		if got, crc := binary.LittleEndian.Uint32(want[i].CRC32[:]), crc32.ChecksumIEEE(block); got != crc {
+			t.Errorf("%d. got CRC32 %08x, wanted %08x", i, got, crc)
+		}
+		cw.Write(block)
+	}
+	for i, got := range cw.Pairs {
+		if got != want[i] {
+			t.Errorf("%d. writer got %v, wanted %v", i, got, want[i])
+		}
+	}
+}
+
+// TestReadBodyCopies checks that the packets keep a copy of the body, as the reader reuses its buffer.
+func TestReadBodyCopies(t *testing.T) {
+	body := []byte{1, 0, 0, 0, 'd', 'a', 't', 'a'}
+	rs := CreatePacket(TypeRecoverySlicePacket).(*RecoverySlicePacket)
+	if err := rs.readBody(body); err != nil {
+		t.Fatal(err)
+	}
+	var u UnknownPacket
+	if err := u.readBody(body); err != nil {
+		t.Fatal(err)
+	}
+	for i := range body {
+		body[i] = 0
+	}
+	if rs.Exponent != 1 || string(rs.RecoveryData) != "data" {
+		t.Errorf("recovery slice: got %d %q", rs.Exponent, rs.RecoveryData)
+	}
+	if want := []byte{1, 0, 0, 0, 'd', 'a', 't', 'a'}; !bytes.Equal(u.Body, want) {
+		t.Errorf("unknown: got %q, wanted %q", u.Body, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, fn := range []string{"input.txt", "input.txt.par2", "input.txt.vol0+1.par2"} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fn == "input.txt" {
+			b[len(b)-1]++
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := Stat(filepath.Join(dir, "input.txt.par2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := Verify(info)
+	if len(rep.Files) != 1 {
+		t.Fatalf("got %d files, wanted 1", len(rep.Files))
+	}
+	fr := rep.Files[0]
+	if !fr.Exists || fr.Err != nil || !reflect.DeepEqual(fr.BadBlocks, []int{int(info.BlockCount) - 1}) || len(fr.GoodBlocks) != int(info.BlockCount)-1 {
+		t.Errorf("got %#v", fr)
+	}
+	if rep.MissingBlocks != 1 || rep.AvailableRecovery != 1 || rep.NeededRecovery != 0 || rep.Status != RepairRequired {
+		t.Errorf("got %#v", rep)
+	}
+	var buf bytes.Buffer
+	if _, err := rep.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("\tinput.txt: %d/%d blocks available\n\t-------\n\t1 missing blocks, 1 recovery blocks: Repair is required.\n",
+		info.BlockCount-1, info.BlockCount)
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "input.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if rep = Verify(info); rep.Files[0].Exists || rep.Status != RepairImpossible || rep.NeededRecovery != int(info.BlockCount)-1 {
+		t.Errorf("got %#v", rep)
+	}
+}
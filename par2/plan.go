@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// VolumeSlices is the number of the usable recovery slices in a par file.
+type VolumeSlices struct {
+	File   string
+	Slices int
+}
+
+// Plan is the minimal set of volumes needed for the repair.
+type Plan struct {
+	// MissingBlocks is the number of missing input blocks (from the VerifyReport),
+	// AvailableRecovery is the number of distinct recovery slices in all the Volumes.
+	MissingBlocks, AvailableRecovery int
+	// Volumes are the par files with recovery slices.
+	Volumes []VolumeSlices
+	// Needed is the smallest subset of the Volumes with enough recovery slices,
+	// NeededRecovery is the number of recovery slices in them.
+	Needed         []string
+	NeededRecovery int
+	// Enough is false if all the Volumes are not enough for the repair.
+	Enough bool
+}
+
+// NewPlan returns the plan for the repair of the verified set:
+// the fewest volume files which hold enough recovery slices (and the smaller ones of those).
+//
+// Each vol file holds the critical packets, too, so the Needed ones are enough for the repair.
+func NewPlan(info *ParInfo, rep *VerifyReport) *Plan {
+	plan := Plan{MissingBlocks: rep.MissingBlocks}
+	blockSize := -1
+	if info.Main != nil {
+		blockSize = int(info.Main.BlockSize)
+	}
+	// the distinct exponents of each file
+	exponents := make(map[string]map[uint32]bool)
+	var files []string
+	all := make(map[uint32]bool)
+	for _, r := range info.RecoveryData {
+		if r.Damaged || r.Len() != blockSize {
+			continue
+		}
+		m := exponents[r.File]
+		if m == nil {
+			m = make(map[uint32]bool)
+			exponents[r.File] = m
+			files = append(files, r.File)
+		}
+		m[r.Exponent] = true
+		all[r.Exponent] = true
+	}
+	for _, fn := range files {
+		plan.Volumes = append(plan.Volumes, VolumeSlices{File: fn, Slices: len(exponents[fn])})
+	}
+	plan.AvailableRecovery = len(all)
+	if plan.Enough = plan.AvailableRecovery >= plan.MissingBlocks; !plan.Enough {
+		return &plan
+	}
+
+	// greedy: the smallest file which completes the need, or the one adding the most slices
+	have := make(map[uint32]bool, plan.MissingBlocks)
+	remaining := append([]string(nil), files...)
+	for len(have) < plan.MissingBlocks {
+		best, bestNew, complete := -1, 0, false
+		for i, fn := range remaining {
+			var n int
+			for e := range exponents[fn] {
+				if !have[e] {
+					n++
+				}
+			}
+			switch done := len(have)+n >= plan.MissingBlocks; {
+			case done && (!complete || n < bestNew):
+				best, bestNew, complete = i, n, true
+			case !done && !complete && n > bestNew:
+				best, bestNew = i, n
+			}
+		}
+		fn := remaining[best]
+		remaining = append(remaining[:best], remaining[best+1:]...)
+		for e := range exponents[fn] {
+			have[e] = true
+		}
+		plan.Needed = append(plan.Needed, fn)
+	}
+	plan.NeededRecovery = len(have)
+	sort.Strings(plan.Needed)
+	return &plan
+}
+
+// WriteTo writes the plan as text.
+func (plan *Plan) WriteTo(w io.Writer) (int64, error) {
+	ew := &errWriter{w: w}
+	fmt.Fprintf(ew, "\t%d missing blocks, %d recovery blocks\n", plan.MissingBlocks, plan.AvailableRecovery)
+	for _, v := range plan.Volumes {
+		fmt.Fprintf(ew, "\t%s: %d recovery blocks\n", v.File, v.Slices)
+	}
+	switch {
+	case !plan.Enough:
+		fmt.Fprintf(ew, "\t-------\n\tnot enough recovery blocks: %d more needed\n", plan.MissingBlocks-plan.AvailableRecovery)
+	case len(plan.Needed) == 0:
+		fmt.Fprintf(ew, "\t-------\n\tno volumes needed\n")
+	default:
+		fmt.Fprintf(ew, "\t-------\n\t%d volumes needed (%d recovery blocks):\n", len(plan.Needed), plan.NeededRecovery)
+		for _, fn := range plan.Needed {
+			fmt.Fprintf(ew, "\t%s\n", fn)
+		}
+	}
+	return ew.N, ew.Err
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// maxPacketLength is the upper bound of a packet's length:
+// a recovery slice packet of a 1GiB block.
+const maxPacketLength = headerLength + 4 + 1<<30
+
+var (
+	// ErrTruncated is returned for a packet which is longer than the rest of the input.
+	ErrTruncated = errors.New("truncated packet")
+
+	errBadBody = errors.New("bad packet body")
+)
+
+// packetReader reads the packets from a stream, skipping the garbage between them.
+//
+// The magic sequence is searched byte-by-byte, the length is checked for sanity,
+// and the rest of a damaged packet is rescanned, as it may contain the start of a good one.
+type packetReader struct {
+	br *bufio.Reader
+	// pending bytes are read before br.
+	pending []byte
+	// size of the input, -1 if unknown
+	size int64
+	// Offset of the next unread byte.
+	Offset int64
+	// Start is the offset of the last packet.
+	Start int64
+	// Skipped is the number of garbage bytes skipped.
+	Skipped int64
+	buf     []byte
+
+	// file is the name of rs, to record the place of the recovery data, instead of reading it.
+	file string
+	rs   io.ReadSeeker
+}
+
+func newPacketReader(r io.Reader, size int64) *packetReader {
+	return &packetReader{br: bufio.NewReader(r), size: size}
+}
+
+// newFilePacketReader returns a packetReader for the file,
+// which does not read the recovery data into memory, just records its place.
+func newFilePacketReader(fh *os.File, size int64) *packetReader {
+	pr := newPacketReader(fh, size)
+	pr.file, pr.rs = fh.Name(), fh
+	return pr
+}
+
+// seek to the offset, dropping the buffered and pending bytes.
+func (pr *packetReader) seek(offset int64) error {
+	if _, err := pr.rs.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrap(err, pr.file)
+	}
+	pr.br.Reset(pr.rs)
+	pr.pending, pr.Offset = nil, offset
+	return nil
+}
+
+func (pr *packetReader) Read(p []byte) (int, error) {
+	if len(pr.pending) != 0 {
+		n := copy(p, pr.pending)
+		pr.pending = pr.pending[n:]
+		pr.Offset += int64(n)
+		return n, nil
+	}
+	n, err := pr.br.Read(p)
+	pr.Offset += int64(n)
+	return n, err
+}
+
+func (pr *packetReader) ReadByte() (byte, error) {
+	if len(pr.pending) != 0 {
+		c := pr.pending[0]
+		pr.pending = pr.pending[1:]
+		pr.Offset++
+		return c, nil
+	}
+	c, err := pr.br.ReadByte()
+	if err == nil {
+		pr.Offset++
+	}
+	return c, err
+}
+
+// unread pushes back p, to be read again.
+func (pr *packetReader) unread(p []byte) {
+	pr.pending = append(append(make([]byte, 0, len(p)+len(pr.pending)), p...), pr.pending...)
+	pr.Offset -= int64(len(p))
+}
+
+// findMagic reads till the end of the next magic sequence.
+//
+// Returns io.EOF if there is no more.
+func (pr *packetReader) findMagic() error {
+	var win [8]byte
+	n, err := io.ReadFull(pr, win[:])
+	if err != nil {
+		pr.Skipped += int64(n)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return err
+	}
+	for string(win[:]) != validSequence {
+		c, err := pr.ReadByte()
+		if err != nil {
+			pr.Skipped += int64(len(win))
+			return err
+		}
+		pr.Skipped++
+		copy(win[:], win[1:])
+		win[len(win)-1] = c
+	}
+	return nil
+}
+
+// next returns the next packet.
+//
+// A packet whose checksum or body is bad is returned with Damaged set,
+// its body is rescanned for packets.
+// Returns ErrTruncated (with the offset) if the input ends in the middle of a packet,
+// the rest is rescanned, too, so next can be called again.
+func (pr *packetReader) next() (Packet, error) {
+	for {
+		if err := pr.findMagic(); err != nil {
+			return nil, err
+		}
+		start := pr.Offset - 8
+		pr.Start = start
+		var b [headerLength]byte
+		copy(b[:], validSequence)
+		if n, err := io.ReadFull(pr, b[8:]); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			pr.unread(b[8 : 8+n])
+			pr.Skipped += 8
+			return nil, errors.Wrapf(ErrTruncated, "header at %d", start)
+		}
+		var h Header
+		h.decode(b[:])
+		if h.Length%4 != 0 || h.Length < headerLength || h.Length > maxPacketLength {
+			// not a real packet, or a damaged header
+			pr.unread(b[8:])
+			pr.Skipped += 8
+			continue
+		}
+		n := int64(h.Length - headerLength)
+		if pr.size >= 0 && start+int64(h.Length) > pr.size {
+			pr.unread(b[8:])
+			pr.Skipped += 8
+			return nil, errors.Wrapf(ErrTruncated, "packet at %d of length %d (input size is %d)", start, h.Length, pr.size)
+		}
+
+		if pr.rs != nil && PacketType(h.Type[:]) == TypeRecoverySlicePacket && n >= 4 {
+			p, err := pr.skipRecoveryData(h, start)
+			if err != nil {
+				return nil, err
+			}
+			if p.Damaged {
+				// rescan the damaged packet
+				if err := pr.seek(start + 8); err != nil {
+					return nil, err
+				}
+				pr.Skipped += 8
+			}
+			return p, nil
+		}
+
+		// the body is not preallocated, so a bogus length does not allocate more than the input
+		body := bytes.NewBuffer(pr.buf[:0])
+		k, err := io.CopyN(body, pr, n)
+		pr.buf = body.Bytes()
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			pr.unread(append(b[8:], pr.buf...))
+			pr.Skipped += 8
+			return nil, errors.Wrapf(ErrTruncated, "packet at %d of length %d, got only %d bytes of the body", start, h.Length, k)
+		}
+
+		h.Damaged = !h.verifyPacket(pr.buf)
+		p := h.Create()
+		if !h.Damaged {
+			if err := p.readBody(pr.buf); err != nil {
+				h.Damaged = true
+				p = h.Create()
+			}
+		}
+		if h.Damaged {
+			// the damaged packet may hide the start of a good one
+			pr.unread(append(b[8:], pr.buf...))
+			pr.Skipped += 8
+		}
+		return p, nil
+	}
+}
+
+// skipRecoveryData reads the recovery slice packet of h, starting at start,
+// checking the checksum but not keeping the recovery data, just its place.
+func (pr *packetReader) skipRecoveryData(h Header, start int64) (*RecoverySlicePacket, error) {
+	var a [4]byte
+	if _, err := io.ReadFull(pr, a[:]); err != nil {
+		return nil, pr.truncated(h, start, err)
+	}
+	hsh := md5.New()
+	hsh.Write(h.RecoverySetID[:])
+	hsh.Write(h.Type[:])
+	hsh.Write(a[:])
+	r := RecoverySlicePacket{
+		Header:   h,
+		Exponent: binary.LittleEndian.Uint32(a[:]),
+		File:     pr.file, Offset: pr.Offset,
+		DataLength: int(h.Length - headerLength - 4),
+	}
+	if _, err := io.CopyN(hsh, pr, int64(r.DataLength)); err != nil {
+		return nil, pr.truncated(h, start, err)
+	}
+	var sum MD5
+	hsh.Sum(sum[:0])
+	r.Damaged = sum != h.PacketMD5
+	return &r, nil
+}
+
+// truncated seeks back after the magic of the packet at start,
+// and returns ErrTruncated for an EOF error.
+func (pr *packetReader) truncated(h Header, start int64, err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if err := pr.seek(start + 8); err != nil {
+		return err
+	}
+	pr.Skipped += 8
+	return errors.Wrapf(ErrTruncated, "packet at %d of length %d", start, h.Length)
+}
@@ -0,0 +1,251 @@
+package par2
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func readAll(t *testing.T, b []byte) ([]Packet, int, *packetReader) {
+	pr := newPacketReader(bytes.NewReader(b), int64(len(b)))
+	var packets []Packet
+	var truncated int
+	for {
+		p, err := pr.next()
+		if err != nil {
+			if err == io.EOF {
+				return packets, truncated, pr
+			}
+			if errors.Cause(err) != ErrTruncated {
+				t.Fatal(err)
+			}
+			truncated++
+			continue
+		}
+		if !p.packetHeader().Damaged {
+			packets = append(packets, p)
+		}
+	}
+}
+
+func TestPacketReader(t *testing.T) {
+	good, err := ioutil.ReadFile("testdata/input.txt.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, pr := readAll(t, good)
+	if pr.Skipped != 0 {
+		t.Errorf("skipped %d bytes of a good file", pr.Skipped)
+	}
+	if len(want) == 0 {
+		t.Fatal("no packets read")
+	}
+	first := int(want[0].packetHeader().Length)
+
+	for _, tc := range []struct {
+		Name      string
+		Data      []byte
+		Packets   int
+		Truncated int
+	}{
+		{"garbage", append(append([]byte("PAR2\000PKgarbage PAR2"), good...), "PAR2\000PKT"...), len(want), 1},
+		{"length", func() []byte {
+			b := append([]byte(nil), good...)
+			b[8] = 0xff // length not aligned
+			return b
+		}(), len(want) - 1, 0},
+		{"huge", func() []byte {
+			b := append([]byte(nil), good...)
+			b[15] = 0x7f
+			return b
+		}(), len(want) - 1, 0},
+		{"checksum", func() []byte {
+			b := append([]byte(nil), good...)
+			b[first-1]++
+			return b
+		}(), len(want) - 1, 0},
+		{"truncated", good[:len(good)-4], len(want) - 1, 1},
+	} {
+		got, truncated, _ := readAll(t, tc.Data)
+		if len(got) != tc.Packets || truncated != tc.Truncated {
+			t.Errorf("%s: got %d packets and %d truncated, wanted %d and %d.",
+				tc.Name, len(got), truncated, tc.Packets, tc.Truncated)
+		}
+	}
+}
+
+func TestHeaderTruncated(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/input.txt.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h Header
+	if err := h.readFrom(bytes.NewReader(b[:20])); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func FuzzReadPackets(f *testing.F) {
+	for _, fn := range []string{"testdata/input.txt.par2", "testdata/input.txt.vol0+1.par2"} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	dir, err := ioutil.TempDir("", "par2-fuzz-")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "fuzz.par2")
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPacketsFile(nil, fn); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzReadBody(f *testing.F) {
+	types := []PacketType{
+		TypeMainPacket, TypeFileDescPacket, TypeIFSCPacket, TypeRecoverySlicePacket,
+		TypeCreatorPacket, TypeUnicodeFileNamePacket, TypeASCIICommentPacket, TypeUnicodeCommentPacket,
+		PacketType("PAR 2.0\000Unknown\000"),
+	}
+	b, err := ioutil.ReadFile("testdata/input.txt.par2")
+	if err != nil {
+		f.Fatal(err)
+	}
+	pr := newPacketReader(bytes.NewReader(b), int64(len(b)))
+	for {
+		p, err := pr.next()
+		if err != nil {
+			break
+		}
+		h := p.packetHeader()
+		for i, typ := range types {
+			if string(h.Type[:]) == string(typ) {
+				f.Add(uint8(i), append([]byte(nil), p.writeBody(nil)...))
+			}
+		}
+	}
+	f.Add(uint8(0), []byte{})
+	f.Fuzz(func(t *testing.T, i uint8, body []byte) {
+		p := CreatePacket(types[int(i)%len(types)])
+		if err := p.readBody(body); err != nil {
+			return
+		}
+		p.writeBody(nil)
+	})
+}
+
+func TestLazyRecoveryData(t *testing.T) {
+	info, err := Stat("testdata/input.txt.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.RecoveryData) == 0 {
+		t.Fatal("no recovery data")
+	}
+	rd := info.RecoveryData[0]
+	if rd.RecoveryData != nil || rd.File == "" {
+		t.Errorf("recovery data is loaded: %#v", rd)
+	}
+	data, err := rd.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != int(info.Main.BlockSize) {
+		t.Errorf("got %d bytes, wanted %d", len(data), info.Main.BlockSize)
+	}
+
+	// a damaged recovery slice is skipped, the rest is read
+	b, err := ioutil.ReadFile(rd.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := readPacketsFile(nil, rd.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[rd.Offset+10]++
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "damaged.par2")
+	if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPacketsFile(nil, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(good)-1 {
+		t.Errorf("got %d packets, wanted %d", len(got), len(good)-1)
+	}
+	for _, p := range got {
+		if _, ok := p.(*RecoverySlicePacket); ok {
+			t.Errorf("damaged recovery slice is read: %v", p)
+		}
+	}
+}
+
+func TestScanner(t *testing.T) {
+	good, err := ioutil.ReadFile("testdata/input.txt.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := []byte("garbage")
+	b := append(append(append([]byte(nil), garbage...), good...), good[:100]...)
+
+	var offsets []int64
+	scanner := NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if scanner.Header().Damaged {
+			t.Errorf("%d. packet at %d is damaged", len(offsets), scanner.Offset())
+		}
+		offsets = append(offsets, scanner.Offset())
+	}
+	if err := scanner.Err(); errors.Cause(err) != ErrTruncated {
+		t.Errorf("got error %v, wanted %v", err, ErrTruncated)
+	}
+	if len(offsets) == 0 || offsets[0] != int64(len(garbage)) {
+		t.Fatalf("got offsets %v, wanted first at %d", offsets, len(garbage))
+	}
+	if got, want := scanner.Skipped(), int64(len(garbage)+100); got != want {
+		t.Errorf("skipped %d bytes, wanted %d", got, want)
+	}
+
+	// the same offsets from a file, but without loading the recovery data
+	fh, err := os.Open("testdata/input.txt.vol0+1.par2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	scanner = NewScanner(fh)
+	var n int
+	for scanner.Scan() {
+		if rd, ok := scanner.Packet().(*RecoverySlicePacket); ok {
+			if rd.RecoveryData != nil || rd.Offset != scanner.Offset()+int64(headerLength)+4 {
+				t.Errorf("got %#v at %d", rd, scanner.Offset())
+			}
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Error(err)
+	}
+	if n == 0 {
+		t.Error("no packets")
+	}
+}
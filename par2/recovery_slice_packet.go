@@ -27,29 +27,68 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
 )
 
 type RecoverySlicePacket struct {
 	Header
 	Exponent     uint32
 	RecoveryData []byte `json:"-"`
+	// File and Offset locate the DataLength bytes of recovery data,
+	// when it is not read into RecoveryData.
+	File       string `json:",omitempty"`
+	Offset     int64  `json:",omitempty"`
+	DataLength int    `json:",omitempty"`
 }
 
 func (r RecoverySlicePacket) String() string {
-	return fmt.Sprintf("%s-RECOV-%s, %d/%d", r.PacketMD5, r.RecoverySetID, r.Exponent, len(r.RecoveryData))
+	return fmt.Sprintf("%s-RECOV-%s, %d/%d", r.PacketMD5, r.RecoverySetID, r.Exponent, r.Len())
+}
+
+// Len returns the length of the recovery data.
+func (r *RecoverySlicePacket) Len() int {
+	if r.RecoveryData == nil && r.File != "" {
+		return r.DataLength
+	}
+	return len(r.RecoveryData)
+}
+
+// Data returns the RecoveryData, or reads it from File.
+// The read data is not retained.
+func (r *RecoverySlicePacket) Data() ([]byte, error) {
+	if r.RecoveryData != nil || r.File == "" {
+		return r.RecoveryData, nil
+	}
+	fh, err := os.Open(r.File)
+	if err != nil {
+		return nil, errors.Wrap(err, r.File)
+	}
+	defer fh.Close()
+	b := make([]byte, r.DataLength)
+	if _, err := fh.ReadAt(b, r.Offset); err != nil {
+		return nil, errors.Wrapf(err, "read %d bytes from %s at %d", len(b), r.File, r.Offset)
+	}
+	return b, nil
 }
 
 func (r *RecoverySlicePacket) packetHeader() Header {
 	return r.Header
 }
 
-func (r *RecoverySlicePacket) readBody(body []byte) {
-	binary.Read(bytes.NewReader(body), binary.LittleEndian, &r.Exponent)
-	r.RecoveryData = body[4:]
+func (r *RecoverySlicePacket) readBody(body []byte) error {
+	if len(body) < 4 {
+		return errors.Wrapf(errBadBody, "recovery slice packet of %d bytes", len(body))
+	}
+	r.Exponent = binary.LittleEndian.Uint32(body)
+	// body is reused by the caller
+	r.RecoveryData = append([]byte(nil), body[4:]...)
+	return nil
 }
 
 func (r *RecoverySlicePacket) AvailableBlocks(blocksize uint64) uint64 {
-	return uint64(len(r.RecoveryData)) / blocksize
+	return uint64(r.Len()) / blocksize
 }
 
 func (r *RecoverySlicePacket) writeBody(dest []byte) []byte {
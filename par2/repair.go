@@ -0,0 +1,394 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"crypto/md5"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// RepairOptions are the options of Repair.
+type RepairOptions struct {
+	// NoBackup removes the damaged files, instead of keeping them with a .1 (.2, ...) suffix.
+	NoBackup bool
+	// Candidates are searched for the missing or damaged files (see FindMisnamed),
+	// with ScanDir all the other files of BaseDir, too.
+	Candidates []string
+	ScanDir    bool
+}
+
+// Repair the damaged or missing files of the recovery set in info.BaseDir, in place.
+//
+// The good blocks are found by the IFSC checksums (at any offset of the damaged files
+// and the candidates, see Verify), the missing ones are reconstructed
+// from the recovery slices. The repaired files are written into temporary files (next to the damaged ones)
+// and checked by their MD5; only if all of them are good, the damaged file is renamed with a .1 suffix
+// (or .2, if that exists, ...), as par2cmdline does, and the repaired one is moved under the original name.
+//
+// A misnamed file (found among the candidates) is renamed to its correct name.
+// The missing directory entries are created, the non-recovery set files are left alone.
+//
+// Returns the names of the repaired files.
+func Repair(info *ParInfo, opts RepairOptions) ([]string, error) {
+	// the names come from the par2 file, do not touch anything outside of BaseDir
+	for _, file := range info.Files {
+		if !file.IsLocal() {
+			return nil, errors.Errorf("%q is not under %q", file.Name(), info.BaseDir)
+		}
+	}
+	files, err := info.InputFiles()
+	if err != nil {
+		return nil, err
+	}
+	blockSize := int(info.Main.BlockSize)
+	candidates := opts.Candidates
+	if opts.ScanDir {
+		dirCandidates, err := info.DirCandidates()
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates[:len(candidates):len(candidates)], dirCandidates...)
+	}
+	misnamed, err := info.FindMisnamed(candidates)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+
+	// find the missing blocks
+	reports := make([]FileReport, len(files))
+	bases := make([]int, len(files))
+	var scan []string
+	used := make(map[string]bool, len(misnamed))
+	var base int
+	for i, file := range files {
+		bases[i] = base
+		base += len(file.Pairs)
+		fn := file.Path(info.BaseDir)
+		reports[i] = verifyFile(fn, file, blockSize)
+		if reports[i].Err != nil {
+			return names, errors.Wrap(reports[i].Err, fn)
+		}
+		if found := misnamed[file.Name()]; found != "" && (len(reports[i].BadBlocks) != 0 || fileSize(fn) != int64(file.FileLength)) {
+			if err := renameMisnamed(found, fn, reports[i].Exists, opts); err != nil {
+				return names, err
+			}
+			used[found] = true
+			names = append(names, fn)
+			reports[i] = verifyFile(fn, file, blockSize)
+		}
+		if reports[i].Exists && len(reports[i].BadBlocks) != 0 {
+			scan = append(scan, fn)
+		}
+	}
+	for _, fn := range candidates {
+		if !used[fn] {
+			scan = append(scan, fn)
+		}
+	}
+	scanDisplaced(files, blockSize, reports, scan)
+
+	var missing, damaged []int
+	for i, file := range files {
+		for _, j := range reports[i].BadBlocks {
+			missing = append(missing, bases[i]+j)
+		}
+		fn := file.Path(info.BaseDir)
+		if len(reports[i].BadBlocks) != 0 || len(reports[i].Displaced) != 0 || fileSize(fn) != int64(file.FileLength) {
+			damaged = append(damaged, i)
+		}
+	}
+	// the directory entries need no data
+	for _, file := range info.Files {
+		if !file.IsDir() {
+			continue
+		}
+		fn := file.Path(info.BaseDir)
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(fn, 0755); err != nil {
+			return names, errors.Wrap(err, fn)
+		}
+		log.Printf("Created directory %q.", fn)
+		names = append(names, fn)
+	}
+	if len(damaged) == 0 {
+		return names, nil
+	}
+
+	// add the good blocks to the decoder, and reconstruct the missing ones
+	var repaired map[int][]byte
+	if len(missing) != 0 {
+		dec := NewDecoder(blockSize, info.RecoveryData, len(missing))
+		if dec.Available() < len(missing) {
+			return names, errors.Wrapf(ErrNotEnoughRecovery, "%d missing, %d available", len(missing), dec.Available())
+		}
+		block := make([]byte, blockSize)
+		for i, file := range files {
+			base := bases[i]
+			if err := readBlocks(file.Path(info.BaseDir), file, reports[i], block,
+				func(j int, b []byte) { dec.Add(base+j, b) },
+			); err != nil {
+				return names, err
+			}
+		}
+		blocks, err := dec.Reconstruct(missing)
+		if err != nil {
+			return names, errors.Wrap(err, "Reconstruct")
+		}
+		repaired = make(map[int][]byte, len(missing))
+		for k, i := range missing {
+			repaired[i] = blocks[k]
+		}
+	}
+
+	// write the repaired files next to the damaged ones, and move them in place only if all of them are good,
+	// as the displaced blocks may be in any of the damaged files
+	tmps := make(map[int]string, len(damaged))
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for _, i := range damaged {
+		fn := files[i].Path(info.BaseDir)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return names, errors.Wrap(err, fn)
+		}
+		old := ""
+		if reports[i].Exists {
+			old = fn
+		}
+		tmp, err := repairFile(fn, old, files[i], reports[i], blockSize, bases[i], repaired)
+		if err != nil {
+			return names, err
+		}
+		tmps[i] = tmp
+	}
+	for _, i := range damaged {
+		fn := files[i].Path(info.BaseDir)
+		if reports[i].Exists {
+			if opts.NoBackup {
+				if err := os.Remove(fn); err != nil {
+					return names, errors.Wrap(err, fn)
+				}
+			} else if err := os.Rename(fn, backupName(fn)); err != nil {
+				return names, errors.Wrap(err, fn)
+			}
+		}
+		if err := os.Rename(tmps[i], fn); err != nil {
+			return names, errors.Wrap(err, fn)
+		}
+		delete(tmps, i)
+		log.Printf("Repaired %q.", fn)
+		names = append(names, fn)
+	}
+	return names, nil
+}
+
+// repairFile writes the file fn into a temporary file next to it, from the good blocks of the old (damaged) file,
+// the displaced blocks and the repaired blocks (indexed from base), and checks its MD5.
+//
+// Returns the name of the temporary file, which is removed on error.
+func repairFile(fn, old string, file *File, rep FileReport, blockSize, base int, repaired map[int][]byte) (string, error) {
+	var oldFh *os.File
+	if old != "" {
+		var err error
+		if oldFh, err = os.Open(old); err != nil {
+			return "", errors.Wrap(err, old)
+		}
+		defer oldFh.Close()
+	}
+	fh, err := createTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".par2-")
+	if err != nil {
+		return "", errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	// keep the mode of the damaged file
+	if oldFh != nil {
+		fi, err := oldFh.Stat()
+		if err == nil {
+			err = fh.Chmod(fi.Mode().Perm())
+		}
+		if err != nil {
+			os.Remove(fh.Name())
+			return "", errors.Wrap(err, fn)
+		}
+	}
+	if err := writeRepaired(fh, fn, oldFh, file, rep, blockSize, base, repaired); err != nil {
+		os.Remove(fh.Name())
+		return "", err
+	}
+	if err := fh.Close(); err != nil {
+		os.Remove(fh.Name())
+		return "", errors.Wrap(err, fn)
+	}
+	return fh.Name(), nil
+}
+
+// createTemp creates a new file in dir, named pattern and a random suffix.
+// Unlike ioutil.TempFile, the mode is 0666 (before umask), as of os.Create,
+// as the file replaces a missing one.
+func createTemp(dir, pattern string) (*os.File, error) {
+	for i := 0; ; i++ {
+		fh, err := os.OpenFile(filepath.Join(dir, pattern+strconv.FormatUint(uint64(rand.Uint32()), 10)),
+			os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil && os.IsExist(err) && i < 100 {
+			continue
+		}
+		return fh, err
+	}
+}
+
+func writeRepaired(fh *os.File, fn string, oldFh *os.File, file *File, rep FileReport, blockSize, base int, repaired map[int][]byte) error {
+	hsh := md5.New()
+	w := io.MultiWriter(fh, hsh)
+	block := make([]byte, blockSize)
+	for j, pair := range file.Pairs {
+		b := repaired[base+j]
+		if loc, ok := rep.Displaced[j]; ok && b == nil {
+			if err := readLocation(loc, file.BlockLength(blockSize, j), block); err != nil {
+				return err
+			}
+			b = block
+		} else if b == nil {
+			if oldFh == nil {
+				return errors.Errorf("%s: %d. block is neither good nor repaired", fn, j)
+			}
+			if err := readBlock(oldFh, file, j, block); err != nil {
+				return err
+			}
+			b = block
+		} else if got := NewChecksumPair(b); got != pair {
+			return errors.Errorf("%s: %d. reconstructed block mismatch (got %s, wanted %s)", fn, j, got, pair)
+		}
+		if _, err := w.Write(b[:file.BlockLength(blockSize, j)]); err != nil {
+			return errors.Wrap(err, fh.Name())
+		}
+	}
+	var sum MD5
+	hsh.Sum(sum[:0])
+	if sum != file.MD5 {
+		return errors.Errorf("%s: repaired file MD5 mismatch (got %s, wanted %s)", fn, sum, file.MD5)
+	}
+	return nil
+}
+
+// renameMisnamed renames the found file to fn, backing up (or removing) the existing fn.
+func renameMisnamed(found, fn string, exists bool, opts RepairOptions) error {
+	if exists {
+		if opts.NoBackup {
+			if err := os.Remove(fn); err != nil {
+				return errors.Wrap(err, fn)
+			}
+		} else if err := os.Rename(fn, backupName(fn)); err != nil {
+			return errors.Wrap(err, fn)
+		}
+	}
+	log.Printf("Rename misnamed %q to %q.", found, fn)
+	return errors.Wrap(os.Rename(found, fn), found)
+}
+
+// readBlocks reads the good blocks of the file (from their place, or where they are displaced to), calling f with each.
+func readBlocks(fn string, file *File, rep FileReport, block []byte, f func(int, []byte)) error {
+	if len(rep.GoodBlocks) == 0 {
+		return nil
+	}
+	var fh *os.File
+	for _, j := range rep.GoodBlocks {
+		if loc, ok := rep.Displaced[j]; ok {
+			if err := readLocation(loc, file.BlockLength(len(block), j), block); err != nil {
+				return err
+			}
+			f(j, block)
+			continue
+		}
+		if fh == nil {
+			var err error
+			if fh, err = os.Open(fn); err != nil {
+				return errors.Wrap(err, fn)
+			}
+			defer fh.Close()
+		}
+		if err := readBlock(fh, file, j, block); err != nil {
+			return err
+		}
+		f(j, block)
+	}
+	return nil
+}
+
+// readLocation reads length bytes from the location into block, padded with zeros.
+func readLocation(loc BlockLocation, length int, block []byte) error {
+	fh, err := os.Open(loc.File)
+	if err != nil {
+		return errors.Wrap(err, loc.File)
+	}
+	defer fh.Close()
+	if _, err := fh.ReadAt(block[:length], loc.Offset); err != nil {
+		return errors.Wrapf(err, "%s: read block at %d", loc.File, loc.Offset)
+	}
+	for k := length; k < len(block); k++ {
+		block[k] = 0
+	}
+	return nil
+}
+
+// readBlock reads the j-th block of the file into block, padded with zeros.
+func readBlock(fh *os.File, file *File, j int, block []byte) error {
+	length := file.BlockLength(len(block), j)
+	if _, err := fh.ReadAt(block[:length], int64(j)*int64(len(block))); err != nil {
+		return errors.Wrapf(err, "%s: read %d. block", fh.Name(), j)
+	}
+	for k := length; k < len(block); k++ {
+		block[k] = 0
+	}
+	return nil
+}
+
+// backupName returns the first not existing fn.1, fn.2, ...
+func backupName(fn string) string {
+	for i := 1; ; i++ {
+		bak := fn + "." + strconv.Itoa(i)
+		if _, err := os.Lstat(bak); os.IsNotExist(err) {
+			return bak
+		}
+	}
+}
+
+// fileSize returns the size of the file, -1 if it does not exist.
+func fileSize(fn string) int64 {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
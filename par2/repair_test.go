@@ -0,0 +1,413 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origs := make(map[string][]byte)
+	var files []string
+	for _, names := range [][2]string{{"testdata/input.txt", "a.txt"}, {"create.go", "b.go"}} {
+		src, dst := names[0], names[1]
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := filepath.Join(dir, dst)
+		origs[fn] = b
+		if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+	written, err := Create(CreateOptions{Output: filepath.Join(dir, "set.par2"), Files: files, BlockSize: 512, Redundancy: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names, err := Repair(info, RepairOptions{}); err != nil || len(names) != 0 {
+		t.Fatalf("repair of good files: %q, %v", names, err)
+	}
+
+	// damage a block of a.txt, truncate b.go
+	a, b := files[0], files[1]
+	damaged := append([]byte(nil), origs[a]...)
+	damaged[600]++
+	if err := ioutil.WriteFile(a, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(a, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(b, int64(len(origs[b])-100)); err != nil {
+		t.Fatal(err)
+	}
+	names, err := Repair(info, RepairOptions{})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(names) != 2 {
+		t.Errorf("got repaired %q, wanted both", names)
+	}
+	for _, fn := range files {
+		got, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, origs[fn]) {
+			t.Errorf("%s: repaired mismatch", fn)
+		}
+	}
+	if got, err := ioutil.ReadFile(a + ".1"); err != nil || !bytes.Equal(got, damaged) {
+		t.Errorf("backup of %s: %v", a, err)
+	}
+	// the repaired files keep their mode
+	for fn, want := range map[string]os.FileMode{a: 0640, b: 0644} {
+		if fi, err := os.Stat(fn); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != want {
+			t.Errorf("%s: got mode %v, wanted %v", fn, fi.Mode(), want)
+		}
+	}
+
+	// a missing file, without backup
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	damaged = append(damaged[:0], origs[b]...)
+	damaged[10]++
+	if err := ioutil.WriteFile(b, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Repair(info, RepairOptions{NoBackup: true}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, fn := range files {
+		if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, origs[fn]) {
+			t.Errorf("%s: repaired mismatch (%v)", fn, err)
+		}
+	}
+	if _, err := os.Stat(b + ".2"); !os.IsNotExist(err) {
+		t.Errorf("backup of %s: %v", b, err)
+	}
+	// the missing file gets the mode of a new file
+	fh, err := os.Create(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	if want, err := os.Stat(fh.Name()); err != nil {
+		t.Fatal(err)
+	} else if fi, err := os.Stat(a); err != nil {
+		t.Error(err)
+	} else if fi.Mode() != want.Mode() {
+		t.Errorf("%s: got mode %v, wanted %v", a, fi.Mode(), want.Mode())
+	}
+}
+
+func TestRepairFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origs := make(map[string][]byte)
+	var files []string
+	for _, names := range [][2]string{{"testdata/input.txt", "a.txt"}, {"create.go", "b.go"}} {
+		b, err := ioutil.ReadFile(names[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := filepath.Join(dir, names[1])
+		origs[fn] = b
+		if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+	written, err := Create(CreateOptions{Output: filepath.Join(dir, "set.par2"), Files: files, BlockSize: 512, Redundancy: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := make(map[string][]byte, len(files))
+	for _, fn := range files {
+		damaged[fn] = append([]byte(nil), origs[fn]...)
+		damaged[fn][600]++
+		if err := ioutil.WriteFile(fn, damaged[fn], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the repaired b.go won't match its MD5
+	for _, f := range info.Files {
+		if f.Name() == "b.go" {
+			f.MD5[0]++
+		}
+	}
+	if names, err := Repair(info, RepairOptions{}); err == nil {
+		t.Fatalf("repair succeeded: %q", names)
+	} else {
+		t.Log(err)
+	}
+	for _, fn := range files {
+		if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, damaged[fn]) {
+			t.Errorf("%s: changed by the failed repair (%v)", fn, err)
+		}
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if name := fi.Name(); name != "a.txt" && name != "b.go" && filepath.Ext(name) != ".par2" {
+			t.Errorf("%s is left behind", name)
+		}
+	}
+}
+
+func TestRepairNotLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig, err := ioutil.ReadFile("testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(sub, "a.txt")
+	if err := ioutil.WriteFile(fn, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	written, err := Create(CreateOptions{Output: filepath.Join(sub, "set.par2"), Files: []string{fn}, BlockSize: 512, Redundancy: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if a crafted par2 file named a file outside of the base dir
+	info.Files[0].FileName = "../outside.txt"
+	outside := filepath.Join(dir, "outside.txt")
+	damaged := append([]byte(nil), orig...)
+	damaged[10]++
+	if err := ioutil.WriteFile(outside, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rep := Verify(info, fn)
+	if len(rep.Files) != 1 || rep.Files[0].Err == nil || rep.Files[0].Exists {
+		t.Errorf("verify got %+v", rep.Files)
+	}
+	if names, err := Repair(info, RepairOptions{NoBackup: true, Candidates: []string{fn}}); err == nil {
+		t.Errorf("repair succeeded: %q", names)
+	}
+	if got, err := ioutil.ReadFile(outside); err != nil || !bytes.Equal(got, damaged) {
+		t.Errorf("%s is changed (%v)", outside, err)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, orig) {
+		t.Errorf("%s is changed (%v)", fn, err)
+	}
+}
+
+func TestMisnamed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig, err := ioutil.ReadFile("testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(fn, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	written, err := Create(CreateOptions{Output: filepath.Join(dir, "set.par2"), Files: []string{fn}, BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := filepath.Join(dir, "renamed.bin")
+	if err := os.Rename(fn, renamed); err != nil {
+		t.Fatal(err)
+	}
+	// same size, but different content
+	decoy := append([]byte(nil), orig...)
+	decoy[len(decoy)-1]++
+	if err := ioutil.WriteFile(filepath.Join(dir, "decoy.bin"), decoy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if rep := Verify(info); rep.Files[0].Exists || rep.Status != RepairImpossible {
+		t.Errorf("without candidates: got %#v", rep)
+	}
+	candidates, err := info.DirCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Errorf("got candidates %q, wanted the two .bin files", candidates)
+	}
+	rep := Verify(info, candidates...)
+	if rep.Files[0].Misnamed != renamed || rep.MissingBlocks != 0 || rep.Status != RepairRequired {
+		t.Errorf("with candidates: got %#v", rep)
+	}
+
+	names, err := Repair(info, RepairOptions{ScanDir: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != fn {
+		t.Errorf("got repaired %q, wanted %q", names, fn)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, orig) {
+		t.Errorf("%s: mismatch (%v)", fn, err)
+	}
+	if _, err := os.Stat(renamed); !os.IsNotExist(err) {
+		t.Errorf("%s still exists: %v", renamed, err)
+	}
+}
+
+func TestDisplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig := make([]byte, 8*512+100)
+	rand.New(rand.NewSource(1)).Read(orig)
+	fn := filepath.Join(dir, "a.bin")
+	if err := ioutil.WriteFile(fn, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	written, err := Create(CreateOptions{Output: filepath.Join(dir, "set.par2"), Files: []string{fn}, BlockSize: 512, Redundancy: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one inserted byte in the 3rd block: only that one is lost
+	shifted := append(append(append([]byte(nil), orig[:1100]...), 'X'), orig[1100:]...)
+	if err := ioutil.WriteFile(fn, shifted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rep := Verify(info)
+	if fr := rep.Files[0]; len(fr.BadBlocks) != 1 || fr.BadBlocks[0] != 2 || len(fr.Displaced) != 6 || rep.Status != RepairRequired {
+		t.Errorf("shifted: got %#v", rep)
+	}
+	if _, err := Repair(info, RepairOptions{NoBackup: true}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, orig) {
+		t.Errorf("%s: mismatch (%v)", fn, err)
+	}
+
+	// missing, but joined with another file, given as candidate
+	joined := filepath.Join(dir, "joined.bin")
+	if err := ioutil.WriteFile(joined, append(append([]byte("some other file"), orig...), "trailer"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(fn); err != nil {
+		t.Fatal(err)
+	}
+	if rep = Verify(info, joined); rep.MissingBlocks != 0 || len(rep.Files[0].Displaced) != 9 {
+		t.Errorf("joined: got %#v", rep)
+	}
+	if _, err := Repair(info, RepairOptions{Candidates: []string{joined}}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, orig) {
+		t.Errorf("%s: mismatch (%v)", fn, err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	info := ParInfo{Main: &MainPacket{BlockSize: 4}}
+	// exponential volumes, and a copy of the first one
+	var e uint32
+	for k := 1; k <= 8; k *= 2 {
+		for i := 0; i < k; i++ {
+			info.RecoveryData = append(info.RecoveryData, &RecoverySlicePacket{Exponent: e, File: fmt.Sprintf("vol%d", k), DataLength: 4})
+			e++
+		}
+	}
+	info.RecoveryData = append(info.RecoveryData, &RecoverySlicePacket{Exponent: 0, File: "copy1", DataLength: 4})
+
+	for _, tc := range []struct {
+		Missing int
+		Want    []string
+	}{
+		{0, nil},
+		{1, []string{"vol1"}},
+		{3, []string{"vol4"}},
+		{10, []string{"vol2", "vol8"}},
+		{15, []string{"vol1", "vol2", "vol4", "vol8"}},
+		{16, nil},
+	} {
+		plan := NewPlan(&info, &VerifyReport{MissingBlocks: tc.Missing})
+		if plan.AvailableRecovery != 15 || len(plan.Volumes) != 5 {
+			t.Errorf("%d: got %#v", tc.Missing, plan)
+		}
+		if plan.Enough != (tc.Missing <= 15) || !reflect.DeepEqual(plan.Needed, tc.Want) {
+			t.Errorf("%d: got %q (%t), wanted %q", tc.Missing, plan.Needed, plan.Enough, tc.Want)
+		}
+		if plan.Enough && plan.NeededRecovery < tc.Missing {
+			t.Errorf("%d: got %d recovery blocks", tc.Missing, plan.NeededRecovery)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Scanner reads the packets of a PAR2 stream one by one.
+//
+// Garbage between the packets is skipped, damaged packets are returned with Damaged set
+// in their Header (and their body is scanned for packets, too).
+// Truncated packets are skipped, the first such error is returned by Err.
+type Scanner struct {
+	pr        *packetReader
+	packet    Packet
+	err       error
+	truncated error
+}
+
+// NewScanner returns a Scanner reading from r.
+//
+// If r is an *os.File, the recovery data is not read into memory, just its place is recorded
+// (see RecoverySlicePacket.Data).
+func NewScanner(r io.Reader) *Scanner {
+	if fh, ok := r.(*os.File); ok {
+		if fi, err := fh.Stat(); err == nil && fi.Mode().IsRegular() {
+			offset, err := fh.Seek(0, io.SeekCurrent)
+			if err == nil {
+				pr := newFilePacketReader(fh, fi.Size())
+				pr.Offset, pr.Start = offset, offset
+				return &Scanner{pr: pr}
+			}
+		}
+	}
+	return &Scanner{pr: newPacketReader(r, -1)}
+}
+
+// Scan advances to the next packet, returns false at the end of the input, or on error.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	for {
+		p, err := s.pr.next()
+		if err == nil {
+			s.packet = p
+			return true
+		}
+		s.packet = nil
+		if errors.Cause(err) == ErrTruncated {
+			if s.truncated == nil {
+				s.truncated = err
+			}
+			continue
+		}
+		s.err = err
+		return false
+	}
+}
+
+// Packet returns the current packet.
+func (s *Scanner) Packet() Packet { return s.packet }
+
+// Header returns the current packet's header.
+func (s *Scanner) Header() Header {
+	if s.packet == nil {
+		return Header{}
+	}
+	return s.packet.packetHeader()
+}
+
+// Offset returns the byte offset of the current packet in the input.
+func (s *Scanner) Offset() int64 { return s.pr.Start }
+
+// Skipped returns the number of garbage bytes skipped so far.
+func (s *Scanner) Skipped() int64 { return s.pr.Skipped }
+
+// Err returns the first error (but not io.EOF), or the first truncated packet's error.
+func (s *Scanner) Err() error {
+	if s.err != nil && s.err != io.EOF {
+		return s.err
+	}
+	return s.truncated
+}
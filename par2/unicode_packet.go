@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// UnicodeFileNamePacket holds the Unicode name of a file,
+// for names which cannot be expressed in the ASCII name of the FileDescPacket.
+type UnicodeFileNamePacket struct {
+	Header
+	FileID   MD5
+	FileName string
+}
+
+func (u UnicodeFileNamePacket) String() string {
+	return fmt.Sprintf("[%s] %q", u.FileID, u.FileName)
+}
+
+func (u *UnicodeFileNamePacket) packetHeader() Header {
+	return u.Header
+}
+
+func (u *UnicodeFileNamePacket) readBody(body []byte) error {
+	if len(body) < 16 {
+		return errors.Wrapf(errBadBody, "unicode file name packet of %d bytes", len(body))
+	}
+	copy(u.FileID[:], body)
+	u.FileName = decodeUTF16(body[16:])
+	return nil
+}
+
+func (u *UnicodeFileNamePacket) writeBody(dest []byte) []byte {
+	b := append(dest[:0], u.FileID[:]...)
+	return appendUTF16(b, u.FileName)
+}
+
+// ASCIICommentPacket holds a comment.
+type ASCIICommentPacket struct {
+	Header
+	Comment string
+}
+
+func (c ASCIICommentPacket) String() string {
+	return fmt.Sprintf("Comment:%q", c.Comment)
+}
+
+func (c *ASCIICommentPacket) packetHeader() Header {
+	return c.Header
+}
+
+func (c *ASCIICommentPacket) readBody(body []byte) error {
+	c.Comment = string(bytes.TrimRight(body, "\000"))
+	return nil
+}
+
+func (c *ASCIICommentPacket) writeBody(dest []byte) []byte {
+	b := append(dest[:0], c.Comment...)
+	if n := len(b) % 4; n != 0 {
+		b = append(b, []byte{0, 0, 0}[:4-n]...)
+	}
+	return b
+}
+
+// UnicodeCommentPacket holds a Unicode comment,
+// which may be the Unicode version of an ASCIICommentPacket.
+type UnicodeCommentPacket struct {
+	Header
+	// ASCIIPacketMD5 is the PacketMD5 of the corresponding ASCIICommentPacket, zero if there is none.
+	ASCIIPacketMD5 MD5
+	Comment        string
+}
+
+func (c UnicodeCommentPacket) String() string {
+	return fmt.Sprintf("Comment:%q", c.Comment)
+}
+
+func (c *UnicodeCommentPacket) packetHeader() Header {
+	return c.Header
+}
+
+func (c *UnicodeCommentPacket) readBody(body []byte) error {
+	if len(body) < 16 {
+		return errors.Wrapf(errBadBody, "unicode comment packet of %d bytes", len(body))
+	}
+	copy(c.ASCIIPacketMD5[:], body)
+	c.Comment = decodeUTF16(body[16:])
+	return nil
+}
+
+func (c *UnicodeCommentPacket) writeBody(dest []byte) []byte {
+	b := append(dest[:0], c.ASCIIPacketMD5[:]...)
+	return appendUTF16(b, c.Comment)
+}
+
+// NewCommentPackets returns the packets for the comment:
+// an ASCIICommentPacket, and an UnicodeCommentPacket if the comment is not pure ASCII.
+func NewCommentPackets(recoverySetID MD5, comment string) []Packet {
+	ascii, isASCII := toASCII(comment)
+	ac := CreatePacket(TypeASCIICommentPacket).(*ASCIICommentPacket)
+	ac.RecoverySetID, ac.Comment = recoverySetID, ascii
+	if isASCII {
+		return []Packet{ac}
+	}
+	b := bytesPool.Get()
+	ac.recalc(ac.writeBody(b))
+	bytesPool.Put(b)
+	uc := CreatePacket(TypeUnicodeCommentPacket).(*UnicodeCommentPacket)
+	uc.RecoverySetID, uc.ASCIIPacketMD5, uc.Comment = recoverySetID, ac.PacketMD5, comment
+	return []Packet{ac, uc}
+}
+
+// toASCII returns s with the non-ASCII characters replaced by '?',
+// and whether s was pure ASCII.
+func toASCII(s string) (string, bool) {
+	isASCII := true
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r >= 0x80 {
+			r, isASCII = '?', false
+		}
+		b = append(b, byte(r))
+	}
+	return string(b), isASCII
+}
+
+// decodeUTF16 decodes the little-endian UTF-16 b, without the trailing zeros.
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	for len(u) > 0 && u[len(u)-1] == 0 {
+		u = u[:len(u)-1]
+	}
+	return string(utf16.Decode(u))
+}
+
+// appendUTF16 appends s as little-endian UTF-16 to b, padded to a multiple of 4 bytes.
+func appendUTF16(b []byte, s string) []byte {
+	var a [2]byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		binary.LittleEndian.PutUint16(a[:], u)
+		b = append(b, a[:]...)
+	}
+	if len(b)%4 != 0 {
+		b = append(b, 0, 0)
+	}
+	return b
+}
@@ -32,8 +32,9 @@ func (u *UnknownPacket) packetHeader() Header {
 	return u.Header
 }
 
-func (u *UnknownPacket) readBody(body []byte) {
-	u.Body = body
+func (u *UnknownPacket) readBody(body []byte) error {
+	u.Body = append([]byte(nil), body...)
+	return nil
 }
 
 func (u *UnknownPacket) writeBody(dest []byte) []byte {
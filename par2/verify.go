@@ -0,0 +1,274 @@
+// Copyright (c) 2016 Tamás Gulácsi
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package par2
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyStatus is the overall result of Verify.
+type VerifyStatus uint8
+
+const (
+	// RepairNotNeeded means all the blocks are good.
+	RepairNotNeeded = VerifyStatus(iota)
+	// RepairRequired means some blocks are missing, but there are enough recovery blocks.
+	RepairRequired
+	// RepairImpossible means more blocks are missing than the available recovery blocks.
+	RepairImpossible
+)
+
+func (s VerifyStatus) String() string {
+	switch s {
+	case RepairNotNeeded:
+		return "Repair not needed."
+	case RepairRequired:
+		return "Repair is required."
+	case RepairImpossible:
+		return "Repair not possible."
+	}
+	return fmt.Sprintf("VerifyStatus(%d)", uint8(s))
+}
+
+// FileReport is the verification result of one file.
+type FileReport struct {
+	Name   string
+	Exists bool
+	// Err is the error of opening the file.
+	Err error `json:",omitempty"`
+	// GoodBlocks and BadBlocks are the indices of the good and the bad (or missing) blocks of the file.
+	GoodBlocks, BadBlocks []int
+	// Misnamed is the name of the file under which the (missing or damaged) file is found.
+	Misnamed string `json:",omitempty"`
+	// Displaced are the good blocks found at another offset or in another file
+	// (they are in GoodBlocks, too).
+	Displaced map[int]BlockLocation `json:",omitempty"`
+	// NonRecovery is true for the non-recovery set files, which are verified, but cannot be repaired.
+	NonRecovery bool `json:",omitempty"`
+}
+
+// BlockCount returns the number of blocks of the file.
+func (f FileReport) BlockCount() int { return len(f.GoodBlocks) + len(f.BadBlocks) }
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Files []FileReport
+	// MissingBlocks is the number of missing (or bad) input blocks,
+	// AvailableRecovery the number of recovery blocks,
+	// NeededRecovery the number of recovery blocks needed in addition to the available ones.
+	MissingBlocks, AvailableRecovery, NeededRecovery int
+	// Unprotected is the number of damaged or missing non-recovery set files:
+	// Status is about the recovery set files only.
+	Unprotected int
+	Status      VerifyStatus
+}
+
+// Verify checks the blocks of the files in info.BaseDir against their checksums.
+//
+// The missing or damaged files are searched among the candidates (see FindMisnamed),
+// then the still missing blocks at any offset of the damaged files and the candidates,
+// with a rolling CRC32 (as par2cmdline does), so shifted or joined files are recognized, too.
+func Verify(info *ParInfo, candidates ...string) *VerifyReport {
+	rep := VerifyReport{
+		Files:             make([]FileReport, 0, len(info.Files)),
+		AvailableRecovery: len(info.RecoveryData),
+	}
+	var blockSize int
+	if info.Main != nil {
+		blockSize = int(info.Main.BlockSize)
+	}
+	misnamed, err := info.FindMisnamed(candidates)
+	if err != nil {
+		log.Printf("search misnamed files: %v", err)
+	}
+	var rewrite bool
+	var scan []string
+	used := make(map[string]bool, len(misnamed))
+	for _, file := range info.Files {
+		if !file.IsLocal() {
+			rep.Files = append(rep.Files, FileReport{
+				Name: file.Name(), NonRecovery: info.IsNonRecovery(file),
+				Err: errors.Errorf("%q is not under %q", file.Name(), info.BaseDir),
+			})
+			continue
+		}
+		fn := file.Path(info.BaseDir)
+		var fr FileReport
+		if file.IsDir() {
+			fr = verifyDir(fn)
+		} else {
+			fr = verifyFile(fn, file, blockSize)
+		}
+		if found := misnamed[file.Name()]; found != "" && len(fr.BadBlocks) != 0 {
+			fr = verifyFile(found, file, blockSize)
+			fr.Misnamed, rewrite, fn = found, true, found
+			used[found] = true
+		}
+		fr.Name, fr.NonRecovery = file.Name(), info.IsNonRecovery(file)
+		if fr.Exists && fr.Err == nil && len(fr.BadBlocks) != 0 {
+			scan = append(scan, fn)
+		}
+		rep.Files = append(rep.Files, fr)
+	}
+	for _, fn := range candidates {
+		if !used[fn] {
+			scan = append(scan, fn)
+		}
+	}
+	if blockSize > 0 {
+		scanDisplaced(info.Files, blockSize, rep.Files, scan)
+	}
+	totalGood := 0
+	for i, fr := range rep.Files {
+		switch {
+		case info.Files[i].IsDir():
+			rewrite = rewrite || !fr.Exists
+		case fr.NonRecovery:
+			if !fr.Exists || fr.Err != nil || len(fr.BadBlocks) != 0 {
+				rep.Unprotected++
+			}
+		default:
+			totalGood += len(fr.GoodBlocks)
+			rewrite = rewrite || len(fr.Displaced) != 0 || !fr.Exists
+		}
+	}
+	rep.MissingBlocks = int(info.BlockCount) - totalGood
+	switch {
+	case rep.MissingBlocks == 0 && rewrite:
+		rep.Status = RepairRequired
+	case rep.MissingBlocks == 0:
+		rep.Status = RepairNotNeeded
+	case rep.MissingBlocks > rep.AvailableRecovery:
+		rep.Status = RepairImpossible
+		rep.NeededRecovery = rep.MissingBlocks - rep.AvailableRecovery
+	default:
+		rep.Status = RepairRequired
+	}
+	return &rep
+}
+
+// verifyDir checks the existence of the directory entry.
+func verifyDir(fname string) FileReport {
+	var fr FileReport
+	fi, err := os.Stat(fname)
+	if fr.Exists = !os.IsNotExist(err); err != nil && fr.Exists {
+		fr.Err = err
+	} else if err == nil && !fi.IsDir() {
+		fr.Err = errors.Errorf("%s: not a directory", fname)
+	}
+	return fr
+}
+
+// verifyFile checks the blocks of fname against the checksums of file.
+//
+// The last block is padded with zeros, as when the checksums were computed.
+// A short read makes the rest of the blocks bad.
+func verifyFile(fname string, file *File, blockSize int) FileReport {
+	var fr FileReport
+	n := len(file.Pairs)
+	f, err := os.Open(fname)
+	if err != nil {
+		fr.Exists = !os.IsNotExist(err)
+		if fr.Exists {
+			fr.Err = err
+		}
+		fr.BadBlocks = make([]int, n)
+		for i := range fr.BadBlocks {
+			fr.BadBlocks[i] = i
+		}
+		return fr
+	}
+	defer f.Close()
+	fr.Exists = true
+
+	var length int64 = -1
+	if file.FileDescPacket != nil {
+		length = int64(file.FileLength)
+	}
+	buf := make([]byte, blockSize)
+	var hshBuf MD5
+	hash := md5.New()
+	var readErr error
+	for i, pair := range file.Pairs {
+		good := false
+		if readErr == nil {
+			want := blockSize
+			if rest := length - int64(i)*int64(blockSize); length >= 0 && rest < int64(blockSize) {
+				if want = int(rest); want < 0 {
+					want = 0
+				}
+			}
+			var k int
+			k, readErr = io.ReadFull(f, buf[:want])
+			for j := k; j < len(buf); j++ {
+				buf[j] = 0
+			}
+			if readErr == nil {
+				hash.Reset()
+				hash.Write(buf)
+				hash.Sum(hshBuf[:0])
+				good = hshBuf == pair.MD5
+			}
+		}
+		if good {
+			fr.GoodBlocks = append(fr.GoodBlocks, i)
+		} else {
+			fr.BadBlocks = append(fr.BadBlocks, i)
+		}
+	}
+	return fr
+}
+
+// WriteTo writes the report as text.
+func (rep *VerifyReport) WriteTo(w io.Writer) (int64, error) {
+	ew := &errWriter{w: w}
+	for _, f := range rep.Files {
+		if f.NonRecovery {
+			f.Name += " (not protected)"
+		}
+		switch {
+		case f.Misnamed != "":
+			fmt.Fprintf(ew, "\t%s: found as %s\n", f.Name, f.Misnamed)
+		case !f.Exists:
+			fmt.Fprintf(ew, "\t%s: missing\n", f.Name)
+		case f.Err != nil:
+			fmt.Fprintf(ew, "\t%s: open: %v\n", f.Name, f.Err)
+		case len(f.Displaced) != 0:
+			fmt.Fprintf(ew, "\t%s: %d/%d blocks available (%d displaced)\n", f.Name, len(f.GoodBlocks), f.BlockCount(), len(f.Displaced))
+		default:
+			fmt.Fprintf(ew, "\t%s: %d/%d blocks available\n", f.Name, len(f.GoodBlocks), f.BlockCount())
+		}
+	}
+	if rep.Unprotected != 0 {
+		fmt.Fprintf(ew, "\t%d damaged or missing files are not protected by the recovery set\n", rep.Unprotected)
+	}
+	fmt.Fprintf(ew, "\t-------\n\t%d missing blocks, %d recovery blocks: %s\n",
+		rep.MissingBlocks, rep.AvailableRecovery, rep.Status)
+	return ew.N, ew.Err
+}
@@ -0,0 +1,233 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// The fingerprint hash of PAR3 is BLAKE3, truncated to 16 bytes.
+// This is a straightforward (not vectorized) implementation, following the reference one.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var blake3IV = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for r := 0; r < 7; r++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var p [16]uint32
+		for i, j := range blake3Permutation {
+			p[i] = m[j]
+		}
+		m = p
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func blake3Words(b []byte) [16]uint32 {
+	var block [64]byte
+	copy(block[:], b)
+	var w [16]uint32
+	for i := range w {
+		w[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return w
+}
+
+// blake3Output is the input of the last compression: of a chunk or a parent node.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o blake3Output) chainingValue() [8]uint32 {
+	s := blake3Compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	var cv [8]uint32
+	copy(cv[:], s[:8])
+	return cv
+}
+
+// rootBytes returns the first (at most 64) bytes of the output.
+func (o blake3Output) rootBytes(dst []byte) []byte {
+	s := blake3Compress(&o.cv, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	var b [64]byte
+	for i, w := range s {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	return append(dst, b[:]...)
+}
+
+func blake3Parent(left, right [8]uint32) blake3Output {
+	o := blake3Output{cv: blake3IV, blockLen: blake3BlockLen, flags: flagParent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+type blake3Chunk struct {
+	cv              [8]uint32
+	counter         uint64
+	block           [blake3BlockLen]byte
+	blockLen        int
+	blocksCompresed int
+}
+
+func (c *blake3Chunk) len() int { return blake3BlockLen*c.blocksCompresed + c.blockLen }
+
+func (c *blake3Chunk) startFlag() uint32 {
+	if c.blocksCompresed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *blake3Chunk) update(p []byte) {
+	for len(p) != 0 {
+		if c.blockLen == blake3BlockLen {
+			w := blake3Words(c.block[:])
+			s := blake3Compress(&c.cv, &w, c.counter, blake3BlockLen, c.startFlag())
+			copy(c.cv[:], s[:8])
+			c.blocksCompresed++
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3Chunk) output() blake3Output {
+	return blake3Output{
+		cv: c.cv, block: blake3Words(c.block[:c.blockLen]), counter: c.counter,
+		blockLen: uint32(c.blockLen), flags: c.startFlag() | flagChunkEnd,
+	}
+}
+
+// blake3Hash is the hash.Hash of the fingerprint: BLAKE3, truncated to FingerprintSize bytes.
+type blake3Hash struct {
+	chunk blake3Chunk
+	stack [][8]uint32
+}
+
+var _ = hash.Hash((*blake3Hash)(nil))
+
+func newFingerprintHash() *blake3Hash {
+	h := new(blake3Hash)
+	h.Reset()
+	return h
+}
+
+func (h *blake3Hash) Reset() {
+	h.chunk = blake3Chunk{cv: blake3IV}
+	h.stack = h.stack[:0]
+}
+func (h *blake3Hash) Size() int      { return FingerprintSize }
+func (h *blake3Hash) BlockSize() int { return blake3BlockLen }
+
+func (h *blake3Hash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		if h.chunk.len() == blake3ChunkLen {
+			cv := h.chunk.output().chainingValue()
+			total := h.chunk.counter + 1
+			// merge the completed subtrees
+			for total&1 == 0 {
+				cv = blake3Parent(h.stack[len(h.stack)-1], cv).chainingValue()
+				h.stack = h.stack[:len(h.stack)-1]
+				total >>= 1
+			}
+			h.stack = append(h.stack, cv)
+			h.chunk = blake3Chunk{cv: blake3IV, counter: h.chunk.counter + 1}
+		}
+		k := blake3ChunkLen - h.chunk.len()
+		if k > len(p) {
+			k = len(p)
+		}
+		h.chunk.update(p[:k])
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Sum appends the fingerprint to b, without changing the state.
+func (h *blake3Hash) Sum(b []byte) []byte {
+	a := h.sum32()
+	return append(b, a[:FingerprintSize]...)
+}
+
+// sum32 returns the full (32 bytes) BLAKE3 hash.
+func (h *blake3Hash) sum32() [32]byte {
+	o := h.chunk.output()
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		o = blake3Parent(h.stack[i], o.chainingValue())
+	}
+	var a [32]byte
+	copy(a[:], o.rootBytes(nil))
+	return a
+}
+
+// NewFingerprint returns the fingerprint of b.
+func NewFingerprint(b []byte) Fingerprint {
+	h := newFingerprintHash()
+	h.Write(b)
+	var f Fingerprint
+	h.Sum(f[:0])
+	return f
+}
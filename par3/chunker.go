@@ -0,0 +1,121 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"bufio"
+	"hash/crc64"
+	"io"
+	"math/bits"
+)
+
+// headLength is the length of the head of the files, whose CRC64 is in the file packet.
+const headLength = 16 << 10
+
+// gearTable is the table of the gear hash of the content-defined chunking.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x9E3779B97F4A7C15)
+	for i := range t {
+		// splitmix64
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunkedFile is the result of reading a file: its checksums and chunks
+// (without the block indexes and the tails).
+type chunkedFile struct {
+	Hash16k     uint64
+	Fingerprint Fingerprint
+	Chunks      []Chunk
+}
+
+// readChunks reads the file, splitting it into content-defined chunks of about avg bytes
+// (at least avg/4, at most 4*avg), where the gear hash has its low bits zero.
+// With avg <= 0, the file is one chunk.
+//
+// The same content gives the same chunks, wherever it is in the file, so
+// the chunks of the similar files can be deduplicated.
+func readChunks(r io.Reader, avg int) (chunkedFile, error) {
+	var cf chunkedFile
+	br := bufio.NewReaderSize(r, 1<<20)
+	fileHash, chunkHash := newFingerprintHash(), newFingerprintHash()
+	head := crc64.New(crc64Table)
+
+	var mask uint64
+	minLength, maxLength := int64(-1), int64(-1)
+	if avg > 0 {
+		mask = 1<<uint(bits.Len(uint(avg-1))) - 1
+		minLength, maxLength = int64(avg/4), int64(4*avg)
+	}
+	var gear uint64
+	var length, total int64
+	buf := make([]byte, 0, 64<<10)
+	flush := func() {
+		fileHash.Write(buf)
+		chunkHash.Write(buf)
+		if total < headLength {
+			n := int64(len(buf))
+			if total+n > headLength {
+				n = headLength - total
+			}
+			head.Write(buf[:n])
+		}
+		total += int64(len(buf))
+		buf = buf[:0]
+	}
+	cut := func() {
+		flush()
+		c := Chunk{Length: uint64(length)}
+		chunkHash.Sum(c.fingerprint[:0])
+		cf.Chunks = append(cf.Chunks, c)
+		chunkHash.Reset()
+		length, gear = 0, 0
+	}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err != io.EOF {
+				return cf, err
+			}
+			break
+		}
+		buf = append(buf, c)
+		length++
+		if avg > 0 {
+			gear = gear<<1 + gearTable[c]
+			if length >= minLength && (gear&mask == 0 || length >= maxLength) {
+				cut()
+				continue
+			}
+		}
+		if len(buf) == cap(buf) {
+			flush()
+		}
+	}
+	if length != 0 {
+		cut()
+	}
+	flush()
+	cf.Hash16k = head.Sum64()
+	fileHash.Sum(cf.Fingerprint[:0])
+	return cf, nil
+}
@@ -0,0 +1,457 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBlockCount is the number of input blocks Create aims for, if no block size is given.
+const DefaultBlockCount = 2000
+
+// DefaultCreator is the creator written by Create, if none is given.
+const DefaultCreator = "github.com/tgulacsi/par"
+
+// externalPerPacket is the number of block checksums in an external data packet.
+const externalPerPacket = 1024
+
+// CreateOptions are the options of Create.
+type CreateOptions struct {
+	// Output is the name of the index file, the vol files are named after it.
+	Output string
+	// Files to protect: the directories are walked (the empty ones are kept, too).
+	Files []string
+	// BaseDir is the root of the tree (the directory of Output if empty): the files must be under it.
+	BaseDir string
+	// BlockSize is the size of the input blocks, rounded up to a multiple of 4.
+	// If zero, it is computed to have about BlockCount (DefaultBlockCount if zero) input blocks.
+	BlockSize, BlockCount int
+	// Redundancy is the number of recovery blocks, in the percent of the input blocks.
+	Redundancy int
+	// ChunkSize is the average size of the content-defined chunks;
+	// zero means each file is one chunk. The identical chunks are stored once.
+	ChunkSize int
+	// Creator is stored in the creator packet (DefaultCreator if empty),
+	// Comment in a comment packet (if not empty).
+	Creator, Comment string
+}
+
+// Create the input set of the files: the index file (without recovery packets),
+// and the vol files with the recovery packets and the critical packets repeated.
+//
+// Returns the names of the written files.
+func Create(opts CreateOptions) ([]string, error) {
+	if len(opts.Files) == 0 {
+		return nil, errors.New("no files given")
+	}
+	if opts.Output == "" {
+		opts.Output = opts.Files[0] + ".par3"
+	}
+	if opts.BaseDir == "" {
+		opts.BaseDir = filepath.Dir(opts.Output)
+	}
+	paths, names, dirs, err := walkTree(opts.BaseDir, opts.Files)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BlockSize == 0 {
+		if opts.BlockSize, err = blockSizeFor(paths, opts.BlockCount); err != nil {
+			return nil, err
+		}
+	}
+	if n := opts.BlockSize % 4; n != 0 {
+		opts.BlockSize += 4 - n
+	}
+
+	// read the files, and place their chunks into the blocks
+	files := make([]*FilePacket, len(paths))
+	var a allocator
+	a.blockSize = uint64(opts.BlockSize)
+	for i, fn := range paths {
+		fh, err := os.Open(fn)
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		cf, err := readChunks(fh, opts.ChunkSize)
+		if err == nil {
+			err = readTails(fh, cf.Chunks, a.blockSize)
+		}
+		fh.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		for k := range cf.Chunks {
+			a.place(&cf.Chunks[k])
+		}
+		files[i] = &FilePacket{Name: path.Base(names[i]), Hash16k: cf.Hash16k, Fingerprint: cf.Fingerprint, Chunks: cf.Chunks}
+	}
+	n := int(a.next)
+	recovery := (n*opts.Redundancy + 99) / 100
+	field, err := fieldFor(n + recovery)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := layout(files, opts.BlockSize, n)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]int, recovery)
+	for j := range indexes {
+		indexes[j] = j
+	}
+	enc, err := NewEncoder(field, opts.BlockSize, n, indexes)
+	if err != nil {
+		return nil, err
+	}
+	br := newBlockReader(paths, blocks, opts.BlockSize)
+	defer br.Close()
+	checksums := make([]BlockChecksum, n)
+	block := make([]byte, opts.BlockSize)
+	for b := range checksums {
+		if !br.read(b, block) {
+			return nil, errors.Errorf("cannot read the %d. block (changed file?)", b)
+		}
+		checksums[b] = newBlockChecksum(block)
+		enc.Add(b, block)
+	}
+	br.Close()
+
+	sb := newSetBuilder(opts.BlockSize, field)
+	matrix := &CauchyPacket{First: 0, Last: uint64(n), Hint: uint64(recovery)}
+	sb.add(matrix)
+	sb.addChecksums(checksums)
+	var t tree
+	for i, name := range names {
+		t.add(name, files[i])
+	}
+	for _, d := range dirs {
+		t.add(d, nil)
+	}
+	root := &RootPacket{BlockCount: uint64(n), Children: t.seal(sb)}
+	sb.add(root)
+	extra := sb.extra(opts.Creator, opts.Comment)
+
+	recov := make([]Packet, recovery)
+	for j, data := range enc.Recovery() {
+		r := CreatePacket(TypeRecovery, sb.id).(*RecoveryPacket)
+		r.Root, r.Matrix = root.Fingerprint, matrix.Fingerprint
+		r.Index, r.RecoveryData = uint64(j), data
+		recov[j] = r
+	}
+
+	written := make([]string, 0, 8)
+	if err := writePacketFile(opts.Output, sb.packets, extra); err != nil {
+		return written, err
+	}
+	written = append(written, opts.Output)
+	base := strings.TrimSuffix(opts.Output, ".par3")
+	lowDigits, countDigits := len(fmt.Sprint(recovery)), len(fmt.Sprint(recovery))
+	for start, count := 0, 1; start < recovery; start, count = start+count, 2*count {
+		if start+count > recovery {
+			count = recovery - start
+		}
+		fn := fmt.Sprintf("%s.vol%0*d+%0*d.par3", base, lowDigits, start, countDigits, count)
+		if err := writePacketFile(fn, sb.packets, recov[start:start+count], sb.packets); err != nil {
+			return written, err
+		}
+		written = append(written, fn)
+	}
+	return written, nil
+}
+
+// readTails sets the tails of the chunks of the file.
+func readTails(r io.ReaderAt, chunks []Chunk, blockSize uint64) error {
+	var offset int64
+	for i := range chunks {
+		c := &chunks[i]
+		offset += int64(c.Length)
+		tail := make([]byte, c.Length%blockSize)
+		if len(tail) == 0 {
+			continue
+		}
+		if _, err := r.ReadAt(tail, offset-int64(len(tail))); err != nil {
+			return err
+		}
+		c.setTail(tail)
+	}
+	return nil
+}
+
+// allocator places the chunks into the input blocks: the full blocks are allocated in order,
+// the tails are packed together (the short ones are in the chunk descriptions).
+// The identical chunks are placed once.
+type allocator struct {
+	blockSize uint64
+	next      uint64
+	// tailBlock is the block of the tails, tailFill is the used part of it
+	tailBlock, tailFill uint64
+	placed              map[chunkKey]Chunk
+}
+
+// chunkKey identifies the content of a chunk.
+type chunkKey struct {
+	length      uint64
+	fingerprint Fingerprint
+}
+
+func (a *allocator) place(c *Chunk) {
+	key := chunkKey{length: c.Length, fingerprint: c.fingerprint}
+	if p, ok := a.placed[key]; ok {
+		*c = p
+		return
+	}
+	if full := c.Length / a.blockSize; full != 0 {
+		c.Block = a.next
+		a.next += full
+	}
+	if tail := c.Length % a.blockSize; tail >= minTailLength {
+		if a.tailFill == 0 || a.tailFill+tail > a.blockSize {
+			a.tailBlock, a.tailFill = a.next, 0
+			a.next++
+		}
+		c.TailBlock, c.TailOffset = a.tailBlock, a.tailFill
+		a.tailFill += tail
+	}
+	if a.placed == nil {
+		a.placed = make(map[chunkKey]Chunk)
+	}
+	a.placed[key] = *c
+}
+
+// fieldFor returns the Galois field for n input and recovery blocks: GF(2^8) if they fit, GF(2^16) otherwise.
+func fieldFor(n int) (*Field, error) {
+	if n <= 255 {
+		return NewField(1, Generator8)
+	}
+	if n > 65535 {
+		return nil, errors.Errorf("%d input and recovery blocks, the maximum is 65535: use a bigger block size", n)
+	}
+	return NewField(2, Generator16)
+}
+
+// setBuilder collects the critical packets of an input set.
+type setBuilder struct {
+	id        InputSetID
+	blockSize uint64
+	packets   []Packet
+}
+
+func newSetBuilder(blockSize int, field *Field) *setBuilder {
+	start := &StartPacket{BlockSize: uint64(blockSize), FieldSize: uint8(field.Size), Generator: field.Generator}
+	id := start.ID()
+	start.Type, start.InputSetID = TypeStart, id
+	encodePacket(start)
+	return &setBuilder{id: id, blockSize: uint64(blockSize), packets: []Packet{start}}
+}
+
+// add the packet, computing its fingerprint.
+func (sb *setBuilder) add(p Packet) {
+	h := p.header()
+	h.Type, h.InputSetID = typeOf(p), sb.id
+	if f, ok := p.(*FilePacket); ok {
+		f.blockSize = sb.blockSize
+	}
+	encodePacket(p)
+	sb.packets = append(sb.packets, p)
+}
+
+// addChecksums adds the external data packets of the block checksums.
+func (sb *setBuilder) addChecksums(checksums []BlockChecksum) {
+	for first := 0; first < len(checksums); first += externalPerPacket {
+		last := first + externalPerPacket
+		if last > len(checksums) {
+			last = len(checksums)
+		}
+		sb.add(&ExternalPacket{First: uint64(first), Checksums: checksums[first:last]})
+	}
+}
+
+// extra returns the creator and comment packets.
+func (sb *setBuilder) extra(creator, comment string) []Packet {
+	if creator == "" {
+		creator = DefaultCreator
+	}
+	cr := CreatePacket(TypeCreator, sb.id).(*CreatorPacket)
+	cr.Creator = creator
+	extra := []Packet{cr}
+	if comment != "" {
+		c := CreatePacket(TypeComment, sb.id).(*CommentPacket)
+		c.Comment = comment
+		extra = append(extra, c)
+	}
+	return extra
+}
+
+func typeOf(p Packet) PacketType {
+	switch p.(type) {
+	case *CauchyPacket:
+		return TypeCauchy
+	case *ExternalPacket:
+		return TypeExternal
+	case *FilePacket:
+		return TypeFile
+	case *DirectoryPacket:
+		return TypeDirectory
+	case *RootPacket:
+		return TypeRoot
+	}
+	return p.header().Type
+}
+
+// tree is a directory of the input set.
+type tree struct {
+	files map[string]*FilePacket
+	dirs  map[string]*tree
+}
+
+// add the file (or directory, if f is nil) with the "/" separated name.
+func (t *tree) add(name string, f *FilePacket) {
+	dir, rest := name, ""
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		dir, rest = name[:i], name[i+1:]
+	}
+	if rest == "" && f != nil {
+		if t.files == nil {
+			t.files = make(map[string]*FilePacket)
+		}
+		t.files[dir] = f
+		return
+	}
+	if t.dirs == nil {
+		t.dirs = make(map[string]*tree)
+	}
+	sub := t.dirs[dir]
+	if sub == nil {
+		sub = new(tree)
+		t.dirs[dir] = sub
+	}
+	if rest != "" {
+		sub.add(rest, f)
+	}
+}
+
+// seal adds the packets of the files and directories (depth first), returning their fingerprints.
+func (t *tree) seal(sb *setBuilder) []Fingerprint {
+	names := make([]string, 0, len(t.files)+len(t.dirs))
+	for name := range t.files {
+		names = append(names, name)
+	}
+	for name := range t.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	children := make([]Fingerprint, 0, len(names))
+	for _, name := range names {
+		if f := t.files[name]; f != nil {
+			sb.add(f)
+			children = append(children, f.Header.Fingerprint)
+			continue
+		}
+		d := &DirectoryPacket{Name: name, Children: t.dirs[name].seal(sb)}
+		sb.add(d)
+		children = append(children, d.Header.Fingerprint)
+	}
+	return children
+}
+
+// walkTree returns the files (walking the directories), their names relative to baseDir
+// (with "/" separators), and the relative names of the directories.
+func walkTree(baseDir string, names []string) (paths, rels, dirs []string, err error) {
+	seen := make(map[string]bool)
+	addFile := func(fn string, isDir bool) error {
+		rel, err := filepath.Rel(baseDir, fn)
+		if err != nil || !filepath.IsLocal(rel) {
+			return errors.Errorf("%q is not under %q", fn, baseDir)
+		}
+		rel = filepath.ToSlash(rel)
+		if seen[rel] {
+			return nil
+		}
+		seen[rel] = true
+		if isDir {
+			dirs = append(dirs, rel)
+		} else {
+			paths, rels = append(paths, fn), append(rels, rel)
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := filepath.Walk(name, func(fn string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				if fn == baseDir {
+					return nil
+				}
+				return addFile(fn, true)
+			}
+			if fi.Mode().IsRegular() {
+				return addFile(fn, false)
+			}
+			return nil
+		}); err != nil {
+			return paths, rels, dirs, errors.Wrap(err, name)
+		}
+	}
+	return paths, rels, dirs, nil
+}
+
+// blockSizeFor returns the block size for about count blocks of the files.
+func blockSizeFor(files []string, count int) (int, error) {
+	if count <= 0 {
+		count = DefaultBlockCount
+	}
+	var total int64
+	for _, fn := range files {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return 0, errors.Wrap(err, fn)
+		}
+		total += fi.Size()
+	}
+	size := (total + int64(count) - 1) / int64(count)
+	if size < 4 {
+		size = 4
+	}
+	return int(size), nil
+}
+
+// writePacketFile writes the packets to the file.
+func writePacketFile(fn string, packets ...[]Packet) error {
+	fh, err := os.Create(fn)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	for _, pkts := range packets {
+		for _, p := range pkts {
+			if _, err := WritePacket(fh, p); err != nil {
+				return errors.Wrap(err, fn)
+			}
+		}
+	}
+	return errors.Wrap(fh.Close(), fn)
+}
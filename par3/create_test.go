@@ -0,0 +1,255 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var first, second bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&first, "the %d. line of the first file\n", i)
+	}
+	second.Write(first.Bytes()[:30000])
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&second, "the %d. line of the second file\n", i)
+	}
+	contents := map[string][]byte{
+		"a.txt":       first.Bytes(),
+		"sub/b.txt":   second.Bytes(),
+		"sub/copy":    first.Bytes(),
+		"sub/empty":   nil,
+		"sub/x/short": []byte("short"),
+	}
+	for name, b := range contents {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "emptydir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := Create(CreateOptions{
+		Output:  filepath.Join(dir, "set.par3"),
+		Files:   []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub"), filepath.Join(dir, "emptydir")},
+		BaseDir: dir, BlockSize: 1000, Redundancy: 20, ChunkSize: 4096, Comment: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(written)
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Files) != len(contents) || len(info.Dirs) != 3 || info.Creator == nil || len(info.Comments) != 1 {
+		t.Fatalf("got files %v, dirs %q, creator %v, comments %v", info.Files, info.Dirs, info.Creator, info.Comments)
+	}
+	// the copy and the common part of b.txt are stored once
+	var total int
+	for _, b := range contents {
+		total += len(b)
+	}
+	if max := (total - len(first.Bytes())) / 1000; info.BlockCount() > max {
+		t.Errorf("got %d blocks, wanted at most %d", info.BlockCount(), max)
+	}
+	if rep := Verify(info); rep.Status != RepairNotNeeded {
+		t.Fatalf("got %#v", rep)
+	}
+
+	// damage
+	fn := filepath.Join(dir, "sub", "b.txt")
+	b := append([]byte(nil), second.Bytes()...)
+	copy(b[35000:], "DAMAGE")
+	if err := ioutil.WriteFile(fn, b[:len(b)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(fn, 0640); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "sub/x/short", "emptydir"} {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the deleted a.txt still has its copy
+	if err := os.Remove(filepath.Join(dir, "sub", "x")); err != nil {
+		t.Fatal(err)
+	}
+	rep := Verify(info)
+	var buf bytes.Buffer
+	rep.WriteTo(&buf)
+	t.Log(buf.String())
+	if rep.Status != RepairRequired || rep.MissingBlocks == 0 || len(rep.MissingDirs) != 2 {
+		t.Fatalf("got %#v", rep)
+	}
+
+	names, err := Repair(info, RepairOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(names)
+	for name, want := range contents {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: differs", name)
+		}
+	}
+	if _, err := os.Stat(fn + ".1"); err != nil {
+		t.Errorf("no backup: %v", err)
+	}
+	if fi, err := os.Stat(fn); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0640 {
+		t.Errorf("%s: got mode %v, wanted %v", fn, fi.Mode(), os.FileMode(0640))
+	}
+	if rep := Verify(info); rep.Status != RepairNotNeeded {
+		t.Errorf("after repair: got %#v", rep)
+	}
+}
+
+func TestRepairFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []string
+	damaged := make(map[string][]byte)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		var buf bytes.Buffer
+		for i := 0; i < 500; i++ {
+			fmt.Fprintf(&buf, "the %d. line of %s\n", i, name)
+		}
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+		damaged[fn] = buf.Bytes()
+	}
+	written, err := Create(CreateOptions{Output: filepath.Join(dir, "set.par3"), Files: files, BaseDir: dir, BlockSize: 1000, Redundancy: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range files {
+		damaged[fn][600]++
+		if err := ioutil.WriteFile(fn, damaged[fn], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the repaired b.txt won't match its fingerprint
+	for _, f := range info.Files {
+		if f.Path == "b.txt" {
+			f.Fingerprint[0]++
+		}
+	}
+	if names, err := Repair(info, RepairOptions{NoBackup: true}); err == nil {
+		t.Fatalf("repair succeeded: %q", names)
+	} else {
+		t.Log(err)
+	}
+	for _, fn := range files {
+		if got, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(got, damaged[fn]) {
+			t.Errorf("%s: changed by the failed repair (%v)", fn, err)
+		}
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if name := fi.Name(); name != "a.txt" && name != "b.txt" && filepath.Ext(name) != ".par3" {
+			t.Errorf("%s is left behind", name)
+		}
+	}
+}
+
+func TestWriterRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var data bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&data, "the %d. line\n", i)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "data.txt", int64(data.Len()), 510, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Comment = "stream"
+	if _, err := w.Write(data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	parFn := filepath.Join(dir, "data.txt.par3")
+	if err := ioutil.WriteFile(parFn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(parFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BlockSize() != 512 || len(info.Files) != 1 || len(info.Recovery) != 3 {
+		t.Fatalf("got block size %d, files %v, %d recovery", info.BlockSize(), info.Files, len(info.Recovery))
+	}
+
+	for _, damage := range []int{0, 1, 3} {
+		b := append([]byte(nil), data.Bytes()...)
+		for k := 0; k < damage; k++ {
+			b[k*1000+7] ^= 0xff
+		}
+		var got bytes.Buffer
+		if err := info.Restore(&got, "data.txt", bytes.NewReader(b)); err != nil {
+			t.Fatalf("%d damaged blocks: %+v", damage, err)
+		}
+		if !bytes.Equal(got.Bytes(), data.Bytes()) {
+			t.Errorf("%d damaged blocks: differs", damage)
+		}
+	}
+	if err := info.Restore(ioutil.Discard, "data.txt", nil); err == nil {
+		t.Error("wanted error for the missing file")
+	}
+}
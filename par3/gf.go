@@ -0,0 +1,239 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// The generators of the supported Galois fields.
+const (
+	Generator8  = 0x11D
+	Generator16 = 0x1100B
+)
+
+// Field is a GF(2^8) or GF(2^16) Galois field, with log/exp tables.
+type Field struct {
+	// Size is the size of the elements in bytes.
+	Size      int
+	Generator uint64
+	order     int // 2^bits - 1
+	log, exp  []uint16
+}
+
+// NewField returns the Galois field of size-byte elements with the generator polynomial.
+func NewField(size int, generator uint64) (*Field, error) {
+	if size != 1 && size != 2 {
+		return nil, errors.Errorf("field size %d not supported (only 1 and 2)", size)
+	}
+	bits := 8 * uint(size)
+	if generator>>bits != 1 {
+		return nil, errors.Errorf("generator %#x is not of degree %d", generator, bits)
+	}
+	f := Field{Size: size, Generator: generator, order: 1<<bits - 1}
+	f.log = make([]uint16, f.order+1)
+	f.exp = make([]uint16, 2*f.order)
+	x := uint64(1)
+	for i := 0; i < f.order; i++ {
+		if x == 0 || i != 0 && x == 1 {
+			return nil, errors.Errorf("generator %#x is not primitive", generator)
+		}
+		f.exp[i], f.exp[i+f.order] = uint16(x), uint16(x)
+		f.log[x] = uint16(i)
+		if x <<= 1; x>>bits != 0 {
+			x ^= generator
+		}
+	}
+	return &f, nil
+}
+
+// Elements returns the number of elements of the field.
+func (f *Field) Elements() int { return f.order + 1 }
+
+func (f *Field) mul(a, b uint16) uint16 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return f.exp[int(f.log[a])+int(f.log[b])]
+}
+
+func (f *Field) inv(a uint16) uint16 {
+	if a == 0 {
+		panic("inverse of zero")
+	}
+	return f.exp[(f.order-int(f.log[a]))%f.order]
+}
+
+// mulAdd adds c*src to dst (element-wise, the elements are little-endian).
+func (f *Field) mulAdd(dst, src []byte, c uint16) {
+	if c == 0 {
+		return
+	}
+	lc := int(f.log[c])
+	if f.Size == 1 {
+		for i, a := range src {
+			if a != 0 {
+				dst[i] ^= byte(f.exp[int(f.log[a])+lc])
+			}
+		}
+		return
+	}
+	for i := 0; i+1 < len(src); i += 2 {
+		if a := binary.LittleEndian.Uint16(src[i:]); a != 0 {
+			binary.LittleEndian.PutUint16(dst[i:], binary.LittleEndian.Uint16(dst[i:])^f.exp[int(f.log[a])+lc])
+		}
+	}
+}
+
+// cauchy returns the coefficient of the input block for the recovery block:
+// 1 / (x_input + y_recovery), with x_input = input and y_recovery = order - recovery,
+// so there must be no more than 2^bits input and recovery blocks altogether.
+func (f *Field) cauchy(input, recovery int) uint16 {
+	return f.inv(uint16(input) ^ uint16(f.order-recovery))
+}
+
+// Encoder computes the recovery blocks from the input blocks.
+type Encoder struct {
+	field     *Field
+	BlockSize int
+	indexes   []int
+	recovery  [][]byte
+}
+
+// NewEncoder returns an encoder of the recovery blocks with the given indexes,
+// for at most inputs input blocks.
+func NewEncoder(field *Field, blockSize, inputs int, indexes []int) (*Encoder, error) {
+	for _, j := range indexes {
+		if j < 0 || inputs+j > field.order {
+			return nil, errors.Errorf("%d input and %d. recovery block do not fit in GF(2^%d)", inputs, j, 8*field.Size)
+		}
+	}
+	enc := Encoder{field: field, BlockSize: blockSize, indexes: indexes, recovery: make([][]byte, len(indexes))}
+	for k := range enc.recovery {
+		enc.recovery[k] = make([]byte, blockSize)
+	}
+	return &enc, nil
+}
+
+// Add the i. input block (shorter blocks are padded with zeros).
+func (enc *Encoder) Add(i int, block []byte) {
+	for k, j := range enc.indexes {
+		enc.field.mulAdd(enc.recovery[k], block, enc.field.cauchy(i, j))
+	}
+}
+
+// Recovery returns the recovery blocks.
+func (enc *Encoder) Recovery() [][]byte { return enc.recovery }
+
+// ErrNotEnoughRecovery is returned when there are less recovery blocks than missing ones.
+var ErrNotEnoughRecovery = errors.New("not enough recovery blocks")
+
+// Decoder reconstructs the missing input blocks from the recovery blocks.
+//
+// The recovery blocks are loaded with NewDecoder, then all the good input blocks
+// are added (removing them from the recovery blocks), and Reconstruct solves for the missing ones.
+type Decoder struct {
+	field     *Field
+	BlockSize int
+	indexes   []int
+	sums      [][]byte
+}
+
+// NewDecoder loads the usable recovery blocks, at most need of them (all if need <= 0).
+func NewDecoder(field *Field, blockSize int, recovery []*RecoveryPacket, need int) *Decoder {
+	dec := Decoder{field: field, BlockSize: blockSize}
+	seen := make(map[uint64]bool, len(recovery))
+	for _, r := range recovery {
+		if need > 0 && len(dec.sums) == need {
+			break
+		}
+		if r.Damaged || r.Len() != blockSize || seen[r.Index] {
+			continue
+		}
+		data, err := r.Data()
+		if err != nil {
+			continue
+		}
+		seen[r.Index] = true
+		dec.indexes = append(dec.indexes, int(r.Index))
+		dec.sums = append(dec.sums, append(make([]byte, 0, blockSize), data...))
+	}
+	return &dec
+}
+
+// Available returns the number of usable recovery blocks.
+func (dec *Decoder) Available() int { return len(dec.sums) }
+
+// Add the i. good input block.
+func (dec *Decoder) Add(i int, block []byte) {
+	for k, j := range dec.indexes {
+		dec.field.mulAdd(dec.sums[k], block, dec.field.cauchy(i, j))
+	}
+}
+
+// Reconstruct returns the missing input blocks, after all the good ones are added.
+func (dec *Decoder) Reconstruct(missing []int) ([][]byte, error) {
+	m := len(missing)
+	if m > len(dec.sums) {
+		return nil, errors.Wrapf(ErrNotEnoughRecovery, "%d missing, %d available", m, len(dec.sums))
+	}
+	f := dec.field
+	// invert the m x m Cauchy matrix with Gauss-Jordan elimination
+	a := make([][]uint16, m)
+	inv := make([][]uint16, m)
+	for r := range a {
+		a[r], inv[r] = make([]uint16, m), make([]uint16, m)
+		inv[r][r] = 1
+		for c, i := range missing {
+			a[r][c] = f.cauchy(i, dec.indexes[r])
+		}
+	}
+	for c := 0; c < m; c++ {
+		p := c
+		for p < m && a[p][c] == 0 {
+			p++
+		}
+		if p == m {
+			return nil, errors.New("singular matrix")
+		}
+		a[c], a[p] = a[p], a[c]
+		inv[c], inv[p] = inv[p], inv[c]
+		if x := a[c][c]; x != 1 {
+			ix := f.inv(x)
+			for k := 0; k < m; k++ {
+				a[c][k], inv[c][k] = f.mul(a[c][k], ix), f.mul(inv[c][k], ix)
+			}
+		}
+		for r := 0; r < m; r++ {
+			if x := a[r][c]; r != c && x != 0 {
+				for k := 0; k < m; k++ {
+					a[r][k] ^= f.mul(x, a[c][k])
+					inv[r][k] ^= f.mul(x, inv[c][k])
+				}
+			}
+		}
+	}
+	blocks := make([][]byte, m)
+	for k := range blocks {
+		blocks[k] = make([]byte, dec.BlockSize)
+		for r := 0; r < m; r++ {
+			f.mulAdd(blocks[k], dec.sums[r], inv[k][r])
+		}
+	}
+	return blocks, nil
+}
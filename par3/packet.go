@@ -0,0 +1,698 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	magic        = "PAR3\000PKT"
+	headerLength = 48
+
+	// FingerprintSize is the length of the fingerprint hash (truncated BLAKE3).
+	FingerprintSize = 16
+)
+
+// errBadBody is returned for a malformed packet body.
+var errBadBody = errors.New("bad packet body")
+
+// Fingerprint is the (truncated BLAKE3) fingerprint hash of packets, files and blocks.
+type Fingerprint [FingerprintSize]byte
+
+func (f Fingerprint) String() string { return base64.URLEncoding.EncodeToString(f[:]) }
+func (f Fingerprint) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+func (f Fingerprint) IsZero() bool { return f == Fingerprint{} }
+
+// InputSetID identifies the packets of one input set.
+type InputSetID [8]byte
+
+func (id InputSetID) String() string { return base64.URLEncoding.EncodeToString(id[:]) }
+func (id InputSetID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// PacketType is the type of the packet, the types defined by the specification begin with "PAR ".
+type PacketType [8]byte
+
+func (t PacketType) String() string               { return string(t[:]) }
+func (t PacketType) MarshalText() ([]byte, error) { return t[:], nil }
+
+func packetType(s string) PacketType {
+	var t PacketType
+	copy(t[:], s)
+	return t
+}
+
+var (
+	TypeCreator   = packetType("PAR CRE\000")
+	TypeComment   = packetType("PAR COM\000")
+	TypeStart     = packetType("PAR STA\000")
+	TypeCauchy    = packetType("PAR CAU\000")
+	TypeData      = packetType("PAR DAT\000")
+	TypeRecovery  = packetType("PAR REC\000")
+	TypeExternal  = packetType("PAR EXT\000")
+	TypeFile      = packetType("PAR FIL\000")
+	TypeDirectory = packetType("PAR DIR\000")
+	TypeRoot      = packetType("PAR ROO\000")
+)
+
+// Header is the common header of the packets.
+type Header struct {
+	// Fingerprint of the packet, from the Length to the end of the body.
+	// The packets refer to each other by this.
+	Fingerprint Fingerprint
+	// Length of the entire packet, including the header.
+	Length     uint64
+	InputSetID InputSetID
+	Type       PacketType
+	Damaged    bool `json:",omitempty"`
+}
+
+func (h Header) String() string {
+	return fmt.Sprintf("%d:%s [%s] of [%s]", h.Length, h.Type, h.Fingerprint, h.InputSetID)
+}
+
+// Packet is a PAR3 packet.
+type Packet interface {
+	header() *Header
+	readBody([]byte) error
+	writeBody([]byte) []byte
+}
+
+func (h *Header) header() *Header { return h }
+
+// decode the header from b, reporting whether it starts with the magic sequence.
+func (h *Header) decode(b []byte) bool {
+	if string(b[:8]) != magic {
+		return false
+	}
+	copy(h.Fingerprint[:], b[8:24])
+	h.Length = binary.LittleEndian.Uint64(b[24:32])
+	copy(h.InputSetID[:], b[32:40])
+	copy(h.Type[:], b[40:48])
+	return true
+}
+
+// CreatePacket returns an empty packet of the type.
+func CreatePacket(typ PacketType, id InputSetID) Packet {
+	var p Packet
+	switch typ {
+	case TypeCreator:
+		p = new(CreatorPacket)
+	case TypeComment:
+		p = new(CommentPacket)
+	case TypeStart:
+		p = new(StartPacket)
+	case TypeCauchy:
+		p = new(CauchyPacket)
+	case TypeData:
+		p = new(DataPacket)
+	case TypeRecovery:
+		p = new(RecoveryPacket)
+	case TypeExternal:
+		p = new(ExternalPacket)
+	case TypeFile:
+		p = new(FilePacket)
+	case TypeDirectory:
+		p = new(DirectoryPacket)
+	case TypeRoot:
+		p = new(RootPacket)
+	default:
+		p = new(UnknownPacket)
+	}
+	h := p.header()
+	h.Type, h.InputSetID = typ, id
+	return p
+}
+
+// WritePacket writes the packet, computing its length and fingerprint.
+func WritePacket(w io.Writer, p Packet) (int64, error) {
+	if r, ok := p.(*RecoveryPacket); ok && r.RecoveryData == nil && r.File != "" {
+		data, err := r.Data()
+		if err != nil {
+			return 0, err
+		}
+		defer func() { r.RecoveryData = nil }()
+		r.RecoveryData = data
+	}
+	n, err := w.Write(encodePacket(p))
+	return int64(n), err
+}
+
+// encodePacket returns the packet's bytes, after setting its length and fingerprint.
+func encodePacket(p Packet) []byte {
+	h := p.header()
+	b := make([]byte, headerLength, 4096)
+	b = p.writeBody(b)
+	copy(b, magic)
+	h.Length = uint64(len(b))
+	binary.LittleEndian.PutUint64(b[24:], h.Length)
+	copy(b[32:], h.InputSetID[:])
+	copy(b[40:], h.Type[:])
+	h.Fingerprint = NewFingerprint(b[24:])
+	copy(b[8:], h.Fingerprint[:])
+	return b
+}
+
+// CreatorPacket names the client which created the set.
+type CreatorPacket struct {
+	Header
+	Creator string
+}
+
+func (c *CreatorPacket) readBody(body []byte) error { c.Creator = string(body); return nil }
+func (c *CreatorPacket) writeBody(b []byte) []byte  { return append(b, c.Creator...) }
+
+// CommentPacket holds a comment (UTF-8 text).
+type CommentPacket struct {
+	Header
+	Comment string
+}
+
+func (c *CommentPacket) readBody(body []byte) error { c.Comment = string(body); return nil }
+func (c *CommentPacket) writeBody(b []byte) []byte  { return append(b, c.Comment...) }
+
+// StartPacket starts the input set: it holds the block size and the Galois field.
+//
+// The InputSetID is the beginning of the fingerprint of its body.
+type StartPacket struct {
+	Header
+	// ParentID and ParentRoot identify the previous version of the input set (zero if none).
+	ParentID   InputSetID
+	ParentRoot Fingerprint
+	BlockSize  uint64
+	// FieldSize is the size of the Galois field's elements in bytes,
+	// Generator is the generator polynomial, with the leading 1 bit (0x1100B for GF(2^16)).
+	FieldSize uint8
+	Generator uint64
+}
+
+func (s *StartPacket) readBody(body []byte) error {
+	if len(body) < 8+16+8+1 {
+		return errors.Wrapf(errBadBody, "start packet of %d bytes", len(body))
+	}
+	copy(s.ParentID[:], body)
+	copy(s.ParentRoot[:], body[8:])
+	s.BlockSize = binary.LittleEndian.Uint64(body[24:])
+	s.FieldSize = body[32]
+	body = body[33:]
+	if s.FieldSize == 0 || s.FieldSize > 7 || len(body) != int(s.FieldSize) {
+		return errors.Wrapf(errBadBody, "start packet with field size %d and %d bytes of generator", s.FieldSize, len(body))
+	}
+	var g [8]byte
+	copy(g[:], body)
+	s.Generator = binary.LittleEndian.Uint64(g[:]) | 1<<(8*uint(s.FieldSize))
+	return nil
+}
+
+func (s *StartPacket) writeBody(b []byte) []byte {
+	b = append(b, s.ParentID[:]...)
+	b = append(b, s.ParentRoot[:]...)
+	b = binary.LittleEndian.AppendUint64(b, s.BlockSize)
+	b = append(b, s.FieldSize)
+	var g [8]byte
+	binary.LittleEndian.PutUint64(g[:], s.Generator)
+	return append(b, g[:s.FieldSize]...)
+}
+
+// ID returns the InputSetID defined by the start packet.
+func (s *StartPacket) ID() InputSetID {
+	f := NewFingerprint(s.writeBody(nil))
+	var id InputSetID
+	copy(id[:], f[:])
+	return id
+}
+
+// CauchyPacket defines the Cauchy matrix of the recovery blocks for the input blocks [First, Last).
+type CauchyPacket struct {
+	Header
+	First, Last uint64
+	// Hint is the number of recovery blocks created.
+	Hint uint64
+}
+
+func (c *CauchyPacket) readBody(body []byte) error {
+	if len(body) != 24 {
+		return errors.Wrapf(errBadBody, "cauchy matrix packet of %d bytes", len(body))
+	}
+	c.First = binary.LittleEndian.Uint64(body)
+	c.Last = binary.LittleEndian.Uint64(body[8:])
+	c.Hint = binary.LittleEndian.Uint64(body[16:])
+	if c.Last < c.First {
+		return errors.Wrapf(errBadBody, "cauchy matrix of blocks [%d, %d)", c.First, c.Last)
+	}
+	return nil
+}
+
+func (c *CauchyPacket) writeBody(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, c.First)
+	b = binary.LittleEndian.AppendUint64(b, c.Last)
+	return binary.LittleEndian.AppendUint64(b, c.Hint)
+}
+
+// DataPacket holds an input block.
+type DataPacket struct {
+	Header
+	Index uint64
+	Data  []byte `json:"-"`
+}
+
+func (d *DataPacket) readBody(body []byte) error {
+	if len(body) < 8 {
+		return errors.Wrapf(errBadBody, "data packet of %d bytes", len(body))
+	}
+	d.Index = binary.LittleEndian.Uint64(body)
+	d.Data = append([]byte(nil), body[8:]...)
+	return nil
+}
+
+func (d *DataPacket) writeBody(b []byte) []byte {
+	return append(binary.LittleEndian.AppendUint64(b, d.Index), d.Data...)
+}
+
+// RecoveryPacket holds a recovery block: the Index. row of the Matrix.
+type RecoveryPacket struct {
+	Header
+	Root, Matrix Fingerprint
+	Index        uint64
+	RecoveryData []byte `json:"-"`
+	// File and Offset locate the DataLength bytes of recovery data,
+	// when it is not read into RecoveryData.
+	File       string `json:",omitempty"`
+	Offset     int64  `json:",omitempty"`
+	DataLength int    `json:",omitempty"`
+}
+
+// recoveryPrefix is the length of the body before the recovery data.
+const recoveryPrefix = 16 + 16 + 8
+
+func (r *RecoveryPacket) readBody(body []byte) error {
+	if len(body) < recoveryPrefix {
+		return errors.Wrapf(errBadBody, "recovery packet of %d bytes", len(body))
+	}
+	copy(r.Root[:], body)
+	copy(r.Matrix[:], body[16:])
+	r.Index = binary.LittleEndian.Uint64(body[32:])
+	r.RecoveryData = append([]byte(nil), body[recoveryPrefix:]...)
+	return nil
+}
+
+func (r *RecoveryPacket) writeBody(b []byte) []byte {
+	b = append(b, r.Root[:]...)
+	b = append(b, r.Matrix[:]...)
+	b = binary.LittleEndian.AppendUint64(b, r.Index)
+	return append(b, r.RecoveryData...)
+}
+
+// Len returns the length of the recovery data.
+func (r *RecoveryPacket) Len() int {
+	if r.RecoveryData == nil && r.File != "" {
+		return r.DataLength
+	}
+	return len(r.RecoveryData)
+}
+
+// Data returns the RecoveryData, or reads it from File.
+// The read data is not retained.
+func (r *RecoveryPacket) Data() ([]byte, error) {
+	if r.RecoveryData != nil || r.File == "" {
+		return r.RecoveryData, nil
+	}
+	b, err := readAt(r.File, r.Offset, r.DataLength)
+	return b, errors.WithMessage(err, "recovery data")
+}
+
+// BlockChecksum is the checksum of an input block (padded with zeros).
+type BlockChecksum struct {
+	CRC64       uint64
+	Fingerprint Fingerprint
+}
+
+// crc64Table is the table of the rolling hash: CRC-64 (ISO).
+var crc64Table = crc64.MakeTable(crc64.ISO)
+
+// newBlockChecksum returns the checksums of the (padded) block.
+func newBlockChecksum(block []byte) BlockChecksum {
+	return BlockChecksum{CRC64: crc64.Checksum(block, crc64Table), Fingerprint: NewFingerprint(block)}
+}
+
+// ExternalPacket holds the checksums of the input blocks from First.
+type ExternalPacket struct {
+	Header
+	First     uint64
+	Checksums []BlockChecksum
+}
+
+func (e *ExternalPacket) readBody(body []byte) error {
+	if len(body) < 8 || (len(body)-8)%24 != 0 {
+		return errors.Wrapf(errBadBody, "external data packet of %d bytes", len(body))
+	}
+	e.First = binary.LittleEndian.Uint64(body)
+	body = body[8:]
+	e.Checksums = make([]BlockChecksum, len(body)/24)
+	for i := range e.Checksums {
+		e.Checksums[i].CRC64 = binary.LittleEndian.Uint64(body)
+		copy(e.Checksums[i].Fingerprint[:], body[8:24])
+		body = body[24:]
+	}
+	return nil
+}
+
+func (e *ExternalPacket) writeBody(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, e.First)
+	for _, c := range e.Checksums {
+		b = binary.LittleEndian.AppendUint64(b, c.CRC64)
+		b = append(b, c.Fingerprint[:]...)
+	}
+	return b
+}
+
+// Chunk describes a piece of a file.
+//
+// The full blocks of a protected chunk are from Block on. Its tail (shorter than a block)
+// is stored in the description (TailData) if it is shorter than minTailLength,
+// otherwise it is at TailOffset in TailBlock, checked by TailCRC (of its first minTailLength bytes)
+// and TailFingerprint.
+// An unprotected chunk has only its Length.
+type Chunk struct {
+	Length          uint64
+	Unprotected     bool `json:",omitempty"`
+	Block           uint64
+	TailCRC         uint64
+	TailFingerprint Fingerprint
+	TailBlock       uint64
+	TailOffset      uint64
+	TailData        []byte `json:",omitempty"`
+
+	// fingerprint of the content, to place the identical chunks once (not stored).
+	fingerprint Fingerprint
+}
+
+// minTailLength is the length of the shortest tail stored in an input block:
+// the shorter ones are stored in the chunk description.
+const minTailLength = 40
+
+// setTail sets the tail of the chunk description from its content.
+func (c *Chunk) setTail(tail []byte) {
+	if len(tail) < minTailLength {
+		c.TailData = append([]byte(nil), tail...)
+		return
+	}
+	c.TailCRC = crc64.Checksum(tail[:minTailLength], crc64Table)
+	c.TailFingerprint = NewFingerprint(tail)
+}
+
+// appendChunk appends the chunk description: the length (zero for an unprotected chunk, followed by its length),
+// the first block if the chunk has a full block, and the tail's checksums and place (or its content).
+func appendChunk(b []byte, c Chunk, blockSize uint64) []byte {
+	if c.Unprotected {
+		b = binary.LittleEndian.AppendUint64(b, 0)
+		return binary.LittleEndian.AppendUint64(b, c.Length)
+	}
+	b = binary.LittleEndian.AppendUint64(b, c.Length)
+	if c.Length >= blockSize {
+		b = binary.LittleEndian.AppendUint64(b, c.Block)
+	}
+	switch tail := c.Length % blockSize; {
+	case tail >= minTailLength:
+		b = binary.LittleEndian.AppendUint64(b, c.TailCRC)
+		b = append(b, c.TailFingerprint[:]...)
+		b = binary.LittleEndian.AppendUint64(b, c.TailBlock)
+		b = binary.LittleEndian.AppendUint64(b, c.TailOffset)
+	case tail != 0:
+		b = append(b, c.TailData[:tail]...)
+	}
+	return b
+}
+
+// readChunk reads a chunk description, returning the rest of the body.
+func readChunk(body []byte, blockSize uint64) (Chunk, []byte, error) {
+	var c Chunk
+	next := func(n int) ([]byte, bool) {
+		if len(body) < n {
+			return nil, false
+		}
+		p := body[:n]
+		body = body[n:]
+		return p, true
+	}
+	p, ok := next(8)
+	if !ok {
+		return c, body, errors.Wrapf(errBadBody, "chunk description of %d bytes", len(body))
+	}
+	if c.Length = binary.LittleEndian.Uint64(p); c.Length == 0 {
+		if p, ok = next(8); !ok {
+			return c, body, errors.Wrap(errBadBody, "unprotected chunk description")
+		}
+		c.Length, c.Unprotected = binary.LittleEndian.Uint64(p), true
+		return c, body, nil
+	}
+	if c.Length >= blockSize {
+		if p, ok = next(8); !ok {
+			return c, body, errors.Wrapf(errBadBody, "chunk description of %d bytes without its block", c.Length)
+		}
+		c.Block = binary.LittleEndian.Uint64(p)
+	}
+	switch tail := int(c.Length % blockSize); {
+	case tail >= minTailLength:
+		if p, ok = next(8 + FingerprintSize + 8 + 8); !ok {
+			return c, body, errors.Wrapf(errBadBody, "chunk description of %d bytes without its tail", c.Length)
+		}
+		c.TailCRC = binary.LittleEndian.Uint64(p)
+		copy(c.TailFingerprint[:], p[8:])
+		c.TailBlock = binary.LittleEndian.Uint64(p[8+FingerprintSize:])
+		c.TailOffset = binary.LittleEndian.Uint64(p[8+FingerprintSize+8:])
+	case tail != 0:
+		if p, ok = next(tail); !ok {
+			return c, body, errors.Wrapf(errBadBody, "chunk description of %d bytes without its %d bytes of tail", c.Length, tail)
+		}
+		c.TailData = append([]byte(nil), p...)
+	}
+	return c, body, nil
+}
+
+// FilePacket describes a file: its name (in its directory), checksums, options and chunks.
+//
+// The chunk descriptions depend on the block size, so they are decoded
+// when the start packet of the set is known.
+type FilePacket struct {
+	Header
+	Name string
+	// Hash16k is the CRC64 (ISO) of the first 16KiB,
+	// Fingerprint is of the whole (protected) content.
+	Hash16k     uint64
+	Fingerprint Fingerprint
+	// Options are the fingerprints of the option packets (e.g. permissions).
+	Options []Fingerprint `json:",omitempty"`
+	Chunks  []Chunk
+
+	blockSize  uint64
+	chunkBytes []byte
+}
+
+// Size returns the length of the file.
+func (f *FilePacket) Size() int64 {
+	var n int64
+	for _, c := range f.Chunks {
+		n += int64(c.Length)
+	}
+	return n
+}
+
+// readName reads the 2-byte length prefixed name.
+func readName(body []byte) (string, []byte, error) {
+	if len(body) < 2 {
+		return "", body, errBadBody
+	}
+	n := int(binary.LittleEndian.Uint16(body))
+	if len(body) < 2+n {
+		return "", body, errors.Wrapf(errBadBody, "name of %d bytes in %d", n, len(body)-2)
+	}
+	return string(body[2 : 2+n]), body[2+n:], nil
+}
+
+func appendName(b []byte, name string) []byte {
+	return append(binary.LittleEndian.AppendUint16(b, uint16(len(name))), name...)
+}
+
+// readOptions reads the 4-byte count prefixed fingerprints of the option packets.
+func readOptions(body []byte) ([]Fingerprint, []byte, error) {
+	if len(body) < 4 {
+		return nil, body, errors.Wrapf(errBadBody, "options of %d bytes", len(body))
+	}
+	n := int(binary.LittleEndian.Uint32(body))
+	if n == 0 {
+		return nil, body[4:], nil
+	}
+	body = body[4:]
+	if len(body)/FingerprintSize < n {
+		return nil, body, errors.Wrapf(errBadBody, "%d options in %d bytes", n, len(body))
+	}
+	fs, err := readFingerprints(body[:n*FingerprintSize])
+	return fs, body[n*FingerprintSize:], err
+}
+
+func appendOptions(b []byte, options []Fingerprint) []byte {
+	return appendFingerprints(binary.LittleEndian.AppendUint32(b, uint32(len(options))), options)
+}
+
+func (f *FilePacket) readBody(body []byte) error {
+	var err error
+	if f.Name, body, err = readName(body); err != nil {
+		return errors.WithMessage(err, "file packet")
+	}
+	if len(body) < 8+16 {
+		return errors.Wrapf(errBadBody, "file packet of %q with %d bytes", f.Name, len(body))
+	}
+	f.Hash16k = binary.LittleEndian.Uint64(body)
+	copy(f.Fingerprint[:], body[8:])
+	if f.Options, body, err = readOptions(body[24:]); err != nil {
+		return errors.WithMessage(err, f.Name)
+	}
+	f.chunkBytes = append([]byte(nil), body...)
+	return nil
+}
+
+// decodeChunks decodes the chunk descriptions read by readBody, for the block size of the set.
+func (f *FilePacket) decodeChunks(blockSize uint64) error {
+	if f.chunkBytes == nil {
+		return nil
+	}
+	body := f.chunkBytes
+	f.Chunks = f.Chunks[:0]
+	for len(body) != 0 {
+		c, rest, err := readChunk(body, blockSize)
+		if err != nil {
+			return errors.WithMessage(err, f.Name)
+		}
+		f.Chunks, body = append(f.Chunks, c), rest
+	}
+	f.blockSize, f.chunkBytes = blockSize, nil
+	return nil
+}
+
+func (f *FilePacket) writeBody(b []byte) []byte {
+	b = appendName(b, f.Name)
+	b = binary.LittleEndian.AppendUint64(b, f.Hash16k)
+	b = append(b, f.Fingerprint[:]...)
+	b = appendOptions(b, f.Options)
+	if f.chunkBytes != nil {
+		return append(b, f.chunkBytes...)
+	}
+	for _, c := range f.Chunks {
+		b = appendChunk(b, c, f.blockSize)
+	}
+	return b
+}
+
+// DirectoryPacket describes a directory: its name, options and the fingerprints of
+// the file and directory packets in it.
+type DirectoryPacket struct {
+	Header
+	Name     string
+	Options  []Fingerprint `json:",omitempty"`
+	Children []Fingerprint
+}
+
+func readFingerprints(body []byte) ([]Fingerprint, error) {
+	if len(body)%FingerprintSize != 0 {
+		return nil, errors.Wrapf(errBadBody, "%d bytes of fingerprints", len(body))
+	}
+	fs := make([]Fingerprint, len(body)/FingerprintSize)
+	for i := range fs {
+		copy(fs[i][:], body[i*FingerprintSize:])
+	}
+	return fs, nil
+}
+
+func appendFingerprints(b []byte, fs []Fingerprint) []byte {
+	for _, f := range fs {
+		b = append(b, f[:]...)
+	}
+	return b
+}
+
+func (d *DirectoryPacket) readBody(body []byte) error {
+	var err error
+	if d.Name, body, err = readName(body); err != nil {
+		return errors.WithMessage(err, "directory packet")
+	}
+	if d.Options, body, err = readOptions(body); err != nil {
+		return errors.WithMessage(err, d.Name)
+	}
+	d.Children, err = readFingerprints(body)
+	return err
+}
+
+func (d *DirectoryPacket) writeBody(b []byte) []byte {
+	return appendFingerprints(appendOptions(appendName(b, d.Name), d.Options), d.Children)
+}
+
+// RootPacket is the root directory of the input set: the number of input blocks,
+// the attributes, options and the fingerprints of the file and directory packets in it.
+type RootPacket struct {
+	Header
+	// BlockCount is the lowest unused input block index.
+	BlockCount uint64
+	// Attributes is a bit field: RootAbsolute is set if the paths are absolute.
+	Attributes uint8
+	Options    []Fingerprint `json:",omitempty"`
+	Children   []Fingerprint
+}
+
+// RootAbsolute is the attribute of the root packet of absolute paths.
+const RootAbsolute = 1 << 0
+
+func (r *RootPacket) readBody(body []byte) error {
+	if len(body) < 8+1 {
+		return errors.Wrapf(errBadBody, "root packet of %d bytes", len(body))
+	}
+	r.BlockCount = binary.LittleEndian.Uint64(body)
+	r.Attributes = body[8]
+	var err error
+	if r.Options, body, err = readOptions(body[9:]); err != nil {
+		return errors.WithMessage(err, "root packet")
+	}
+	r.Children, err = readFingerprints(body)
+	return err
+}
+
+func (r *RootPacket) writeBody(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, r.BlockCount)
+	b = append(b, r.Attributes)
+	return appendFingerprints(appendOptions(b, r.Options), r.Children)
+}
+
+// UnknownPacket is a packet of an unknown type (e.g. of another client), kept as is.
+type UnknownPacket struct {
+	Header
+	Body []byte `json:"-"`
+}
+
+func (u *UnknownPacket) readBody(body []byte) error {
+	u.Body = append([]byte(nil), body...)
+	return nil
+}
+func (u *UnknownPacket) writeBody(b []byte) []byte { return append(b, u.Body...) }
@@ -0,0 +1,393 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMultipleSets is returned when the files hold more than one input set, and none is chosen.
+var ErrMultipleSets = errors.New("multiple input sets")
+
+// ParInfo is an input set, read from the par files.
+type ParInfo struct {
+	InputSetID InputSetID
+	Start      *StartPacket
+	Root       *RootPacket
+	Creator    *CreatorPacket `json:",omitempty"`
+	Comments   []*CommentPacket
+	Matrices   []*CauchyPacket
+	// Files are the files of the tree, Dirs the directories (also the empty ones).
+	Files []*File
+	Dirs  []string
+	// Checksums of the input blocks.
+	Checksums map[uint64]BlockChecksum `json:"-"`
+	Recovery  []*RecoveryPacket
+	ParFiles  []string
+	// BaseDir is the directory of the tree (the directory of the first par file).
+	BaseDir string
+	Field   *Field `json:"-"`
+}
+
+// File is a file of the input set.
+type File struct {
+	*FilePacket
+	// Path is the path of the file in the tree, with "/" separators.
+	Path string
+}
+
+// LocalPath returns the path of the file under baseDir.
+func (f *File) LocalPath(baseDir string) string {
+	return filepath.Join(baseDir, filepath.FromSlash(f.Path))
+}
+
+// BlockSize returns the block size of the set.
+func (info *ParInfo) BlockSize() int { return int(info.Start.BlockSize) }
+
+// BlockCount returns the number of input blocks.
+func (info *ParInfo) BlockCount() int { return int(info.Root.BlockCount) }
+
+// Stat reads the input set of the par file and its volumes (base.par3, base.vol*.par3).
+func Stat(file string) (*ParInfo, error) {
+	parFiles, err := allParFiles(file)
+	if err != nil {
+		return nil, err
+	}
+	info := ParInfo{ParFiles: parFiles, BaseDir: filepath.Dir(file)}
+	return &info, info.Parse()
+}
+
+// allParFiles returns file and the other par files of the same base name.
+func allParFiles(file string) ([]string, error) {
+	base := strings.TrimSuffix(file, ".par3")
+	if i := strings.LastIndex(base, ".vol"); i >= 0 && strings.Contains(base[i:], "+") {
+		base = base[:i]
+	}
+	files, err := filepath.Glob(globEscape(base) + ".vol*.par3")
+	if err != nil {
+		return nil, errors.Wrap(err, base)
+	}
+	if _, err := os.Stat(base + ".par3"); err == nil {
+		files = append(files, base+".par3")
+	}
+	if !contains(files, file) {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func contains(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse the ParFiles. If InputSetID is not zero, that set is chosen,
+// otherwise the files must hold one input set only.
+func (info *ParInfo) Parse() error {
+	sets := make(map[InputSetID][]Packet)
+	seen := make(map[Fingerprint]bool)
+	for _, fn := range info.ParFiles {
+		packets, err := ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		for _, p := range packets {
+			h := p.header()
+			if seen[h.Fingerprint] {
+				continue
+			}
+			seen[h.Fingerprint] = true
+			sets[h.InputSetID] = append(sets[h.InputSetID], p)
+		}
+	}
+	if info.InputSetID == (InputSetID{}) {
+		var ids []string
+		for id, packets := range sets {
+			for _, p := range packets {
+				if _, ok := p.(*StartPacket); ok {
+					info.InputSetID = id
+					ids = append(ids, id.String())
+					break
+				}
+			}
+		}
+		if len(ids) > 1 {
+			sort.Strings(ids)
+			return errors.Wrapf(ErrMultipleSets, "%s", strings.Join(ids, ", "))
+		}
+	}
+	return info.addPackets(sets[info.InputSetID])
+}
+
+// addPackets fills the set from its packets, resolving the directory tree.
+func (info *ParInfo) addPackets(packets []Packet) error {
+	byFingerprint := make(map[Fingerprint]Packet, len(packets))
+	info.Checksums = make(map[uint64]BlockChecksum)
+	for _, p := range packets {
+		byFingerprint[p.header().Fingerprint] = p
+		switch x := p.(type) {
+		case *StartPacket:
+			info.Start = x
+		case *RootPacket:
+			info.Root = x
+		case *CreatorPacket:
+			info.Creator = x
+		case *CommentPacket:
+			info.Comments = append(info.Comments, x)
+		case *CauchyPacket:
+			info.Matrices = append(info.Matrices, x)
+		case *RecoveryPacket:
+			info.Recovery = append(info.Recovery, x)
+		case *ExternalPacket:
+			for i, c := range x.Checksums {
+				info.Checksums[x.First+uint64(i)] = c
+			}
+		}
+	}
+	if info.Start == nil {
+		return errors.Errorf("no start packet in %q", info.ParFiles)
+	}
+	if info.Root == nil {
+		return errors.Errorf("no root packet in %q", info.ParFiles)
+	}
+	if info.Start.BlockSize == 0 {
+		return errors.New("zero block size")
+	}
+	var err error
+	if info.Field, err = NewField(int(info.Start.FieldSize), info.Start.Generator); err != nil {
+		return err
+	}
+	for _, p := range packets {
+		if f, ok := p.(*FilePacket); ok {
+			if err := f.decodeChunks(info.Start.BlockSize); err != nil {
+				return err
+			}
+		}
+	}
+	return info.addChildren("", info.Root.Children, byFingerprint, make(map[Fingerprint]bool))
+}
+
+// addChildren adds the files and directories of the children (of dir) to the set.
+func (info *ParInfo) addChildren(dir string, children []Fingerprint, byFingerprint map[Fingerprint]Packet, visited map[Fingerprint]bool) error {
+	for _, fp := range children {
+		if visited[fp] {
+			return errors.Errorf("%s: loop in the directory tree", dir)
+		}
+		visited[fp] = true
+		var name string
+		switch x := byFingerprint[fp].(type) {
+		case *FilePacket:
+			name = x.Name
+		case *DirectoryPacket:
+			name = x.Name
+		case nil:
+			return errors.Errorf("%s: missing file or directory packet %s", dir, fp)
+		default:
+			return errors.Errorf("%s: %s is a %s packet", dir, fp, x.header().Type)
+		}
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return errors.Errorf("%s: bad name %q", dir, name)
+		}
+		p := path.Join(dir, name)
+		switch x := byFingerprint[fp].(type) {
+		case *FilePacket:
+			info.Files = append(info.Files, &File{FilePacket: x, Path: p})
+		case *DirectoryPacket:
+			info.Dirs = append(info.Dirs, p)
+			if err := info.addChildren(p, x.Children, byFingerprint, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// source is a place of a piece of an input block: the file and the offset in it.
+type source struct {
+	file   int
+	offset int64
+}
+
+// piece is a part of an input block, with the alternative places of it (deduplicated chunks).
+type piece struct {
+	blockOffset, length int
+	sources             []source
+}
+
+// layout returns the pieces of each input block, from the chunks of the files.
+func layout(files []*FilePacket, blockSize, blockCount int) ([][]piece, error) {
+	blocks := make([][]piece, blockCount)
+	add := func(b uint64, p piece, src source) error {
+		if b >= uint64(blockCount) || p.blockOffset+p.length > blockSize {
+			return errors.Errorf("chunk out of the blocks (%d. block, %d+%d)", b, p.blockOffset, p.length)
+		}
+		for i, q := range blocks[b] {
+			if q.blockOffset == p.blockOffset && q.length == p.length {
+				blocks[b][i].sources = append(q.sources, src)
+				return nil
+			}
+		}
+		p.sources = []source{src}
+		blocks[b] = append(blocks[b], p)
+		return nil
+	}
+	for i, f := range files {
+		var offset int64
+		for _, c := range f.Chunks {
+			if c.Unprotected {
+				offset += int64(c.Length)
+				continue
+			}
+			full := c.Length / uint64(blockSize)
+			for k := uint64(0); k < full; k++ {
+				if err := add(c.Block+k, piece{length: blockSize}, source{file: i, offset: offset}); err != nil {
+					return nil, errors.WithMessage(err, f.Name)
+				}
+				offset += int64(blockSize)
+			}
+			if tail := int(c.Length % uint64(blockSize)); tail >= minTailLength {
+				if err := add(c.TailBlock, piece{blockOffset: int(c.TailOffset), length: tail}, source{file: i, offset: offset}); err != nil {
+					return nil, errors.WithMessage(err, f.Name)
+				}
+			}
+			offset += int64(c.Length % uint64(blockSize))
+		}
+	}
+	return blocks, nil
+}
+
+// blockReader assembles the input blocks from the pieces of the files.
+type blockReader struct {
+	blockSize int
+	paths     []string
+	readers   []io.ReaderAt
+	opened    []bool
+	blocks    [][]piece
+	// chosen is the index of the (good) source of each piece
+	chosen [][]int
+}
+
+func newBlockReader(paths []string, blocks [][]piece, blockSize int) *blockReader {
+	br := blockReader{blockSize: blockSize, paths: paths, readers: make([]io.ReaderAt, len(paths)), opened: make([]bool, len(paths)), blocks: blocks, chosen: make([][]int, len(blocks))}
+	for b, pieces := range blocks {
+		br.chosen[b] = make([]int, len(pieces))
+	}
+	return &br
+}
+
+// setReader sets the reader of the i. file (nil means missing).
+func (br *blockReader) setReader(i int, r io.ReaderAt) {
+	br.closeFile(i)
+	br.readers[i], br.opened[i] = r, true
+}
+
+func (br *blockReader) closeFile(i int) {
+	if c, ok := br.readers[i].(*os.File); ok && c != nil {
+		c.Close()
+	}
+	br.readers[i], br.opened[i] = nil, false
+}
+
+// Close closes the opened files.
+func (br *blockReader) Close() error {
+	for i := range br.readers {
+		br.closeFile(i)
+	}
+	return nil
+}
+
+func (br *blockReader) reader(i int) io.ReaderAt {
+	if !br.opened[i] {
+		br.opened[i] = true
+		if fh, err := os.Open(br.paths[i]); err == nil {
+			br.readers[i] = fh
+		}
+	}
+	return br.readers[i]
+}
+
+// readPiece reads the piece from its k. source into the block.
+func (br *blockReader) readPiece(block []byte, p piece, k int) bool {
+	src := p.sources[k]
+	r := br.reader(src.file)
+	if r == nil {
+		return false
+	}
+	_, err := r.ReadAt(block[p.blockOffset:p.blockOffset+p.length], src.offset)
+	return err == nil
+}
+
+// read assembles the b. block from the chosen sources.
+func (br *blockReader) read(b int, block []byte) bool {
+	zero(block)
+	for i, p := range br.blocks[b] {
+		if !br.readPiece(block, p, br.chosen[b][i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// check assembles the b. block, trying the alternative sources of the pieces
+// until it matches the checksum. The good sources are remembered for read.
+func (br *blockReader) check(b int, block []byte, want BlockChecksum) bool {
+	if br.read(b, block) && newBlockChecksum(block) == want {
+		return true
+	}
+	for i, p := range br.blocks[b] {
+		for k := range p.sources {
+			if k == br.chosen[b][i] {
+				continue
+			}
+			old := br.chosen[b][i]
+			br.chosen[b][i] = k
+			if br.read(b, block) && newBlockChecksum(block) == want {
+				return true
+			}
+			br.chosen[b][i] = old
+		}
+	}
+	return false
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBLAKE3(t *testing.T) {
+	for _, tc := range []struct{ In, Want string }{
+		{"", "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{"abc", "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+	} {
+		h := newFingerprintHash()
+		h.Write([]byte(tc.In))
+		if sum := h.sum32(); hex.EncodeToString(sum[:]) != tc.Want {
+			t.Errorf("%q: got %x, wanted %s", tc.In, sum, tc.Want)
+		}
+		if got := NewFingerprint([]byte(tc.In)); hex.EncodeToString(got[:]) != tc.Want[:2*FingerprintSize] {
+			t.Errorf("%q: got fingerprint %x", tc.In, got)
+		}
+	}
+
+	// the official test vectors, with the input 0, 1, ..., 250, 0, 1, ... over several chunks
+	for _, tc := range []struct {
+		Len  int
+		Want string
+	}{
+		{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{2049, "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+		{3072, "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+		{8192, "aae792484c8efe4f19e2ca7d371d8c467ffb10748d8a5a1ae579948f718a2a63"},
+	} {
+		b := make([]byte, tc.Len)
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		h := newFingerprintHash()
+		h.Write(b)
+		if sum := h.sum32(); hex.EncodeToString(sum[:]) != tc.Want {
+			t.Errorf("%d: got %x, wanted %s", tc.Len, sum, tc.Want)
+		}
+	}
+
+	// writing in pieces gives the same sum, over several chunks and tree levels
+	b := make([]byte, 9000)
+	rand.New(rand.NewSource(1)).Read(b)
+	want := NewFingerprint(b)
+	for _, n := range []int{1, 63, 64, 1023, 1024, 1025, 4096} {
+		h := newFingerprintHash()
+		for p := b; len(p) != 0; {
+			k := n
+			if k > len(p) {
+				k = len(p)
+			}
+			h.Write(p[:k])
+			p = p[k:]
+		}
+		var got Fingerprint
+		if h.Sum(got[:0]); got != want {
+			t.Errorf("%d: got %s, wanted %s", n, got, want)
+		}
+	}
+}
+
+func TestField(t *testing.T) {
+	for _, tc := range []struct {
+		Size      int
+		Generator uint64
+	}{{1, Generator8}, {2, Generator16}} {
+		f, err := NewField(tc.Size, tc.Generator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for a := 1; a < f.Elements(); a += 1 + a/256 {
+			if got := f.mul(uint16(a), f.inv(uint16(a))); got != 1 {
+				t.Errorf("%d: %d * inv(%d) = %d", tc.Size, a, a, got)
+			}
+		}
+	}
+	if _, err := NewField(1, 0x11B); err == nil {
+		t.Error("wanted error for a not primitive generator")
+	}
+}
+
+func TestCode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for _, size := range []int{1, 2} {
+		gen := uint64(Generator8)
+		if size == 2 {
+			gen = Generator16
+		}
+		f, err := NewField(size, gen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const blockSize, n = 64, 10
+		inputs := make([][]byte, n)
+		enc, err := NewEncoder(f, blockSize, n, []int{0, 1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range inputs {
+			inputs[i] = make([]byte, blockSize)
+			rnd.Read(inputs[i])
+			enc.Add(i, inputs[i])
+		}
+		var recovery []*RecoveryPacket
+		for j, data := range enc.Recovery() {
+			if j == 1 {
+				continue
+			}
+			recovery = append(recovery, &RecoveryPacket{Index: uint64(j), RecoveryData: data})
+		}
+		missing := []int{2, 5, 9}
+		dec := NewDecoder(f, blockSize, recovery, len(missing))
+		for i, b := range inputs {
+			if i != 2 && i != 5 && i != 9 {
+				dec.Add(i, b)
+			}
+		}
+		got, err := dec.Reconstruct(missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, i := range missing {
+			if !bytes.Equal(got[k], inputs[i]) {
+				t.Errorf("%d: %d. block differs", size, i)
+			}
+		}
+	}
+}
+
+func TestPackets(t *testing.T) {
+	f, _ := NewField(1, Generator8)
+	sb := newSetBuilder(1024, f)
+	// chunks with a tail in a block, a short tail in the description, without tail, and an unprotected one
+	file := &FilePacket{Name: "a.txt", Hash16k: 42, Fingerprint: NewFingerprint([]byte("a")),
+		Options: []Fingerprint{NewFingerprint([]byte("o"))},
+		Chunks: []Chunk{
+			{Length: 2000, Block: 1, TailCRC: 9, TailFingerprint: NewFingerprint([]byte("t")), TailBlock: 3, TailOffset: 8},
+			{Length: 1030, Block: 2, TailData: []byte("abcdef")},
+			{Length: 39, TailData: bytes.Repeat([]byte{'x'}, 39)},
+			{Length: 2048, Block: 4},
+			{Length: 77, Unprotected: true},
+		}}
+	sb.add(file)
+	dir := &DirectoryPacket{Name: "dir", Children: []Fingerprint{file.Header.Fingerprint}}
+	sb.add(dir)
+	sb.add(&RootPacket{BlockCount: 6, Attributes: RootAbsolute,
+		Options:  []Fingerprint{NewFingerprint([]byte("p")), NewFingerprint([]byte("q"))},
+		Children: []Fingerprint{dir.Header.Fingerprint}})
+	sb.add(&ExternalPacket{First: 3, Checksums: []BlockChecksum{newBlockChecksum([]byte("x"))}})
+	r := CreatePacket(TypeRecovery, sb.id).(*RecoveryPacket)
+	r.Index, r.RecoveryData = 7, bytes.Repeat([]byte{1}, 1024)
+	sb.add(r)
+
+	var buf bytes.Buffer
+	buf.WriteString("garbage")
+	for i, p := range sb.packets {
+		if _, err := WritePacket(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// a damaged copy of the file packet
+			b := encodePacket(file)
+			b[len(b)-1] ^= 1
+			buf.Write(b)
+		}
+	}
+	b := buf.Bytes()
+	got, err := readPackets(bytes.NewReader(b), int64(len(b)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(sb.packets) {
+		t.Fatalf("got %d packets, wanted %d", len(got), len(sb.packets))
+	}
+	for i, p := range got {
+		if f, ok := p.(*FilePacket); ok {
+			if err := f.decodeChunks(1024); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(p, sb.packets[i]) {
+			t.Errorf("%d. got %#v, wanted %#v", i, p, sb.packets[i])
+		}
+	}
+	if s := got[0].(*StartPacket); s.ID() != sb.id || s.InputSetID != sb.id {
+		t.Errorf("got start %#v", s)
+	}
+}
+
+// TestPacketBodies checks the bodies against the layouts of the specification, spelled out byte by byte.
+func TestPacketBodies(t *testing.T) {
+	fp := func(s string) string { f := NewFingerprint([]byte(s)); return string(f[:]) }
+	le := func(n uint64, size int) string {
+		b := make([]byte, 8)
+		for i := range b {
+			b[i] = byte(n >> (8 * uint(i)))
+		}
+		return string(b[:size])
+	}
+	for _, tc := range []struct {
+		Name   string
+		Packet Packet
+		Want   string
+	}{
+		{"root", &RootPacket{BlockCount: 5, Attributes: RootAbsolute, Options: []Fingerprint{NewFingerprint([]byte("o"))},
+			Children: []Fingerprint{NewFingerprint([]byte("f")), NewFingerprint([]byte("d"))}},
+			le(5, 8) + "\x01" + le(1, 4) + fp("o") + fp("f") + fp("d")},
+		{"directory", &DirectoryPacket{Name: "dir", Children: []Fingerprint{NewFingerprint([]byte("f"))}},
+			le(3, 2) + "dir" + le(0, 4) + fp("f")},
+		{"file", &FilePacket{Name: "a.txt", Hash16k: 42, Fingerprint: NewFingerprint([]byte("a")), blockSize: 100,
+			Chunks: []Chunk{
+				// full blocks and a tail in a block
+				{Length: 250, Block: 1, TailCRC: 7, TailFingerprint: NewFingerprint([]byte("t")), TailBlock: 9, TailOffset: 12},
+				// full block, and a short tail in the description
+				{Length: 103, Block: 4, TailData: []byte("xyz")},
+				// a tail only, in a block
+				{Length: 40, TailCRC: 8, TailFingerprint: NewFingerprint([]byte("u")), TailBlock: 9, TailOffset: 62},
+				{Length: 1000, Unprotected: true},
+			}},
+			le(5, 2) + "a.txt" + le(42, 8) + fp("a") + le(0, 4) +
+				le(250, 8) + le(1, 8) + le(7, 8) + fp("t") + le(9, 8) + le(12, 8) +
+				le(103, 8) + le(4, 8) + "xyz" +
+				le(40, 8) + le(8, 8) + fp("u") + le(9, 8) + le(62, 8) +
+				le(0, 8) + le(1000, 8)},
+	} {
+		if got := string(tc.Packet.writeBody(nil)); got != tc.Want {
+			t.Errorf("%s: got\n%x, wanted\n%x", tc.Name, got, tc.Want)
+		}
+		p := CreatePacket(typeOf(tc.Packet), InputSetID{})
+		if err := p.readBody([]byte(tc.Want)); err != nil {
+			t.Fatalf("%s: %+v", tc.Name, err)
+		}
+		if f, ok := p.(*FilePacket); ok {
+			if err := f.decodeChunks(100); err != nil {
+				t.Fatalf("%s: %+v", tc.Name, err)
+			}
+		}
+		if got := string(p.writeBody(nil)); got != tc.Want {
+			t.Errorf("%s: read and written got\n%x, wanted\n%x", tc.Name, got, tc.Want)
+		}
+	}
+}
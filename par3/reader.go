@@ -0,0 +1,155 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// lazyLength is the body length from which the data of the recovery packets
+// is not read into memory, just located in the file.
+const lazyLength = 4 << 10
+
+// ReadFile reads the packets of the file.
+//
+// The damaged packets (bad fingerprint or body) are skipped, the reading
+// resumes at the next magic sequence.
+func ReadFile(fn string) ([]Packet, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	return readPackets(fh, fi.Size(), fn)
+}
+
+// readPackets reads the packets of r (of size bytes),
+// locating the recovery data in the file fn (if not empty).
+func readPackets(r io.ReaderAt, size int64, fn string) ([]Packet, error) {
+	var packets []Packet
+	var b [headerLength]byte
+	var skipped int64
+	for pos := int64(0); pos+headerLength <= size; {
+		var h Header
+		if _, err := r.ReadAt(b[:], pos); err != nil {
+			return packets, errors.Wrapf(err, "%s: read header at %d", fn, pos)
+		}
+		p, err := readPacket(r, size, fn, pos, b[:], &h)
+		if err != nil {
+			next, findErr := findMagic(r, size, pos+1)
+			if findErr != nil {
+				return packets, findErr
+			}
+			if h.Length != 0 {
+				log.Printf("%s: skip damaged packet at %d: %v", fn, pos, err)
+			}
+			skipped += next - pos
+			pos = next
+			continue
+		}
+		packets = append(packets, p)
+		pos += int64(h.Length)
+	}
+	if skipped != 0 {
+		log.Printf("%s: skipped %d bytes", fn, skipped)
+	}
+	return packets, nil
+}
+
+// readPacket reads the packet at pos, whose header is in b.
+func readPacket(r io.ReaderAt, size int64, fn string, pos int64, b []byte, h *Header) (Packet, error) {
+	if !h.decode(b) {
+		return nil, errors.New("no magic")
+	}
+	if h.Length < headerLength || int64(h.Length) > size-pos {
+		return nil, errors.Errorf("bad length %d", h.Length)
+	}
+	// check the fingerprint
+	hsh := newFingerprintHash()
+	if _, err := io.Copy(hsh, io.NewSectionReader(r, pos+24, int64(h.Length)-24)); err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+	var got Fingerprint
+	if hsh.Sum(got[:0]); got != h.Fingerprint {
+		return nil, errors.Errorf("fingerprint mismatch (got %s, wanted %s)", got, h.Fingerprint)
+	}
+
+	p := CreatePacket(h.Type, h.InputSetID)
+	bodyLength := int(h.Length) - headerLength
+	rp, lazy := p.(*RecoveryPacket)
+	if lazy = lazy && fn != "" && bodyLength > lazyLength; lazy {
+		bodyLength = recoveryPrefix
+	}
+	body := make([]byte, bodyLength)
+	if _, err := r.ReadAt(body, pos+headerLength); err != nil {
+		return nil, errors.Wrap(err, "read body")
+	}
+	if err := p.readBody(body); err != nil {
+		return nil, err
+	}
+	*p.header() = *h
+	if lazy {
+		rp.RecoveryData = nil
+		rp.File, rp.Offset = fn, pos+headerLength+recoveryPrefix
+		rp.DataLength = int(h.Length) - headerLength - recoveryPrefix
+	}
+	return p, nil
+}
+
+// findMagic returns the position of the next magic sequence from pos (or size, if there is none).
+func findMagic(r io.ReaderAt, size, pos int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for pos < size {
+		n, err := r.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return pos, errors.Wrapf(err, "read at %d", pos)
+		}
+		if n == 0 {
+			break
+		}
+		if i := bytes.Index(buf[:n], []byte(magic)); i >= 0 {
+			return pos + int64(i), nil
+		}
+		if int64(n) < int64(len(buf)) {
+			break
+		}
+		pos += int64(n - len(magic) + 1)
+	}
+	return size, nil
+}
+
+// readAt reads length bytes from fn at offset.
+func readAt(fn string, offset int64, length int) ([]byte, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	defer fh.Close()
+	b := make([]byte, length)
+	if _, err := fh.ReadAt(b, offset); err != nil {
+		return nil, errors.Wrapf(err, "%s: read %d bytes at %d", fn, length, offset)
+	}
+	return b, nil
+}
@@ -0,0 +1,290 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// RepairOptions are the options of Repair.
+type RepairOptions struct {
+	// NoBackup removes the damaged files, instead of keeping them with a .1 (.2, ...) suffix.
+	NoBackup bool
+}
+
+// Repair the damaged and missing files and directories of the set.
+//
+// The missing input blocks are reconstructed (using the good chunks of the damaged files, too),
+// and the files are written into temporary files next to them. Only if all of them match
+// their fingerprint, the damaged files are renamed (or removed), and the temporary files moved in place.
+//
+// Returns the names of the repaired files and directories.
+func Repair(info *ParInfo, opts RepairOptions) ([]string, error) {
+	rep := Verify(info)
+	if rep.Status == RepairNotNeeded {
+		return nil, nil
+	}
+	if rep.Status == RepairImpossible {
+		return nil, errors.Wrapf(ErrNotEnoughRecovery, "%d missing, %d available", rep.MissingBlocks, rep.AvailableRecovery)
+	}
+	for _, file := range info.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Path)) {
+			return nil, errors.Errorf("%q is not under %q", file.Path, info.BaseDir)
+		}
+	}
+	br, err := info.inputBlocks()
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+
+	var names []string
+	var damaged []int
+	for i, fr := range rep.Files {
+		if fr.Exists && fr.Err == nil && !fr.Damaged {
+			continue
+		}
+		damaged = append(damaged, i)
+	}
+
+	repaired, err := info.reconstruct(br)
+	if err != nil {
+		return names, err
+	}
+	tmps := make(map[int]string, len(damaged))
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for _, i := range damaged {
+		file := info.Files[i]
+		fn := file.LocalPath(info.BaseDir)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return names, errors.Wrap(err, fn)
+		}
+		tmp, err := info.repairFile(fn, rep.Files[i].Exists, file, br, repaired)
+		if err != nil {
+			return names, err
+		}
+		tmps[i] = tmp
+	}
+	br.Close()
+
+	for _, dir := range rep.MissingDirs {
+		fn := (&File{Path: dir}).LocalPath(info.BaseDir)
+		if err := os.MkdirAll(fn, 0755); err != nil {
+			return names, errors.Wrap(err, fn)
+		}
+		names = append(names, fn)
+	}
+	for _, i := range damaged {
+		fn := info.Files[i].LocalPath(info.BaseDir)
+		if rep.Files[i].Exists {
+			if opts.NoBackup {
+				if err := os.Remove(fn); err != nil {
+					return names, errors.Wrap(err, fn)
+				}
+			} else {
+				bak := backupName(fn)
+				if err := os.Rename(fn, bak); err != nil {
+					return names, errors.Wrap(err, fn)
+				}
+				log.Printf("%q renamed to %q", fn, bak)
+			}
+		}
+		if err := os.Rename(tmps[i], fn); err != nil {
+			return names, errors.Wrap(err, fn)
+		}
+		delete(tmps, i)
+		names = append(names, fn)
+	}
+	return names, nil
+}
+
+// repairFile writes the file fn into a temporary file next to it, with the mode of the damaged file (if exists),
+// and checks its fingerprint.
+//
+// Returns the name of the temporary file, which is removed on error.
+func (info *ParInfo) repairFile(fn string, exists bool, file *File, br *blockReader, repaired map[int][]byte) (string, error) {
+	fh, err := createTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".par3-")
+	if err != nil {
+		return "", errors.Wrap(err, fn)
+	}
+	if exists {
+		var fi os.FileInfo
+		if fi, err = os.Stat(fn); err == nil {
+			err = fh.Chmod(fi.Mode().Perm())
+		}
+	}
+	if err == nil {
+		err = info.writeFile(fh, file, br, repaired)
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", errors.Wrap(err, fn)
+	}
+	return fh.Name(), nil
+}
+
+// createTemp creates a new file in dir, named pattern and a random suffix.
+// Unlike ioutil.TempFile, the mode is 0666 (before umask), as of os.Create,
+// as the file replaces a missing one.
+func createTemp(dir, pattern string) (*os.File, error) {
+	for i := 0; ; i++ {
+		fh, err := os.OpenFile(filepath.Join(dir, pattern+strconv.FormatUint(uint64(rand.Uint32()), 10)),
+			os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil && os.IsExist(err) && i < 100 {
+			continue
+		}
+		return fh, err
+	}
+}
+
+// Restore writes the content of the file named (by its path in the set) into w,
+// repairing it if needed. Its data is read from data (nil if missing), the other files from BaseDir.
+func (info *ParInfo) Restore(w io.Writer, name string, data io.ReaderAt) error {
+	br, err := info.inputBlocks()
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+	var file *File
+	for i, f := range info.Files {
+		if f.Path == name {
+			file = f
+			br.setReader(i, data)
+			break
+		}
+	}
+	if file == nil {
+		return errors.Errorf("%q is not in the set", name)
+	}
+	repaired, err := info.reconstruct(br)
+	if err != nil {
+		return err
+	}
+	return info.writeFile(w, file, br, repaired)
+}
+
+// reconstruct returns the missing input blocks.
+func (info *ParInfo) reconstruct(br *blockReader) (map[int][]byte, error) {
+	missing := br.missing(info.Checksums, nil)
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	dec := NewDecoder(info.Field, info.BlockSize(), info.Recovery, len(missing))
+	if dec.Available() < len(missing) {
+		return nil, errors.Wrapf(ErrNotEnoughRecovery, "%d missing, %d available", len(missing), dec.Available())
+	}
+	// the chosen sources of the good blocks are remembered by the first pass
+	block := make([]byte, info.BlockSize())
+	next := 0
+	for b := range br.blocks {
+		if next < len(missing) && missing[next] == b {
+			next++
+			continue
+		}
+		if !br.read(b, block) {
+			return nil, errors.Errorf("cannot read the %d. block", b)
+		}
+		dec.Add(b, block)
+	}
+	blocks, err := dec.Reconstruct(missing)
+	if err != nil {
+		return nil, err
+	}
+	repaired := make(map[int][]byte, len(missing))
+	for k, b := range missing {
+		repaired[b] = blocks[k]
+	}
+	return repaired, nil
+}
+
+// writeFile writes the content of the file from its input blocks, checking its fingerprint.
+func (info *ParInfo) writeFile(w io.Writer, file *File, br *blockReader, repaired map[int][]byte) error {
+	bw := bufio.NewWriter(w)
+	h := newFingerprintHash()
+	mw := io.MultiWriter(bw, h)
+	blockSize := uint64(info.BlockSize())
+	block := make([]byte, blockSize)
+	get := func(b uint64) ([]byte, error) {
+		if data := repaired[int(b)]; data != nil {
+			return data, nil
+		}
+		if b >= uint64(len(br.blocks)) || !br.read(int(b), block) {
+			return nil, errors.Errorf("cannot read the %d. block", b)
+		}
+		return block, nil
+	}
+	for _, c := range file.Chunks {
+		if c.Unprotected {
+			return errors.Errorf("%s: the unprotected chunk of %d bytes cannot be restored", file.Path, c.Length)
+		}
+		for k := uint64(0); k < c.Length/blockSize; k++ {
+			data, err := get(c.Block + k)
+			if err != nil {
+				return err
+			}
+			if _, err := mw.Write(data); err != nil {
+				return err
+			}
+		}
+		if tail := c.Length % blockSize; tail != 0 && tail < minTailLength {
+			if _, err := mw.Write(c.TailData); err != nil {
+				return err
+			}
+		} else if tail != 0 {
+			data, err := get(c.TailBlock)
+			if err != nil {
+				return err
+			}
+			if _, err := mw.Write(data[c.TailOffset : c.TailOffset+tail]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	var fp Fingerprint
+	h.Sum(fp[:0])
+	if fp != file.Fingerprint {
+		return errors.Errorf("%s: fingerprint mismatch after repair", file.Path)
+	}
+	return nil
+}
+
+// backupName returns the first not existing fn.1, fn.2, ...
+func backupName(fn string) string {
+	for i := 1; ; i++ {
+		bak := fn + "." + strconv.Itoa(i)
+		if _, err := os.Lstat(bak); os.IsNotExist(err) {
+			return bak
+		}
+	}
+}
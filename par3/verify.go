@@ -0,0 +1,232 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// VerifyStatus is the result of Verify.
+type VerifyStatus uint8
+
+const (
+	// RepairNotNeeded means all the files are good.
+	RepairNotNeeded = VerifyStatus(iota)
+	// RepairRequired means some files are damaged or missing, but there are enough recovery blocks.
+	RepairRequired
+	// RepairImpossible means more input blocks are missing than the available recovery blocks.
+	RepairImpossible
+)
+
+func (s VerifyStatus) String() string {
+	switch s {
+	case RepairNotNeeded:
+		return "Repair not needed."
+	case RepairRequired:
+		return "Repair is required."
+	case RepairImpossible:
+		return "Repair not possible."
+	}
+	return fmt.Sprintf("VerifyStatus(%d)", uint8(s))
+}
+
+// FileReport is the state of a file of the set.
+type FileReport struct {
+	Path   string
+	Exists bool
+	// Err is the error of opening the file.
+	Err error `json:",omitempty"`
+	// Damaged is true if the file exists, but its size or fingerprint differs.
+	Damaged bool `json:",omitempty"`
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Files       []FileReport
+	MissingDirs []string `json:",omitempty"`
+	// BlockCount is the number of input blocks, MissingBlocks the number of the missing (or bad) ones,
+	// AvailableRecovery the number of recovery blocks,
+	// NeededRecovery the number of recovery blocks needed in addition to the available ones.
+	BlockCount, MissingBlocks, AvailableRecovery, NeededRecovery int
+	Status                                                       VerifyStatus
+}
+
+// Verify checks the files (by size and fingerprint) and the directories of the set.
+// If a file is damaged, its input blocks are checked one by one, to count the missing ones
+// (a deduplicated chunk is good if any copy of it is).
+func Verify(info *ParInfo) *VerifyReport {
+	rep := VerifyReport{
+		Files:      make([]FileReport, len(info.Files)),
+		BlockCount: info.BlockCount(),
+	}
+	rep.AvailableRecovery = NewDecoder(info.Field, info.BlockSize(), info.Recovery, 0).Available()
+	var rewrite bool
+	for i, file := range info.Files {
+		rep.Files[i] = verifyFile(file.LocalPath(info.BaseDir), file)
+		rep.Files[i].Path = file.Path
+		fr := rep.Files[i]
+		rewrite = rewrite || !fr.Exists || fr.Err != nil || fr.Damaged
+	}
+	for _, dir := range info.Dirs {
+		if fi, err := os.Stat((&File{Path: dir}).LocalPath(info.BaseDir)); err != nil || !fi.IsDir() {
+			rep.MissingDirs = append(rep.MissingDirs, dir)
+			rewrite = true
+		}
+	}
+	if rewrite {
+		missing, err := missingBlocks(info, nil)
+		if err != nil {
+			rep.MissingBlocks = rep.BlockCount
+		} else {
+			rep.MissingBlocks = len(missing)
+		}
+	}
+	switch {
+	case rep.MissingBlocks == 0 && rewrite:
+		rep.Status = RepairRequired
+	case rep.MissingBlocks == 0:
+		rep.Status = RepairNotNeeded
+	case rep.MissingBlocks > rep.AvailableRecovery:
+		rep.Status = RepairImpossible
+		rep.NeededRecovery = rep.MissingBlocks - rep.AvailableRecovery
+	default:
+		rep.Status = RepairRequired
+	}
+	return &rep
+}
+
+func verifyFile(fn string, file *File) FileReport {
+	var fr FileReport
+	fh, err := os.Open(fn)
+	if err != nil {
+		if fr.Exists = !os.IsNotExist(err); fr.Exists {
+			fr.Err = err
+		}
+		return fr
+	}
+	defer fh.Close()
+	fr.Exists = true
+	fi, err := fh.Stat()
+	if err != nil {
+		fr.Err = err
+		return fr
+	}
+	if fi.Size() != file.Size() {
+		fr.Damaged = true
+		return fr
+	}
+	// the fingerprint is of the protected chunks
+	h := newFingerprintHash()
+	for _, c := range file.Chunks {
+		w := io.Writer(h)
+		if c.Unprotected {
+			w = ioutil.Discard
+		}
+		if _, err := io.CopyN(w, fh, int64(c.Length)); err != nil {
+			fr.Err = err
+			return fr
+		}
+	}
+	var fp Fingerprint
+	h.Sum(fp[:0])
+	fr.Damaged = fp != file.Fingerprint
+	return fr
+}
+
+// inputBlocks returns the block reader of the input blocks of the set.
+func (info *ParInfo) inputBlocks() (*blockReader, error) {
+	paths := make([]string, len(info.Files))
+	files := make([]*FilePacket, len(info.Files))
+	for i, file := range info.Files {
+		paths[i], files[i] = file.LocalPath(info.BaseDir), file.FilePacket
+	}
+	blocks, err := layout(files, info.BlockSize(), info.BlockCount())
+	if err != nil {
+		return nil, err
+	}
+	return newBlockReader(paths, blocks, info.BlockSize()), nil
+}
+
+// missingBlocks returns the indexes of the input blocks which cannot be read or have bad checksum.
+// The good blocks are given to f (if not nil).
+func missingBlocks(info *ParInfo, f func(int, []byte)) ([]int, error) {
+	br, err := info.inputBlocks()
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	return br.missing(info.Checksums, f), nil
+}
+
+// missing returns the indexes of the blocks which cannot be read or have bad checksum.
+// The good blocks are given to f (if not nil).
+func (br *blockReader) missing(checksums map[uint64]BlockChecksum, f func(int, []byte)) []int {
+	var missing []int
+	block := make([]byte, br.blockSize)
+	for b := range br.blocks {
+		want, ok := checksums[uint64(b)]
+		if ok && br.check(b, block, want) || !ok && br.read(b, block) {
+			if f != nil {
+				f(b, block)
+			}
+			continue
+		}
+		missing = append(missing, b)
+	}
+	return missing
+}
+
+// WriteTo writes the report as text.
+func (rep *VerifyReport) WriteTo(w io.Writer) (int64, error) {
+	ew := &errWriter{w: w}
+	for _, f := range rep.Files {
+		switch {
+		case !f.Exists:
+			fmt.Fprintf(ew, "\t%s: missing\n", f.Path)
+		case f.Err != nil:
+			fmt.Fprintf(ew, "\t%s: open: %v\n", f.Path, f.Err)
+		case f.Damaged:
+			fmt.Fprintf(ew, "\t%s: damaged\n", f.Path)
+		default:
+			fmt.Fprintf(ew, "\t%s: ok\n", f.Path)
+		}
+	}
+	for _, dir := range rep.MissingDirs {
+		fmt.Fprintf(ew, "\t%s/: missing\n", dir)
+	}
+	fmt.Fprintf(ew, "\t-------\n\t%d/%d missing blocks, %d recovery blocks: %s\n",
+		rep.MissingBlocks, rep.BlockCount, rep.AvailableRecovery, rep.Status)
+	return ew.N, ew.Err
+}
+
+type errWriter struct {
+	w   io.Writer
+	Err error
+	N   int64
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.Err != nil {
+		return 0, ew.Err
+	}
+	n, err := ew.w.Write(p)
+	ew.Err = err
+	ew.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package par3
+
+import (
+	"hash"
+	"hash/crc64"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var _ = io.WriteCloser((*Writer)(nil))
+
+// Writer writes the PAR3 input set of one file, streaming its data:
+// the file is one chunk, its full blocks are the first input blocks, the tail is in the last one
+// (or in the chunk description, if it is shorter than 40 bytes).
+//
+// The recovery blocks depend on all the input blocks, so the packets are written on Close.
+type Writer struct {
+	// Creator and Comment are written into the creator and comment packets (set them before Close).
+	Creator, Comment string
+
+	w         io.Writer
+	name      string
+	size      int64
+	blockSize int
+	field     *Field
+	enc       *Encoder
+	checksums []BlockChecksum
+	fileHash  hash.Hash
+	head      hash.Hash64
+	block     []byte
+	length    int
+	total     int64
+	closed    bool
+}
+
+// NewWriter returns a Writer of the file name, having size bytes,
+// with blockSize (rounded up to a multiple of 4) input blocks and recovery blocks.
+func NewWriter(w io.Writer, name string, size int64, blockSize, recovery int) (*Writer, error) {
+	if blockSize <= 0 {
+		return nil, errors.Errorf("bad block size %d", blockSize)
+	}
+	if n := blockSize % 4; n != 0 {
+		blockSize += 4 - n
+	}
+	n := int(size / int64(blockSize))
+	if size%int64(blockSize) >= minTailLength {
+		n++
+	}
+	field, err := fieldFor(n + recovery)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]int, recovery)
+	for j := range indexes {
+		indexes[j] = j
+	}
+	enc, err := NewEncoder(field, blockSize, n, indexes)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w: w, name: name, size: size, blockSize: blockSize,
+		field: field, enc: enc, checksums: make([]BlockChecksum, 0, n),
+		fileHash: newFingerprintHash(), head: crc64.New(crc64Table),
+		block: make([]byte, blockSize),
+	}, nil
+}
+
+func (pw *Writer) Write(p []byte) (int, error) {
+	if pw.closed {
+		return 0, errors.New("write on closed writer")
+	}
+	if pw.total+int64(len(p)) > pw.size {
+		return 0, errors.Errorf("%s: more than %d bytes", pw.name, pw.size)
+	}
+	pw.fileHash.Write(p)
+	if pw.total < headLength {
+		n := int64(len(p))
+		if pw.total+n > headLength {
+			n = headLength - pw.total
+		}
+		pw.head.Write(p[:n])
+	}
+	pw.total += int64(len(p))
+	written := len(p)
+	for len(p) != 0 {
+		n := copy(pw.block[pw.length:], p)
+		p, pw.length = p[n:], pw.length+n
+		if pw.length == pw.blockSize {
+			pw.flush()
+		}
+	}
+	return written, nil
+}
+
+// flush adds the (zero padded) block.
+func (pw *Writer) flush() {
+	zero(pw.block[pw.length:])
+	pw.enc.Add(len(pw.checksums), pw.block)
+	pw.checksums = append(pw.checksums, newBlockChecksum(pw.block))
+	pw.length = 0
+}
+
+// Close writes the critical packets, then the recovery packets, and the critical packets again.
+func (pw *Writer) Close() error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+	if pw.total != pw.size {
+		return errors.Errorf("%s: got %d bytes, wanted %d", pw.name, pw.total, pw.size)
+	}
+	f := &FilePacket{Name: pw.name, Hash16k: pw.head.Sum64()}
+	pw.fileHash.Sum(f.Fingerprint[:0])
+	if pw.total != 0 {
+		c := Chunk{Length: uint64(pw.total)}
+		if pw.length != 0 {
+			c.setTail(pw.block[:pw.length])
+			if pw.length >= minTailLength {
+				c.TailBlock = uint64(len(pw.checksums))
+				pw.flush()
+			}
+		}
+		f.Chunks = []Chunk{c}
+	}
+
+	n := len(pw.checksums)
+	recovery := pw.enc.Recovery()
+	sb := newSetBuilder(pw.blockSize, pw.field)
+	matrix := &CauchyPacket{First: 0, Last: uint64(n), Hint: uint64(len(recovery))}
+	sb.add(matrix)
+	sb.addChecksums(pw.checksums)
+	sb.add(f)
+	root := &RootPacket{BlockCount: uint64(n), Children: []Fingerprint{f.Header.Fingerprint}}
+	sb.add(root)
+
+	packets := append(sb.packets[:len(sb.packets):len(sb.packets)], sb.extra(pw.Creator, pw.Comment)...)
+	for j, data := range recovery {
+		r := CreatePacket(TypeRecovery, sb.id).(*RecoveryPacket)
+		r.Root, r.Matrix = root.Fingerprint, matrix.Fingerprint
+		r.Index, r.RecoveryData = uint64(j), data
+		packets = append(packets, r)
+	}
+	packets = append(packets, sb.packets...)
+	for _, p := range packets {
+		if _, err := WritePacket(pw.w, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
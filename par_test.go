@@ -16,16 +16,21 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/kylelemons/godebug/diff"
 	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
 )
 
 var errFatal = errors.New("fatal")
@@ -45,7 +50,7 @@ func TestCR(t *testing.T) {
 	}
 	defer parity.Close()
 
-	for _, ver := range []version{VersionJSON, VersionTAR, VersionPAR2} {
+	for _, ver := range []version{VersionJSON, VersionTAR, VersionPAR2, VersionBinary, VersionArmor, VersionArmor85} {
 		if _, err := inp.Seek(0, io.SeekStart); err != nil {
 			t.Fatal(err)
 		}
@@ -57,7 +62,7 @@ func TestCR(t *testing.T) {
 }
 
 func testCR(t *testing.T, ver version, parityName string, inp *os.File) {
-	if err := ver.CreateParFile(parityName, inp.Name(), 0, 0, 0); err != nil {
+	if err := CreateParFile(ver, parityName, inp.Name(), 0, 0, 0, false, ""); err != nil {
 		t.Fatalf("%s. %+v", ver, err)
 	}
 	if _, err := inp.Seek(0, io.SeekStart); err != nil {
@@ -84,7 +89,7 @@ func testCR(t *testing.T, ver version, parityName string, inp *os.File) {
 	}
 
 	var restored bytes.Buffer
-	if err := RestoreParFile(&restored, parityName, inp.Name()); err != nil {
+	if err := RestoreParFile(&restored, parityName, inp.Name(), ""); err != nil {
 		t.Fatalf("%s. Restore: %v", ver, err)
 	}
 
@@ -98,6 +103,565 @@ func testCR(t *testing.T, ver version, parityName string, inp *os.File) {
 	}
 }
 
+// TestJSONShortShard checks that the last, short data shard is hashed without the zero padding,
+// so it is not taken as broken.
+func TestJSONShortShard(t *testing.T) {
+	inp, err := ioutil.TempFile("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove(inp.Name())
+	defer inp.Close()
+	if _, err := inp.Write(bytes.Repeat([]byte("0123456789"), 250)); err != nil {
+		t.Fatal(err)
+	}
+	parity, err := ioutil.TempFile("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove(parity.Name())
+	defer parity.Close()
+	if err := CreateParFile(VersionJSON, parity.Name(), inp.Name(), 2, 1, 1<<10, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inp.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(parity)
+	var meta FileMetadata
+	b, err := br.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	nextShard := newJSONNextShard(meta, br, inp)
+	var short int
+	for i := 0; ; i++ {
+		sm, _, err := nextShard(make([]byte, meta.ShardSize), i%3)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if sm.Size != 0 && sm.Size < meta.ShardSize {
+			short++
+		}
+	}
+	if short == 0 {
+		t.Error("no short shard")
+	}
+}
+
+// TestRSDecSlices checks that a shard cannot overwrite the next one through its capacity,
+// as the readers may use the whole p[:cap(p)].
+func TestRSDecSlices(t *testing.T) {
+	rse := newRSDec(&FileMetadata{DataShards: 3, ParityShards: 2, ShardSize: 16}, nil)
+	if len(rse.slices) != 5 {
+		t.Fatalf("got %d slices, wanted 5", len(rse.slices))
+	}
+	for i, p := range rse.slices {
+		if len(p) != 16 || cap(p) != 16 {
+			t.Errorf("%d. got len=%d cap=%d, wanted 16", i, len(p), cap(p))
+		}
+	}
+}
+
+func TestTarRevisions(t *testing.T) {
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range []uint8{TarRevisionName, TarRevisionPAX, TarRevisionIndex} {
+		parity, err := ioutil.TempFile("", "par-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer remove(parity.Name())
+		meta := FileMetadata{Version: VersionTAR, FileName: "main.go", OnlyParity: true, Revision: rev}
+		w, err := newWriter(parity, meta)
+		if err != nil {
+			t.Fatalf("%d. %+v", rev, err)
+		}
+		if _, err := w.Write(orig); err != nil {
+			t.Fatalf("%d. %v", rev, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%d. %v", rev, err)
+		}
+		if err := parity.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		fh, err := os.Open(parity.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(fh)
+		var names []string
+		for {
+			th, err := tr.Next()
+			if err != nil {
+				break
+			}
+			names = append(names, th.Name)
+		}
+		fh.Close()
+		if wantPAX := rev >= TarRevisionPAX; wantPAX != (names[1] == "shard-000001.dat") {
+			t.Errorf("%d. got name %q", rev, names[1])
+		}
+
+		var restored bytes.Buffer
+		if err := RestoreParFile(&restored, parity.Name(), "main.go", ""); err != nil {
+			t.Fatalf("%d. Restore: %+v", rev, err)
+		}
+		if !bytes.Equal(restored.Bytes(), orig) {
+			t.Errorf("%d. restored mismatch", rev)
+		}
+	}
+}
+
+func TestTarIndex(t *testing.T) {
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parity, err := ioutil.TempFile("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove(parity.Name())
+	defer parity.Close()
+	if err := CreateParFile(VersionTAR, parity.Name(), "main.go", 0, 0, 0, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := parity.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := readTarIndex(parity, fi.Size(), DefaultDataShards+DefaultParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ix.entries), DefaultDataShards+DefaultParityShards; got != want {
+		t.Fatalf("got %d index entries, wanted %d", got, want)
+	}
+
+	// A broken header stops the sequential reader, but not the indexed one.
+	if _, err := parity.WriteAt(bytes.Repeat([]byte{0xff}, 512), ix.entries[DefaultDataShards].Offset); err != nil {
+		t.Fatal(err)
+	}
+	var restored bytes.Buffer
+	if err := RestoreParFile(&restored, parity.Name(), "main.go", ""); err != nil {
+		t.Fatalf("Restore: %+v", err)
+	}
+	if !bytes.Equal(restored.Bytes(), orig) {
+		t.Errorf("restored mismatch")
+	}
+}
+
+func TestBinary(t *testing.T) {
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	parFn := filepath.Join(dir, "main.go.par")
+	if err := CreateParFile(VersionBinary, parFn, "main.go", 4, 2, 1<<10, true, "binary"); err != nil {
+		t.Fatal(err)
+	}
+	good, err := ioutil.ReadFile(parFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, sb, _, err := readBinaryHead(container.Source{Reader: bufio.NewReader(bytes.NewReader(good)), Name: parFn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Comment != "binary" || meta.FileName != "main.go" || sb.Size != int64(len(orig)) {
+		t.Errorf("got %#v, %#v", meta, sb)
+	}
+	// minimal overhead, and each shard is where the superblock says
+	n := sb.shardCount()
+	if got, want := len(good), 2*binSuperblockLength+int(sb.MetaLength)+int(n)*binHeaderLength+
+		len(orig)+int(n)/6*2<<10; got != want {
+		t.Errorf("got %d bytes, wanted %d", got, want)
+	}
+	for index := uint32(1); int64(index) <= n; index++ {
+		off := sb.shardOffset(index)
+		if sm, ok := decodeBinHeader(good[off:]); !ok || sm.Index != index {
+			t.Errorf("%d. shard is not at %d", index, off)
+		}
+	}
+
+	restore := func(name string, b []byte, seekable bool) {
+		t.Helper()
+		pr := container.Source{Reader: bufio.NewReader(bytes.NewReader(b)), Name: name}
+		if seekable {
+			pr.ReaderAt, pr.Size = bytes.NewReader(b), int64(len(b))
+		}
+		wt, err := binaryFormat{}.NewShardReader(pr, errReader{errors.New("no data")}, container.ReadOptions{})
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		var restored bytes.Buffer
+		if _, err := wt.WriteTo(&restored); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if !bytes.Equal(restored.Bytes(), orig) {
+			t.Errorf("%s: restored mismatch (got %d bytes, wanted %d)", name, restored.Len(), len(orig))
+		}
+	}
+	damage := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+	off2, off3 := int(sb.shardOffset(2)), int(sb.shardOffset(3))
+	restore("good", good, false)
+	restore("superblock", damage(func(b []byte) []byte { b[12]++; return b }), true)
+	restore("header", damage(func(b []byte) []byte { b[off2+1]++; return b }), false)
+	restore("content", damage(func(b []byte) []byte { b[off2+100]++; return b }), false)
+	restore("cut", damage(func(b []byte) []byte { return append(b[:off2+100], b[off3-10:]...) }), false)
+	restore("garbage", damage(func(b []byte) []byte {
+		return append(b[:off3:off3], append(bytes.Repeat([]byte(binSync), 10), b[off3:]...)...)
+	}), false)
+	restore("truncated", good[:int(sb.shardOffset(uint32(n)))+10], false)
+	restore("last", damage(func(b []byte) []byte { return append(b[:off3], b[int(sb.shardOffset(5)):]...) }), false)
+}
+
+func TestArmor(t *testing.T) {
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []armorFormat{armorFormatOf(t, VersionArmor), armorFormatOf(t, VersionArmor85)} {
+		parFn := filepath.Join(dir, "main.go."+f.name)
+		if err := CreateParFile(f.version, parFn, "main.go", 4, 2, 1<<10, true, "armor"); err != nil {
+			t.Fatal(err)
+		}
+		good, err := ioutil.ReadFile(parFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.SplitAfter(string(good), "\n")
+		for i, line := range lines {
+			for _, c := range []byte(line) {
+				if c >= 0x80 || c < ' ' && c != '\n' {
+					t.Fatalf("%s: %d. line is not text: %q", f.name, i+1, line)
+				}
+			}
+			if len(line) > 80 && line[0] == 'D' {
+				t.Errorf("%s: %d. line is too long (%d)", f.name, i+1, len(line))
+			}
+		}
+		lineOf := func(prefix string) int {
+			for i, line := range lines {
+				if strings.HasPrefix(line, prefix) {
+					return i
+				}
+			}
+			t.Fatalf("%s: no line %q", f.name, prefix)
+			return -1
+		}
+
+		restore := func(name string, b []byte, seekable bool) {
+			t.Helper()
+			name = f.name + "/" + name
+			pr := container.Source{Reader: bufio.NewReader(bytes.NewReader(b)), Name: name}
+			if seekable {
+				pr.ReaderAt, pr.Size = bytes.NewReader(b), int64(len(b))
+			}
+			wt, err := f.NewShardReader(pr, errReader{errors.New("no data")}, container.ReadOptions{})
+			if err != nil {
+				t.Fatalf("%s: %+v", name, err)
+			}
+			var restored bytes.Buffer
+			if _, err := wt.WriteTo(&restored); err != nil {
+				t.Fatalf("%s: %+v", name, err)
+			}
+			if !bytes.Equal(restored.Bytes(), orig) {
+				t.Errorf("%s: restored mismatch (got %d bytes, wanted %d)", name, restored.Len(), len(orig))
+			}
+		}
+		damage := func(f func(lines []string) []string) []byte {
+			return []byte(strings.Join(f(append([]string(nil), lines...)), ""))
+		}
+		flip := func(line string, i int) string { return line[:i] + string(line[i]^1) + line[i+1:] }
+		s2, s3 := lineOf(`S {"i":2,`), lineOf(`S {"i":3,`)
+		restore("good", good, false)
+		restore("metadata", damage(func(l []string) []string { l[1] = flip(l[1], 10); return l }), true)
+		restore("header", damage(func(l []string) []string { l[s2] = flip(l[s2], 7); return l }), false)
+		restore("content", damage(func(l []string) []string { l[s2+3] = flip(l[s2+3], 20); return l }), false)
+		restore("tag", damage(func(l []string) []string { l[s2+3] = flip(l[s2+3], 0); return l }), false)
+		restore("deleted", damage(func(l []string) []string { return append(l[:s2+3], l[s2+4:]...) }), false)
+		restore("cut", damage(func(l []string) []string { return append(l[:s2+3], l[s3-2:]...) }), false)
+		restore("crlf", []byte(strings.Replace(string(good), "\n", "\r\n", -1)), true)
+		restore("truncated", damage(func(l []string) []string { return l[:len(l)-5] }), false)
+	}
+}
+
+// armorFormatOf returns the armorFormat of the version.
+func armorFormatOf(t *testing.T, ver version) armorFormat {
+	f, err := container.Of(ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.(armorFormat)
+}
+
+func TestStream(t *testing.T) {
+	orig := make([]byte, 10<<10+123)
+	for i := range orig {
+		orig[i] = byte(i * 7 / 3)
+	}
+	var buf bytes.Buffer
+	if _, err := EncodeStream(&buf, bytes.NewReader(orig), 4, 2, 1<<10, "stream"); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+	var offsets []int
+	for i := 0; ; i++ {
+		j := bytes.Index(good[i:], []byte(streamSync))
+		if j < 0 {
+			break
+		}
+		i += j
+		offsets = append(offsets, i)
+	}
+	// meta, 3 stripes of 6 frames, 2 end frames
+	if len(offsets) != 1+3*6+2 {
+		t.Fatalf("got %d frames", len(offsets))
+	}
+	meta, sm, err := readStreamHead("good", bytes.NewReader(good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Comment != "stream" || meta.DataShards != 4 || sm.Index != 1 || sm.Size != 1<<10 {
+		t.Errorf("got %#v, %#v", meta, sm)
+	}
+
+	decode := func(name string, b []byte) ([]byte, error) {
+		t.Helper()
+		var decoded bytes.Buffer
+		// no Seeker
+		_, err := DecodeStream(&decoded, io.MultiReader(bytes.NewReader(b)), name)
+		return decoded.Bytes(), err
+	}
+	restore := func(name string, b []byte) {
+		t.Helper()
+		decoded, err := decode(name, b)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if !bytes.Equal(decoded, orig) {
+			t.Errorf("%s: decoded mismatch (got %d bytes, wanted %d)", name, len(decoded), len(orig))
+		}
+	}
+	damage := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+	f2, f3, f9 := offsets[2], offsets[3], offsets[9]
+	restore("good", good)
+	restore("meta", damage(func(b []byte) []byte { b[offsets[0]+20]++; return b }))
+	restore("header", damage(func(b []byte) []byte { b[f2+10]++; return b }))
+	restore("content", damage(func(b []byte) []byte { b[f2+100]++; return b }))
+	restore("cut", damage(func(b []byte) []byte { return append(b[:f2+100], b[f3-10:]...) }))
+	restore("frames", damage(func(b []byte) []byte { return append(b[:f3], b[offsets[5]:]...) }))
+	restore("garbage", damage(func(b []byte) []byte {
+		return append(b[:f9:f9], append(bytes.Repeat([]byte(streamSync), 10), b[f9:]...)...)
+	}))
+	restore("stripes", damage(func(b []byte) []byte { b[f2+100]++; b[f9+100]++; b[offsets[13]+5]++; return b }))
+	// the last stripe is short, so it is the last even without the end frames
+	restore("end", good[:offsets[len(offsets)-2]])
+
+	if _, err := decode("truncated", good[:offsets[13]]); errors.Cause(err) != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := decode("lost", damage(func(b []byte) []byte { return append(b[:offsets[7]], b[offsets[13]:]...) })); err == nil {
+		t.Errorf("lost stripe: no error")
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parity, err := ioutil.TempFile("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove(parity.Name())
+	parity.Close()
+
+	for _, ver := range []version{VersionJSON, VersionTAR, VersionBinary, VersionArmor, VersionArmor85, VersionStream} {
+		if err := CreateParFile(ver, parity.Name(), "main.go", 0, 0, 1<<10, true, ""); err != nil {
+			t.Fatalf("%s. %+v", ver, err)
+		}
+		var restored bytes.Buffer
+		if err := RestoreParFile(&restored, parity.Name(), "nonexistent.go", ""); err != nil {
+			t.Fatalf("%s. Restore: %+v", ver, err)
+		}
+		if !bytes.Equal(restored.Bytes(), orig) {
+			t.Errorf("%s. restored mismatch", ver)
+		}
+	}
+
+	// the refused -embed must not leave an empty parity file behind
+	out := parity.Name() + ".par"
+	for _, ver := range []version{VersionPAR2, VersionPAR3} {
+		if err := CreateParFile(ver, out, "main.go", 0, 0, 0, true, ""); err == nil {
+			remove(out)
+			t.Errorf("%s should not embed the data", ver)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			remove(out)
+			t.Errorf("%s. %q is created (%v)", ver, out, err)
+		}
+	}
+}
+
+func TestLocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inp := filepath.Join(dir, "input.go")
+	if err := ioutil.WriteFile(inp, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// same size, different content
+	if err := ioutil.WriteFile(filepath.Join(dir, "decoy.go"), bytes.ToUpper(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, ver := range []version{VersionJSON, VersionTAR, VersionPAR2, VersionPAR3} {
+		parFn := filepath.Join(dir, ver.String()+".par")
+		if err := CreateParFile(ver, parFn, inp, 0, 0, 0, false, ""); err != nil {
+			t.Fatalf("%s. %+v", ver, err)
+		}
+		if got, err := LocateDataFile(parFn, ""); err != nil || got != inp {
+			t.Errorf("%s. got %q (%v), wanted %q", ver, got, err, inp)
+		}
+	}
+	renamed := filepath.Join(dir, "sub", "renamed.go")
+	if err := os.MkdirAll(filepath.Dir(renamed), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(inp, renamed); err != nil {
+		t.Fatal(err)
+	}
+	for _, ver := range []version{VersionJSON, VersionTAR, VersionPAR2, VersionPAR3} {
+		parFn := filepath.Join(dir, ver.String()+".par")
+		if got, err := LocateDataFile(parFn, ""); err == nil {
+			t.Errorf("%s. found %q without search dir", ver, got)
+		}
+		if got, err := LocateDataFile(parFn, dir); err != nil || got != renamed {
+			t.Errorf("%s. got %q (%v), wanted %q", ver, got, err, renamed)
+		}
+	}
+}
+
+func TestLocateDamaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig, err := ioutil.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ver := range []version{VersionJSON, VersionTAR, VersionPAR2, VersionBinary} {
+		inp := filepath.Join(dir, ver.String()+".go")
+		if err := ioutil.WriteFile(inp, orig, 0644); err != nil {
+			t.Fatal(err)
+		}
+		parFn := inp + ".par"
+		if err := CreateParFile(ver, parFn, inp, 0, 0, 0, false, ""); err != nil {
+			t.Fatalf("%s. %+v", ver, err)
+		}
+		damaged := append([]byte(nil), orig...)
+		for i := 10; i < 14; i++ {
+			damaged[i] ^= 0xff
+		}
+		if err := ioutil.WriteFile(inp, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := LocateDataFile(parFn, "")
+		if err != nil || got != inp {
+			t.Fatalf("%s. got %q (%v), wanted %q", ver, got, err, inp)
+		}
+		var buf bytes.Buffer
+		if err := RestoreParFile(&buf, parFn, got, ""); err != nil {
+			t.Fatalf("%s. %+v", ver, err)
+		}
+		if !bytes.Equal(buf.Bytes(), orig) {
+			t.Errorf("%s. restored mismatch", ver)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "par-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range container.Formats() {
+		if g, err := container.Lookup(strings.ToLower(f.Name())); err != nil || g != f {
+			t.Errorf("%s: lookup got %v (%v)", f.Name(), g, err)
+		}
+		if g, err := container.Of(f.Version()); err != nil || g != f || f.Version().String() != f.Name() {
+			t.Errorf("%s: got %v (%v) for version %s", f.Name(), g, err, f.Version())
+		}
+		parFn := filepath.Join(dir, f.Name()+".par")
+		if err := CreateParFile(f.Version(), parFn, "main.go", 0, 0, 0, false, ""); err != nil {
+			t.Fatalf("%s. %+v", f.Name(), err)
+		}
+		if g, err := container.DetectFile(parFn); err != nil || g != f {
+			t.Errorf("%s: detected %v (%v)", f.Name(), g, err)
+		}
+		if head, err := container.ReadHead(parFn); err != nil {
+			t.Errorf("%s: %+v", f.Name(), err)
+		} else if head.Version != f.Version() || head.FileName != "main.go" || head.HeadHash == nil {
+			t.Errorf("%s: got head %+v", f.Name(), head)
+		}
+	}
+	if f, err := container.Lookup("par"); err != nil || f.Version() != VersionPAR2 {
+		t.Errorf("par: got %v (%v)", f, err)
+	}
+	if _, err := container.Lookup("zip"); errors.Cause(err) != ErrUnknownVersion {
+		t.Errorf("zip: got %v", err)
+	}
+	if _, err := container.Detect([]byte("garbage")); err == nil {
+		t.Error("detected garbage")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registered TAR twice")
+			}
+		}()
+		container.Register(tarFormat{})
+	}()
+}
+
 var KeepFiles = os.Getenv("KEEP_FILES") == "1"
 
 func remove(fn string) error {
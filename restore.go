@@ -16,11 +16,7 @@
 package main
 
 import (
-	"archive/tar"
-	"bufio"
 	"bytes"
-	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -28,46 +24,30 @@ import (
 
 	"github.com/klauspost/reedsolomon"
 	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
 )
 
 var errShardBroken = errors.New("shard is broken")
 
-type namer interface {
-	Name() string
-}
-type namedReader struct {
-	io.Reader
-	namer
-}
-
-func RestoreParFile(w io.Writer, parFn, fileName string) error {
-	pfh, err := os.Open(parFn)
+// RestoreParFile writes the data file fileName, checked and repaired by the parity file parFn.
+//
+// The set is the ID (prefix) of the recovery set to use, if parFn has several (PAR2).
+func RestoreParFile(w io.Writer, parFn, fileName, set string) error {
+	format, parity, pfh, err := container.Open(parFn)
 	if err != nil {
-		return errors.Wrap(err, parFn)
+		return err
 	}
 	defer pfh.Close()
-	br := bufio.NewReader(pfh)
-	// u s t a r \0 0 0  at byte offset 257
-	b, err := br.Peek(257 + 6)
-	if err != nil {
-		return errors.Wrap(err, parFn)
-	}
-	ver := VersionTAR
-	if bytes.Equal(b[:5], []byte("PAR2\000")) {
-		ver = VersionPAR2
-	} else if b[0] == '{' {
-		ver = VersionJSON
-	} else if len(b) >= 257 && bytes.Equal(b[257:257+6], []byte("ustar\000")) {
-		ver = VersionTAR
-	} else {
-		return errors.Errorf("unknown parity file start %q", b)
-	}
 
-	r, err := os.Open(fileName)
-	if err != nil {
-		return errors.Wrap(err, fileName)
+	// The data file is not needed when the data shards are embedded.
+	var r io.Reader
+	if fh, err := os.Open(fileName); err != nil {
+		r = errReader{errors.Wrap(err, fileName)}
+	} else {
+		defer fh.Close()
+		r = fh
 	}
-	wr, err := ver.NewParWriterTo(namedReader{Reader: br, namer: pfh}, r)
+	wr, err := format.NewShardReader(parity, r, container.ReadOptions{DataName: fileName, Set: set})
 	if err != nil {
 		return err
 	}
@@ -76,42 +56,6 @@ func RestoreParFile(w io.Writer, parFn, fileName string) error {
 	return err
 }
 
-func (ver version) NewParWriterTo(parity, data io.Reader) (io.WriterTo, error) {
-	var meta FileMetadata
-	switch ver {
-	case VersionTAR:
-		tr := tar.NewReader(parity)
-		th, err := tr.Next()
-		if err != nil {
-			return nil, err
-		}
-		if th.Name != "FileMetadata.json" {
-			return nil, errors.Errorf("First item should be FileMetadata.json, got %q", th.Name)
-		}
-		var buf bytes.Buffer
-		if err = json.NewDecoder(io.TeeReader(tr, &buf)).Decode(&meta); err != nil {
-			return nil, errors.Wrap(err, buf.String())
-		}
-		meta.Version = VersionTAR
-		return meta.NewWriterTo(tr, data), nil
-
-	case VersionJSON:
-		var buf bytes.Buffer
-		dec := json.NewDecoder(io.TeeReader(parity, &buf))
-		if err := dec.Decode(&meta); err != nil {
-			return nil, errors.Wrapf(err, "read metadata %s", buf.Bytes())
-		}
-		meta.Version = VersionJSON
-		return meta.NewWriterTo(rewind(dec.Buffered(), parity), data), nil
-
-	case VersionPAR2:
-		meta.Version = VersionPAR2
-		return meta.NewWriterTo(parity, data), nil
-
-	}
-	return nil, errors.Errorf("unknown version %s", ver)
-}
-
 func rewind(ahead, rest io.Reader) io.Reader {
 	sek, ok := rest.(io.Seeker)
 	if !ok {
@@ -131,39 +75,23 @@ func rewind(ahead, rest io.Reader) io.Reader {
 	return rest
 }
 
-func (meta *FileMetadata) NewWriterTo(parity, data io.Reader) io.WriterTo {
+// nextShardFunc reads the next shard into the buffer (the idx. in the stripe).
+type nextShardFunc func(p []byte, idx int) (ShardMetadata, []byte, error)
+
+// newRSWriterTo returns the writer of the data, restored from the shards read by the func returned by newNextShard.
+func newRSWriterTo(meta *FileMetadata, newNextShard func(FileMetadata) nextShardFunc) io.WriterTo {
 	if meta.DataShards == 0 {
 		meta.DataShards = DefaultDataShards
 	}
 	if meta.ParityShards == 0 {
 		meta.ParityShards = DefaultParityShards
 	}
-	if n := meta.ShardSize % 4; n != 0 && meta.Version == VersionPAR2 {
-		meta.ShardSize += 4 - n
-	}
-
 	rsw := rsWriterTo{meta: meta}
-
-	var nextShard func([]byte, int) (ShardMetadata, []byte, error)
-	switch meta.Version {
-	case VersionJSON:
-		nextShard = newJSONNextShard(*meta, bufio.NewReader(parity), data)
-
-	case VersionTAR:
-		nextShard = newTarNextShard(*meta, parity.(*tar.Reader), data)
-
-	case VersionPAR2:
-		nextShard = newPAR2NextShard(*meta, parity.(namedReader), data)
-
-	default:
-		panic(fmt.Sprintf("Unknown version %v", meta.Version))
-	}
-
-	rsw.rsDec = meta.newRSDec(nextShard)
+	rsw.rsDec = newRSDec(meta, newNextShard(*meta))
 	return &rsw
 }
 
-func (meta *FileMetadata) newRSDec(nextShard func([]byte, int) (ShardMetadata, []byte, error)) rsDec {
+func newRSDec(meta *FileMetadata, nextShard nextShardFunc) rsDec {
 	if meta.DataShards == 0 {
 		meta.DataShards = DefaultDataShards
 	}
@@ -189,7 +117,8 @@ func (meta *FileMetadata) newRSDec(nextShard func([]byte, int) (ShardMetadata, [
 		panic(errors.Wrapf(err, "D=%d P=%d", D, P))
 	}
 	for i := range rse.slices {
-		rse.slices[i] = rse.data[i*shardSize : (i+1)*shardSize]
+		// limit the capacity, as nextShard may use the whole p[:cap(p)]
+		rse.slices[i] = rse.data[i*shardSize : (i+1)*shardSize : (i+1)*shardSize]
 	}
 	return rse
 }
@@ -206,7 +135,7 @@ type rsDec struct {
 	data                  []byte
 	slices                [][]byte
 	DataShards, ShardSize int
-	nextShard             func([]byte, int) (ShardMetadata, []byte, error)
+	nextShard             nextShardFunc
 }
 
 func (rsw rsWriterTo) WriteTo(w io.Writer) (int64, error) {
@@ -231,7 +160,8 @@ func (rsw rsWriterTo) WriteTo(w io.Writer) (int64, error) {
 					return written, nil
 				}
 				if errors.Cause(err) == errShardBroken {
-					slices[i] = nil
+					// zero length, but keep the memory, so the reconstructed shard is in the data
+					slices[i] = slices[i][:0]
 					missing++
 					if i < D {
 						totalSize += int(sm.Size)
@@ -0,0 +1,239 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+// armorTailLength is the length of the end of the armored file searched for the metadata copy.
+const armorTailLength = 1 << 20
+
+// readArmorHead reads the begin line and the metadata of the armored format.
+//
+// If parity is a ReaderAt, the metadata copy at the end is used, as it has the real data size
+// (and the metadata at the start may be damaged).
+// The returned reader is positioned after the metadata line.
+func readArmorHead(parity container.Source, enc *armorEncoding) (FileMetadata, *bufio.Reader, error) {
+	var meta FileMetadata
+	br, ok := parity.Reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(parity.Reader)
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return meta, br, errors.Wrap(err, "read begin line")
+	}
+	if got := strings.TrimRight(line, " \t\r\n"); got != enc.begin() {
+		return meta, br, errors.Errorf("bad begin line %q (wanted %q)", got, enc.begin())
+	}
+	if line, err = br.ReadString('\n'); err != nil && line == "" {
+		return meta, br, errors.Wrap(err, "read metadata")
+	}
+	headErr := decodeArmorMeta(line, &meta)
+	if parity.ReaderAt != nil && parity.Size > 0 {
+		if tail, ok := readArmorTailMeta(parity); ok {
+			if headErr != nil {
+				log.Printf("%s: damaged metadata (%v), using the copy at the end", parity.Name, headErr)
+				headErr = nil
+			}
+			meta = tail
+		}
+	}
+	if headErr != nil {
+		return meta, br, headErr
+	}
+	return meta, br, nil
+}
+
+// decodeArmorMeta decodes the metadata line into meta.
+func decodeArmorMeta(line string, meta *FileMetadata) error {
+	tag, payload, err := parseArmorLine(line)
+	if err != nil {
+		return errors.Wrap(err, "metadata")
+	}
+	if tag != 'M' {
+		return errors.Errorf("metadata line is needed, got %q", tag)
+	}
+	if err := json.Unmarshal([]byte(payload), meta); err != nil {
+		return errors.Wrap(err, "decode metadata")
+	}
+	if meta.DataShards == 0 || meta.ParityShards == 0 || meta.ShardSize == 0 {
+		return errors.Errorf("bad metadata %#v", *meta)
+	}
+	return nil
+}
+
+// readArmorTailMeta returns the last good metadata line's metadata, from the end of parity.
+func readArmorTailMeta(parity container.Source) (FileMetadata, bool) {
+	var meta FileMetadata
+	off := parity.Size - armorTailLength
+	if off < 0 {
+		off = 0
+	}
+	b := make([]byte, parity.Size-off)
+	n, _ := parity.ReaderAt.ReadAt(b, off)
+	lines := bytes.Split(b[:n], []byte{'\n'})
+	for i := len(lines) - 1; i >= 0; i-- {
+		if bytes.HasPrefix(lines[i], []byte("M ")) && decodeArmorMeta(string(lines[i]), &meta) == nil {
+			return meta, true
+		}
+	}
+	return meta, false
+}
+
+// armorShardReader is the shardSource of the armored format.
+//
+// A damaged line is skipped; the content of its shard is short, so that shard is broken.
+type armorShardReader struct {
+	br   *bufio.Reader
+	enc  *armorEncoding
+	name string
+	// line is the read, but not consumed line
+	line    string
+	hasLine bool
+	done    bool
+}
+
+func newArmorShardReader(name string, enc *armorEncoding, parity *bufio.Reader) *armorShardReader {
+	return &armorShardReader{br: parity, enc: enc, name: name}
+}
+
+// readLine returns the next line, false at the end (EOF or the end line).
+func (r *armorShardReader) readLine() (string, bool, error) {
+	if r.hasLine {
+		r.hasLine = false
+		return r.line, true, nil
+	}
+	if r.done {
+		return "", false, nil
+	}
+	line, err := r.br.ReadString('\n')
+	if err != nil {
+		if err != io.EOF {
+			return "", false, err
+		}
+		if line == "" {
+			r.done = true
+			return "", false, nil
+		}
+	}
+	if strings.HasPrefix(line, armorEnd) {
+		r.done = true
+		return "", false, nil
+	}
+	return line, true, nil
+}
+
+func (r *armorShardReader) unreadLine(line string) { r.line, r.hasLine = line, true }
+
+// header returns the next good shard header line.
+func (r *armorShardReader) header() (ShardMetadata, bool, error) {
+	var bad int
+	defer func() {
+		if bad != 0 {
+			log.Printf("%s: skipped %d damaged lines", r.name, bad)
+		}
+	}()
+	for {
+		line, ok, err := r.readLine()
+		if !ok || err != nil {
+			return ShardMetadata{}, false, err
+		}
+		tag, payload, err := parseArmorLine(line)
+		if err != nil {
+			bad++
+			continue
+		}
+		if tag != 'S' {
+			// the metadata copy, or the content of a shard whose header is damaged
+			continue
+		}
+		var sm ShardMetadata
+		if err := json.Unmarshal([]byte(payload), &sm); err != nil || sm.Index == 0 {
+			bad++
+			continue
+		}
+		return sm, true, nil
+	}
+}
+
+// contentLines calls f with each content line of the shard (damaged ones, too).
+func (r *armorShardReader) contentLines(f func(line string)) error {
+	for {
+		line, ok, err := r.readLine()
+		if !ok || err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "D ") {
+			r.unreadLine(line)
+			return nil
+		}
+		f(line)
+	}
+}
+
+func (r *armorShardReader) skip(ShardMetadata) { r.contentLines(func(string) {}) }
+
+// content decodes the content lines of the shard, checking each line and the shard's hash.
+func (r *armorShardReader) content(sm ShardMetadata, p []byte, idx int) ([]byte, error) {
+	var n int
+	var lineErr error
+	if err := r.contentLines(func(line string) {
+		if lineErr != nil {
+			return
+		}
+		_, payload, err := parseArmorLine(line)
+		if err != nil {
+			lineErr = err
+			return
+		}
+		b, err := r.enc.decode(payload)
+		if err != nil {
+			lineErr = err
+			return
+		}
+		if n+len(b) > int(sm.Size) {
+			lineErr = errors.Errorf("content is longer than %d", sm.Size)
+			return
+		}
+		n += copy(p[n:], b)
+	}); err != nil {
+		return nil, err
+	}
+	if lineErr != nil {
+		err := errors.Wrapf(errShardBroken, "%d. shard: %v", sm.Index, lineErr)
+		log.Printf("%s: %v", r.name, err)
+		return nil, err
+	}
+	if n != int(sm.Size) {
+		return nil, errors.Wrapf(errShardBroken, "%d. shard is short (%d, wanted %d)", sm.Index, n, sm.Size)
+	}
+	if got := crc32.Checksum(p[:n], crc32cTable); got != sm.Hash32 {
+		return nil, errors.Wrapf(errShardBroken, "%d. shard crc mismatch (got %d, wanted %d)", idx, got, sm.Hash32)
+	}
+	zero(p[n:])
+	return p, nil
+}
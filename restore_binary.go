@@ -0,0 +1,168 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+)
+
+// readBinaryHead reads the superblock and the metadata of the binary format.
+//
+// If the superblock at the start is damaged, the copy at the end is used (if parity is a ReaderAt);
+// that one has the real data size, too.
+// The returned reader is positioned after the metadata (or the damaged superblock).
+func readBinaryHead(parity container.Source) (FileMetadata, binSuperblock, *bufio.Reader, error) {
+	var meta FileMetadata
+	br, ok := parity.Reader.(*bufio.Reader)
+	if !ok || br.Size() < binSuperblockLength {
+		br = bufio.NewReader(parity.Reader)
+	}
+	b, err := br.Peek(binSuperblockLength)
+	if err != nil {
+		return meta, binSuperblock{}, br, errors.Wrap(err, "read superblock")
+	}
+	sb, headErr := decodeBinSuperblock(b)
+	if parity.ReaderAt != nil && parity.Size >= 2*binSuperblockLength {
+		b := make([]byte, binSuperblockLength)
+		if _, err := parity.ReaderAt.ReadAt(b, parity.Size-binSuperblockLength); err == nil {
+			if tail, err := decodeBinSuperblock(b); err == nil {
+				sb = tail
+				if headErr != nil {
+					log.Printf("%s: damaged superblock (%v), using the copy at the end", parity.Name, headErr)
+					headErr = nil
+				}
+			}
+		}
+	}
+	if headErr != nil {
+		return meta, sb, br, headErr
+	}
+	if _, err := br.Discard(binSuperblockLength); err != nil {
+		return meta, sb, br, err
+	}
+	// the metadata is not essential, the superblock has everything for the restore
+	js := make([]byte, sb.MetaLength)
+	if _, err := io.ReadFull(br, js); err != nil {
+		return meta, sb, br, errors.Wrap(err, "read metadata")
+	}
+	if crc32.Checksum(js, crc32cTable) != sb.MetaCRC {
+		log.Printf("%s: damaged metadata", parity.Name)
+	} else if err := json.Unmarshal(js, &meta); err != nil {
+		log.Printf("%s: decode metadata: %v", parity.Name, err)
+	}
+	meta.Version = VersionBinary
+	meta.DataShards, meta.ParityShards = sb.DataShards, sb.ParityShards
+	meta.ShardSize, meta.OnlyParity = sb.ShardSize, sb.OnlyParity
+	if sb.Size >= 0 {
+		meta.Size = sb.Size
+	}
+	return meta, sb, br, nil
+}
+
+// binShardReader is the shardSource of the binary format.
+//
+// The next good header is searched for by its sync marker.
+type binShardReader struct {
+	br      *bufio.Reader
+	name    string
+	skipped int64
+}
+
+func newBinShardReader(name string, sb binSuperblock, parity *bufio.Reader) *binShardReader {
+	br := parity
+	if size := int(sb.ShardSize) + 2*binHeaderLength; br.Size() < size {
+		br = bufio.NewReaderSize(parity, size)
+	}
+	return &binShardReader{br: br, name: name}
+}
+
+// header returns the next good header.
+// Returns false at the end (EOF or the superblock copy).
+func (r *binShardReader) header() (ShardMetadata, bool, error) {
+	for {
+		b, err := r.br.Peek(binHeaderLength)
+		if len(b) < binHeaderLength {
+			if err != nil && err != io.EOF {
+				return ShardMetadata{}, false, err
+			}
+			r.skipped += int64(len(b))
+			r.logSkipped()
+			return ShardMetadata{}, false, nil
+		}
+		if sm, ok := decodeBinHeader(b); ok {
+			r.br.Discard(binHeaderLength)
+			return sm, true, nil
+		}
+		if bytes.HasPrefix(b, []byte(binMagic)) {
+			if b, _ := r.br.Peek(binSuperblockLength); len(b) == binSuperblockLength {
+				if _, err := decodeBinSuperblock(b); err == nil {
+					r.logSkipped()
+					return ShardMetadata{}, false, nil
+				}
+			}
+		}
+		// resync: skip to the next sync marker
+		buf, _ := r.br.Peek(r.br.Buffered())
+		n := len(buf) - len(binSync) + 1
+		if i := bytes.Index(buf[1:], []byte(binSync)); i >= 0 {
+			n = i + 1
+		}
+		r.br.Discard(n)
+		r.skipped += int64(n)
+	}
+}
+
+func (r *binShardReader) logSkipped() {
+	if r.skipped != 0 {
+		log.Printf("%s: skipped %d bytes", r.name, r.skipped)
+		r.skipped = 0
+	}
+}
+
+func (r *binShardReader) skip(sm ShardMetadata) { r.br.Discard(int(sm.Size)) }
+
+// content reads the content of the shard, checking its hash.
+func (r *binShardReader) content(sm ShardMetadata, p []byte, idx int) ([]byte, error) {
+	length := int(sm.Size)
+	b, _ := r.br.Peek(length)
+	if len(b) < length {
+		// truncated: the next header is searched in what is there
+		return nil, errors.Wrapf(errShardBroken, "%d. shard is truncated", sm.Index)
+	}
+	if got := crc32.Checksum(b, crc32cTable); got != sm.Hash32 {
+		err := errors.Wrapf(errShardBroken, "%d. shard crc mismatch (got %d, wanted %d)", idx, got, sm.Hash32)
+		log.Printf("%s: %v", r.name, err)
+		// skip the content if it is just damaged in place (the next header is right after it)
+		if b, _ := r.br.Peek(length + binHeaderLength); len(b) == length+binHeaderLength {
+			if _, ok := decodeBinHeader(b[length:]); ok {
+				r.br.Discard(length)
+			}
+		}
+		return nil, err
+	}
+	copy(p, b)
+	zero(p[length:])
+	r.br.Discard(length)
+	return p, nil
+}
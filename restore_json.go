@@ -26,7 +26,7 @@ import (
 	"github.com/pkg/errors"
 )
 
-func newJSONNextShard(meta FileMetadata, parity *bufio.Reader, data io.Reader) func([]byte, int) (ShardMetadata, []byte, error) {
+func newJSONNextShard(meta FileMetadata, parity *bufio.Reader, data io.Reader) nextShardFunc {
 	D := int(meta.DataShards)
 	hsh := crc32.New(crc32cTable)
 	return func(p []byte, i int) (ShardMetadata, []byte, error) {
@@ -72,7 +72,6 @@ func newJSONNextShard(meta FileMetadata, parity *bufio.Reader, data io.Reader) f
 
 		if length < len(p) {
 			zero(p[length:])
-			hsh.Write(p[length:])
 		}
 		got := uint32(hsh.Sum32())
 		if sm.Hash32 == got {
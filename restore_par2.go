@@ -16,92 +16,249 @@
 package main
 
 import (
-	"crypto/md5"
-	"hash/crc32"
 	"io"
 	"log"
-	"strconv"
+	"os"
+	"path/filepath"
 
 	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
 	"github.com/tgulacsi/par/par2"
 )
 
-var errRecoveryDataInvalid = errors.New("recovery data is invalid")
+// par2WriterTo writes a data file of the recovery set, checked and repaired by the PAR2 recovery set.
+//
+// The recovery slices protect all the files of the set together,
+// so the other files (from the set's BaseDir) are read, too.
+type par2WriterTo struct {
+	info *par2.ParInfo
+	// files are the files of the set in input block order, the data is the target-th.
+	files  []*par2.File
+	target int
+	data   io.Reader
+}
 
-func newPAR2NextShard(meta FileMetadata, parity namedReader, data io.Reader) func([]byte, int) (ShardMetadata, []byte, error) {
-	info := par2.ParInfo{ParFiles: []string{parity.Name()}}
-	var err error
-	if err = info.Parse(); err == nil {
-		if info.Main == nil {
-			err = errors.New("empty par file: " + parity.Name())
-		}
+// newPAR2WriterTo returns the writer of fileName, from the recovery set with the ID (prefix) setID
+// (the -set flag), or if it is empty, from the set which contains the file.
+func newPAR2WriterTo(parity container.Source, data io.Reader, fileName, setID string) (*par2WriterTo, error) {
+	sets, err := par2.StatSets(parity.Name)
+	if err != nil {
+		return nil, err
 	}
+	info, err := selectPAR2Set(sets, setID, fileName)
 	if err != nil {
-		return func(_ []byte, _ int) (ShardMetadata, []byte, error) { return ShardMetadata{}, nil, err }
+		return nil, err
 	}
+	if info.Main == nil || len(info.Files) == 0 {
+		return nil, errors.New("empty par file: " + parity.Name)
+	}
+	pw := par2WriterTo{info: info, data: data, target: -1}
+	if pw.files, err = info.InputFiles(); err != nil {
+		return nil, err
+	}
+	if len(pw.files) == 1 {
+		pw.target = 0
+	} else {
+		base := filepath.Base(fileName)
+		names := make([]string, len(pw.files))
+		for i, f := range pw.files {
+			if names[i] = f.Name(); names[i] == base {
+				pw.target = i
+			}
+		}
+		if pw.target < 0 {
+			return nil, errors.Errorf("%q is not in the recovery set (%q)", fileName, names)
+		}
+	}
+	return &pw, nil
+}
 
-	hCRC := crc32.NewIEEE()
-	hMD5 := md5.New()
-	D, P := int(meta.DataShards), int(meta.ParityShards)
+// selectPAR2Set returns the set with the given ID prefix,
+// or (with an empty id) the only set, or the only set which contains fileName.
+func selectPAR2Set(sets []*par2.ParInfo, id, fileName string) (*par2.ParInfo, error) {
+	if id != "" {
+		return par2.FindSet(sets, id)
+	}
+	if len(sets) == 1 {
+		return sets[0], nil
+	}
+	base := filepath.Base(fileName)
+	var found []*par2.ParInfo
+	for _, set := range sets {
+		for _, f := range set.Files {
+			if f.Name() == base {
+				found = append(found, set)
+				break
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, errors.Errorf("%q is not in any of the %d recovery sets", fileName, len(sets))
+	case 1:
+		return found[0], nil
+	}
+	ids := make([]string, len(found))
+	for i, set := range found {
+		ids[i] = set.RecoverySetID.String()
+	}
+	return nil, errors.Wrapf(par2.ErrMultipleSets, "%q is in %q, choose one with -set", fileName, ids)
+}
 
-	totalSize := info.Files[0].FileDescPacket.FileLength
-	index, dataIndex := -1, -1
-	var got par2.ChecksumPair
+// WriteTo writes the data, as long as it is undamaged.
+// The missing blocks (of all files) are reconstructed from the recovery slices:
+// the good blocks are read again, with just as many recovery slices loaded as needed,
+// then the rest is written with another pass over the data (this needs an io.Seeker).
+func (pw *par2WriterTo) WriteTo(w io.Writer) (int64, error) {
+	blockSize := int(pw.info.Main.BlockSize)
+	block := make([]byte, blockSize)
 
-	return func(p []byte, i int) (ShardMetadata, []byte, error) {
-		if i == 0 && totalSize == 0 {
-			return ShardMetadata{}, nil, io.EOF
-		}
-		index++
-		hCRC.Reset()
-		hMD5.Reset()
-		length := int(info.Main.BlockSize)
-		sm := ShardMetadata{Index: uint32(index + 1), Size: meta.ShardSize}
+	missing, targetBase, written, err := pw.scan(nil, block, w)
+	if err != nil || len(missing) == 0 {
+		return written, err
+	}
 
-		if i < D {
-			dataIndex++
-			if totalSize < uint64(length) {
-				length = int(totalSize)
+	dec := par2.NewDecoder(blockSize, pw.info.RecoveryData, len(missing))
+	log.Printf("Has %d missing blocks, try to reconstruct from %d recovery blocks...", len(missing), dec.Available())
+	if dec.Available() < len(missing) {
+		return written, errors.Wrapf(par2.ErrNotEnoughRecovery, "%d missing, %d available", len(missing), dec.Available())
+	}
+	if sek, ok := pw.data.(io.Seeker); ok {
+		if _, err := sek.Seek(0, io.SeekStart); err != nil {
+			return written, err
+		}
+	} else if targetMissing := countBetween(missing, targetBase, targetBase+len(pw.files[pw.target].Pairs)); targetMissing != len(pw.files[pw.target].Pairs) {
+		// an unreadable data (errReader) can be read again
+		return written, errors.New("data is not seekable, cannot reconstruct")
+	}
+	if missing, _, _, err = pw.scan(dec, block, nil); err != nil {
+		return written, err
+	}
+	repaired, err := dec.Reconstruct(missing)
+	if err != nil {
+		return written, errors.Wrap(err, "Reconstruct")
+	}
+	file := pw.files[pw.target]
+	var targetMissing []int
+	var targetRepaired [][]byte
+	for k, i := range missing {
+		if i < targetBase || i >= targetBase+len(file.Pairs) {
+			continue
+		}
+		if got, want := par2.NewChecksumPair(repaired[k]), file.Pairs[i-targetBase]; got != want {
+			return written, errors.Errorf("%d. reconstructed block mismatch (got %s, wanted %s)", i-targetBase, got, want)
+		}
+		targetMissing = append(targetMissing, i-targetBase)
+		targetRepaired = append(targetRepaired, repaired[k])
+	}
+	if len(targetMissing) == 0 {
+		return written, nil
+	}
+
+	for i := targetMissing[0]; i < len(file.Pairs); i++ {
+		length := file.BlockLength(blockSize, i)
+		b := block[:length]
+		if len(targetMissing) != 0 && targetMissing[0] == i {
+			b = targetRepaired[0][:length]
+			targetMissing, targetRepaired = targetMissing[1:], targetRepaired[1:]
+		} else {
+			// a good block of the target, so the data is seekable
+			if _, err := pw.data.(io.Seeker).Seek(int64(i)*int64(blockSize), io.SeekStart); err != nil {
+				return written, err
 			}
-			totalSize -= uint64(length)
-			sm.Size = uint32(length)
-			if sm.Size == 0 {
-				return sm, p, nil
+			if _, err := io.ReadFull(pw.data, b); err != nil {
+				return written, err
 			}
-			n, err := io.ReadFull(io.TeeReader(data, io.MultiWriter(hMD5, hCRC)), p[:length])
+		}
+		n, err := w.Write(b)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// scan reads the blocks of all the files, adding the good ones to dec (if not nil),
+// and writing the target's blocks to w (if not nil) until the first damaged.
+//
+// Returns the (global) indexes of the missing blocks, and the index of the target's first block.
+func (pw *par2WriterTo) scan(dec *par2.Decoder, block []byte, w io.Writer) ([]int, int, int64, error) {
+	var written int64
+	var missing []int
+	var base, targetBase int
+	for i, file := range pw.files {
+		r, out := pw.data, w
+		if i == pw.target {
+			targetBase = base
+		} else {
+			out = nil
+			fh, err := os.Open(file.Path(pw.info.BaseDir))
 			if err != nil {
-				if sek, ok := data.(io.Seeker); ok {
-					if _, seekErr := sek.Seek(int64(len(p)-n), io.SeekCurrent); seekErr != nil {
-						return sm, nil, errors.Wrapf(err, "seek: %v", seekErr)
-					}
-					return sm, nil, errors.Wrap(errShardBroken, "missing slice")
-				}
-				return sm, nil, err
+				log.Printf("%s: %v", file.Name(), err)
+				r = errReader{err}
+			} else {
+				r = fh
 			}
+		}
+		fileMissing, n, err := checkPAR2Blocks(dec, block, base, file, r, out)
+		written += n
+		if c, ok := r.(io.Closer); ok && i != pw.target {
+			c.Close()
+		}
+		if err != nil {
+			return missing, targetBase, written, err
+		}
+		missing = append(missing, fileMissing...)
+		base += len(file.Pairs)
+	}
+	return missing, targetBase, written, nil
+}
 
-			if length < len(p) {
-				zero(p[length:])
-				hCRC.Write(p[length:])
-				hMD5.Write(p[length:])
-			}
-			want := info.Files[0].IFSCPacket.Pairs[dataIndex]
-			hCRC.Sum(got.CRC32[:0])
-			hMD5.Sum(got.MD5[:0])
-			if want == got {
-				sm.Hash32 = hCRC.Sum32()
-				return sm, p, nil
+// checkPAR2Blocks reads the blocks of the file from r, adding the good ones to the decoder (if not nil)
+// (with base as the index of the file's first block), and writing them to w (if not nil) until the first damaged.
+//
+// Returns the (global) indexes of the missing blocks.
+func checkPAR2Blocks(dec *par2.Decoder, block []byte, base int, file *par2.File, r io.Reader, w io.Writer) ([]int, int64, error) {
+	var written int64
+	var missing []int
+	for i, want := range file.Pairs {
+		length := file.BlockLength(len(block), i)
+		n, err := io.ReadFull(r, block[:length])
+		if err == nil {
+			zero(block[length:])
+			if got := par2.NewChecksumPair(block); got != want {
+				err = errors.Errorf("crc/md5 mismatch (got %s, wanted %s)", got, want)
 			}
-			err = errors.Wrapf(errShardBroken, "%d. shard crc/md5 mismatch (got %s, wanted %s)!", i, got, want)
-			log.Printf("%v", err)
-			return sm, nil, err
 		}
-		// parity
-		rd := info.RecoveryData[(index%(D+P))-D]
-		if rd.Damaged {
-			return sm, nil, errors.Wrap(errShardBroken, strconv.Itoa(i+1))
+		// unreadable blocks are missing, too
+		if err != nil {
+			log.Printf("%s: %d. block is damaged (read %d bytes): %v", file.Name(), i, n, err)
+			missing = append(missing, base+i)
+			continue
+		}
+		if dec != nil {
+			dec.Add(base+i, block)
+		}
+		if w == nil || len(missing) != 0 {
+			continue
+		}
+		n, err = w.Write(block[:length])
+		written += int64(n)
+		if err != nil {
+			return missing, written, err
+		}
+	}
+	return missing, written, nil
+}
+
+// countBetween returns the number of elements of the ascending a in [lo, hi).
+func countBetween(a []int, lo, hi int) int {
+	var n int
+	for _, i := range a {
+		if lo <= i && i < hi {
+			n++
 		}
-		hCRC.Write(rd.RecoveryData)
-		sm.Hash32 = hCRC.Sum32()
-		return sm, rd.RecoveryData, nil
 	}
+	return n
 }
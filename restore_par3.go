@@ -0,0 +1,91 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/par/container"
+	"github.com/tgulacsi/par/par3"
+)
+
+// par3WriterTo writes a data file of the input set, checked and repaired by the PAR3 recovery blocks.
+//
+// The input blocks may hold the chunks of all the files of the set,
+// so the other files (from the set's BaseDir) are read, too.
+type par3WriterTo struct {
+	info *par3.ParInfo
+	name string
+	data io.ReaderAt
+}
+
+func newPAR3WriterTo(parity container.Source, data io.Reader, fileName string) (*par3WriterTo, error) {
+	info, err := par3.Stat(parity.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Files) == 0 {
+		return nil, errors.New("empty par file: " + parity.Name)
+	}
+	file, err := findPAR3File(info, fileName)
+	if err != nil {
+		return nil, err
+	}
+	pw := par3WriterTo{info: info, name: file.Path}
+	switch x := data.(type) {
+	case errReader:
+		// the data file is missing
+		pw.data = nil
+	case io.ReaderAt:
+		pw.data = x
+	default:
+		b, err := ioutil.ReadAll(data)
+		if err != nil {
+			return nil, errors.Wrap(err, fileName)
+		}
+		pw.data = bytes.NewReader(b)
+	}
+	return &pw, nil
+}
+
+// findPAR3File returns the only file of the set, or the one named fileName.
+func findPAR3File(info *par3.ParInfo, fileName string) (*par3.File, error) {
+	if len(info.Files) == 1 {
+		return info.Files[0], nil
+	}
+	names := make([]string, len(info.Files))
+	for i, f := range info.Files {
+		if names[i] = f.Path; f.Path == filepath.ToSlash(fileName) || path.Base(f.Path) == filepath.Base(fileName) {
+			return f, nil
+		}
+	}
+	return nil, errors.Errorf("%q is not in the input set (%q)", fileName, names)
+}
+
+func (pw *par3WriterTo) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := pw.info.Restore(cw, pw.name, pw.data)
+	return cw.N, err
+}
+
+// par3CRC64Table is the table of the Hash16k of the PAR3 files.
+var par3CRC64Table = crc64.MakeTable(crc64.ISO)
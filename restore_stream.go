@@ -0,0 +1,266 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"log"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+)
+
+// streamReader reads the good frames of the stream format, one by one.
+//
+// After a damaged frame, the next one is searched for by its sync marker.
+type streamReader struct {
+	br   *bufio.Reader
+	name string
+	// offset is the position in the stream, at is the offset of the last returned frame.
+	offset, at int64
+	skipped    int64
+}
+
+func newStreamReader(name string, r io.Reader) *streamReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &streamReader{br: br, name: name}
+}
+
+// next returns the next good frame and its content (valid till the next call),
+// or io.EOF at the end of the stream.
+func (r *streamReader) next() (streamFrame, []byte, error) {
+	for {
+		b, err := r.br.Peek(streamHeaderLength)
+		if len(b) < streamHeaderLength {
+			r.skipped += int64(len(b))
+			r.logSkipped()
+			if err == nil {
+				err = io.EOF
+			}
+			return streamFrame{}, nil, err
+		}
+		if f, ok := decodeStreamFrame(b); ok {
+			n := streamHeaderLength + f.contentLength()
+			if r.br.Size() < n {
+				r.br = bufio.NewReaderSize(r.br, n)
+			}
+			b, _ := r.br.Peek(n)
+			if len(b) == n && crc32.Checksum(b[streamHeaderLength:], crc32cTable) == f.ContentCRC {
+				r.logSkipped()
+				r.br.Discard(n)
+				r.at, r.offset = r.offset, r.offset+int64(n)
+				return f, b[streamHeaderLength:], nil
+			}
+			if f.Flags == 0 {
+				log.Printf("%s: damaged %d. shard of the %d. stripe", r.name, f.Idx+1, f.Stripe+1)
+			}
+		}
+		// resync: skip to the next sync marker
+		buf, _ := r.br.Peek(r.br.Buffered())
+		n := len(buf) - len(streamSync) + 1
+		if i := bytes.Index(buf[1:], []byte(streamSync)); i >= 0 {
+			n = i + 1
+		}
+		r.br.Discard(n)
+		r.offset += int64(n)
+		r.skipped += int64(n)
+	}
+}
+
+func (r *streamReader) logSkipped() {
+	if r.skipped != 0 {
+		log.Printf("%s: skipped %d bytes", r.name, r.skipped)
+		r.skipped = 0
+	}
+}
+
+// readStreamHead returns the metadata and the first shard of the stream.
+//
+// If the metadata frame is damaged, the geometry is taken from the first shard frame.
+func readStreamHead(name string, r io.Reader) (FileMetadata, ShardMetadata, error) {
+	var meta FileMetadata
+	var sm ShardMetadata
+	sr := newStreamReader(name, r)
+	for {
+		f, content, err := sr.next()
+		if err != nil {
+			if err == io.EOF && meta.DataShards != 0 {
+				return meta, sm, nil
+			}
+			return meta, sm, errors.Wrap(err, "no frame")
+		}
+		switch {
+		case f.Flags&streamFlagMeta != 0:
+			if err := json.Unmarshal(content, &meta); err != nil {
+				log.Printf("%s: decode metadata: %v", name, err)
+			}
+			continue
+		case f.Flags&streamFlagEnd != 0:
+			return meta, sm, nil
+		}
+		meta.DataShards, meta.ParityShards, meta.ShardSize = f.DataShards, f.ParityShards, f.ShardSize
+		if f.Stripe == 0 && f.Idx == 0 {
+			sm = ShardMetadata{Index: 1, Size: uint32(len(content)), Hash32: f.ContentCRC}
+		}
+		return meta, sm, nil
+	}
+}
+
+var _ = io.WriterTo((*streamDecoder)(nil))
+
+// streamDecoder decodes the stream format: the data of each stripe is written as soon as
+// its frames are read (and the lost ones reconstructed), so the memory is one stripe,
+// and no seeking is needed.
+type streamDecoder struct {
+	r   *streamReader
+	enc reedsolomon.Encoder
+	// geo is the geometry of the stream, from the first shard frame.
+	geo     streamFrame
+	data    []byte
+	slices  [][]byte
+	present []bool
+}
+
+func newStreamDecoder(name string, r io.Reader) *streamDecoder {
+	return &streamDecoder{r: newStreamReader(name, r)}
+}
+
+// init allocates the stripe of the geometry of f.
+func (d *streamDecoder) init(f streamFrame) error {
+	D, P, shardSize := int(f.DataShards), int(f.ParityShards), int(f.ShardSize)
+	var err error
+	if d.enc, err = reedsolomon.New(D, P); err != nil {
+		return errors.Wrapf(err, "D=%d P=%d", D, P)
+	}
+	d.geo = streamFrame{DataShards: f.DataShards, ParityShards: f.ParityShards, ShardSize: f.ShardSize}
+	d.data = make([]byte, (D+P)*shardSize)
+	d.slices = make([][]byte, D+P)
+	d.present = make([]bool, D+P)
+	for i := range d.slices {
+		d.slices[i] = d.data[i*shardSize : (i+1)*shardSize : (i+1)*shardSize]
+	}
+	return nil
+}
+
+// WriteTo writes the data of the stripes, till the end frame.
+//
+// The stream is truncated if it ends without the end frame, after a full stripe.
+func (d *streamDecoder) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	// cur is the stripe being read, last is its first frame.
+	cur, last := int64(-1), streamFrame{}
+	flush := func() error {
+		if cur < 0 {
+			return nil
+		}
+		n, err := d.writeStripe(w, last)
+		written += int64(n)
+		return err
+	}
+	for {
+		f, content, err := d.r.next()
+		if err == io.EOF {
+			if err := flush(); err != nil {
+				return written, err
+			}
+			if cur >= 0 && uint64(last.StripeLength) < uint64(d.geo.DataShards)*uint64(d.geo.ShardSize) {
+				// the last stripe is short, just the end frames are lost
+				return written, nil
+			}
+			return written, errors.Wrapf(io.ErrUnexpectedEOF, "%s: stream is truncated after %d stripes", d.r.name, cur+1)
+		}
+		if err != nil {
+			return written, err
+		}
+		switch {
+		case f.Flags&streamFlagMeta != 0:
+			continue
+		case f.Flags&streamFlagEnd != 0:
+			if err := flush(); err != nil {
+				return written, err
+			}
+			if int64(f.Stripe) != cur+1 {
+				return written, errors.Errorf("%s: %d. stripe is lost", d.r.name, cur+2)
+			}
+			return written, nil
+		}
+
+		if d.data == nil {
+			if err := d.init(f); err != nil {
+				return written, err
+			}
+		} else if f.DataShards != d.geo.DataShards || f.ParityShards != d.geo.ParityShards || f.ShardSize != d.geo.ShardSize {
+			log.Printf("%s: skip frame of other geometry %+v", d.r.name, f)
+			continue
+		}
+		if int64(f.Stripe) < cur {
+			// a stale copy
+			continue
+		}
+		if int64(f.Stripe) > cur {
+			if err := flush(); err != nil {
+				return written, err
+			}
+			if int64(f.Stripe) != cur+1 {
+				return written, errors.Errorf("%s: %d. stripe is lost", d.r.name, cur+2)
+			}
+			cur, last = int64(f.Stripe), f
+			for i := range d.present {
+				d.present[i] = false
+			}
+		}
+		p := d.slices[f.Idx]
+		zero(p[copy(p, content):])
+		d.present[f.Idx] = true
+	}
+}
+
+// writeStripe reconstructs the missing shards of the stripe, and writes its data.
+func (d *streamDecoder) writeStripe(w io.Writer, f streamFrame) (int, error) {
+	slices := make([][]byte, len(d.slices))
+	var missing int
+	for i, p := range d.slices {
+		if slices[i] = p; !d.present[i] {
+			// zero length, but keep the memory, so the reconstructed shard is in the data
+			slices[i] = p[:0]
+			missing++
+		}
+	}
+	if missing > 0 {
+		log.Printf("%s: %d. stripe has %d missing shards, try to reconstruct...", d.r.name, f.Stripe+1, missing)
+		if err := d.enc.Reconstruct(slices); err != nil {
+			return 0, errors.Wrapf(err, "Reconstruct %d. stripe", f.Stripe+1)
+		}
+	}
+	if ok, err := d.enc.Verify(slices); err != nil {
+		return 0, errors.Wrap(err, "Verify")
+	} else if !ok {
+		return 0, errors.Errorf("Verify %d. stripe failed", f.Stripe+1)
+	}
+	return w.Write(d.data[:f.StripeLength])
+}
+
+// DecodeStream writes the data of the stream format read from r (named name) to w.
+func DecodeStream(w io.Writer, r io.Reader, name string) (int64, error) {
+	return newStreamDecoder(name, r).WriteTo(w)
+}
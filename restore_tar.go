@@ -17,72 +17,210 @@ package main
 
 import (
 	"archive/tar"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"log"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
 )
 
-func newTarNextShard(meta FileMetadata, parity *tar.Reader, data io.Reader) func([]byte, int) (ShardMetadata, []byte, error) {
+func newTarNextShard(meta FileMetadata, parity *tar.Reader, data io.Reader) nextShardFunc {
 	if meta.Version != VersionTAR {
 		panic(fmt.Sprintf("Version mismatch: got %s, wanted %s", meta.Version, VersionTAR))
 	}
 	D := int(meta.DataShards)
 	hsh := crc32.New(crc32cTable)
 	return func(p []byte, idx int) (ShardMetadata, []byte, error) {
-		var fn string
 		var sm ShardMetadata
 		for {
 			th, err := parity.Next()
 			if err != nil {
 				return sm, nil, err
 			}
-			if i := strings.IndexByte(th.Name, '{'); i >= 0 {
-				fn = th.Name[i:]
+			var ok bool
+			if sm, ok, err = tarShardMetadata(th, int(meta.DataShards)+int(meta.ParityShards)); err != nil {
+				log.Printf("decode %q: %v", th.Name, err)
+				return sm, nil, err
+			} else if ok {
 				break
 			}
 		}
-		if err := json.NewDecoder(strings.NewReader(fn)).Decode(&sm); err != nil {
-			log.Printf("decode %q: %v", fn, err)
-			return sm, nil, errors.Wrap(err, fn)
+
+		r := io.Reader(parity)
+		if meta.OnlyParity && idx < D {
+			r = data
 		}
+		return readTarShard(hsh, sm, r, p, idx)
+	}
+}
 
-		if sm.Size == 0 {
-			return sm, p, nil
+// readTarShard reads the shard's content described by sm from r into p, checking its hash.
+func readTarShard(hsh hash.Hash32, sm ShardMetadata, r io.Reader, p []byte, idx int) (ShardMetadata, []byte, error) {
+	if sm.Size == 0 {
+		return sm, p, nil
+	}
+	length := int(sm.Size)
+	hsh.Reset()
+	n, err := io.ReadFull(io.TeeReader(r, hsh), p[:length])
+	if err != nil {
+		if sek, ok := r.(io.Seeker); ok {
+			if _, seekErr := sek.Seek(int64(len(p)-n), io.SeekCurrent); seekErr != nil {
+				return sm, nil, errors.Wrapf(err, "seek: %v", seekErr)
+			}
+			return sm, nil, errors.Wrap(errShardBroken, "missing slice")
+		}
+		return sm, nil, err
+	}
+
+	if length < len(p) {
+		zero(p[length:cap(p)])
+	}
+	got := uint32(hsh.Sum32())
+	if sm.Hash32 == got {
+		return sm, p, nil
+	}
+	err = errors.Wrapf(errShardBroken, "%d. shard crc mismatch (got %d, wanted %d)!", idx, got, sm.Hash32)
+	log.Printf("%v", err)
+	return sm, nil, err
+}
+
+var errNoTarIndex = errors.New("no tar index")
+
+// tarIndex gives random access to the shards of a tar archive, by its trailing index.json.
+//
+// The embedded *tar.Reader is the sequential reader of the same archive.
+type tarIndex struct {
+	*tar.Reader
+	ra        io.ReaderAt
+	size      int64
+	stripeLen int
+	// entries[i] is the (i+1)-th shard.
+	entries []tarIndexEntry
+}
+
+// readTarIndex reads the index.json member pointed by the footer at the end of the archive.
+//
+// Returns errNoTarIndex if there's no footer.
+func readTarIndex(ra io.ReaderAt, size int64, stripeLen int) (*tarIndex, error) {
+	if size < tarFooterTail {
+		return nil, errNoTarIndex
+	}
+	footer := make([]byte, tarFooterLength)
+	if _, err := ra.ReadAt(footer, size-tarFooterTail); err != nil {
+		return nil, errors.Wrap(err, "read footer")
+	}
+	if string(footer[:len(tarFooterMagic)]) != tarFooterMagic {
+		return nil, errNoTarIndex
+	}
+	offset := int64(binary.LittleEndian.Uint64(footer[len(tarFooterMagic):]))
+	if offset < 0 || offset >= size {
+		return nil, errors.Errorf("index offset %d out of range", offset)
+	}
+	tr := tar.NewReader(io.NewSectionReader(ra, offset, size-offset))
+	th, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "read index header")
+	}
+	if th.Name != tarIndexName {
+		return nil, errors.Errorf("index should be %q, got %q", tarIndexName, th.Name)
+	}
+	ix := tarIndex{ra: ra, size: size, stripeLen: stripeLen}
+	if err := json.NewDecoder(tr).Decode(&ix.entries); err != nil {
+		return nil, errors.Wrap(err, tarIndexName)
+	}
+	for i, e := range ix.entries {
+		if e.Index != uint32(i+1) || e.Offset < 0 || e.Offset >= size {
+			return nil, errors.Errorf("%d. index entry is invalid: %#v", i, e)
 		}
+	}
+	return &ix, nil
+}
 
-		r, source := io.Reader(parity), "parity"
+// Shard returns the metadata and the content reader of the index-th (1-based) shard.
+//
+// The returned metadata comes from the index, even if the shard's header is broken.
+func (ix *tarIndex) Shard(index uint32) (ShardMetadata, io.Reader, error) {
+	if index == 0 || int(index) > len(ix.entries) {
+		return ShardMetadata{Index: index}, nil, io.EOF
+	}
+	e := ix.entries[index-1]
+	tr := tar.NewReader(io.NewSectionReader(ix.ra, e.Offset, ix.size-e.Offset))
+	th, err := tr.Next()
+	if err != nil {
+		return e.ShardMetadata, nil, errors.Wrapf(errShardBroken, "%d. shard header: %v", index, err)
+	}
+	if sm, ok, err := tarShardMetadata(th, ix.stripeLen); err != nil || !ok || sm != e.ShardMetadata {
+		return e.ShardMetadata, nil, errors.Wrapf(errShardBroken, "%d. shard header %q mismatch", index, th.Name)
+	}
+	return e.ShardMetadata, tr, nil
+}
+
+func newTarIndexNextShard(meta FileMetadata, ix *tarIndex, data io.Reader) nextShardFunc {
+	D := int(meta.DataShards)
+	hsh := crc32.New(crc32cTable)
+	var index uint32
+	return func(p []byte, idx int) (ShardMetadata, []byte, error) {
+		index++
+		sm, r, err := ix.Shard(index)
 		if meta.OnlyParity && idx < D {
-			r, source = data, "data"
+			// the data comes from the data file, the broken header does not matter
+			if err != nil && errors.Cause(err) != errShardBroken {
+				return sm, nil, err
+			}
+			return readTarShard(hsh, sm, data, p, idx)
 		}
-		_ = source
-		length := int(sm.Size)
-		hsh.Reset()
-		n, err := io.ReadFull(io.TeeReader(r, hsh), p[:length])
 		if err != nil {
-			if sek, ok := r.(io.Seeker); ok {
-				if _, seekErr := sek.Seek(int64(len(p)-n), io.SeekCurrent); seekErr != nil {
-					return sm, nil, errors.Wrapf(err, "seek: %v", seekErr)
-				}
-				return sm, nil, errors.Wrap(errShardBroken, "missing slice")
-			}
 			return sm, nil, err
 		}
+		if sm, p, err = readTarShard(hsh, sm, r, p, idx); err != nil && errors.Cause(err) != errShardBroken {
+			err = errors.Wrap(errShardBroken, err.Error())
+		}
+		return sm, p, err
+	}
+}
 
-		if length < len(p) {
-			zero(p[length:cap(p)])
+// tarShardMetadata returns the ShardMetadata stored in the tar header,
+// either in the PAX records (TarRevisionPAX) or in the name (TarRevisionName).
+//
+// Returns false for non-shard members.
+func tarShardMetadata(th *tar.Header, stripeLen int) (ShardMetadata, bool, error) {
+	var sm ShardMetadata
+	if _, ok := th.PAXRecords[paxIndex]; ok {
+		var stripe uint32
+		for _, f := range []struct {
+			Key  string
+			Dest *uint32
+		}{
+			{paxIndex, &sm.Index},
+			{paxSize, &sm.Size},
+			{paxHash, &sm.Hash32},
+			{paxStripe, &stripe},
+		} {
+			u, err := strconv.ParseUint(th.PAXRecords[f.Key], 10, 32)
+			if err != nil {
+				return sm, false, errors.Wrapf(err, "%s: %s", th.Name, f.Key)
+			}
+			*f.Dest = uint32(u)
 		}
-		got := uint32(hsh.Sum32())
-		if sm.Hash32 == got {
-			return sm, p, nil
+		if sm.Index == 0 || (sm.Index-1)/uint32(stripeLen) != stripe {
+			return sm, false, errors.Errorf("%s: index %d is not in stripe %d", th.Name, sm.Index, stripe)
 		}
-		err = errors.Wrapf(errShardBroken, "%d. shard crc mismatch (got %d, wanted %d)!", idx, got, sm.Hash32)
-		log.Printf("%v", err)
-		return sm, nil, err
+		return sm, true, nil
+	}
 
+	i := strings.IndexByte(th.Name, '{')
+	if i < 0 {
+		return sm, false, nil
+	}
+	fn := th.Name[i:]
+	if err := json.NewDecoder(strings.NewReader(fn)).Decode(&sm); err != nil {
+		return sm, false, errors.Wrap(err, fn)
 	}
+	return sm, true, nil
 }
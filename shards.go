@@ -0,0 +1,172 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// stripeLayout is the geometry of the shards of a stream format,
+// to know the shards whose header is lost.
+type stripeLayout struct {
+	DataShards, ParityShards uint8
+	OnlyParity               bool
+	ShardSize                uint32
+	// Size is the length of the data, -1 if unknown.
+	Size int64
+}
+
+func stripeLayoutOf(meta FileMetadata) stripeLayout {
+	sl := stripeLayout{
+		DataShards: meta.DataShards, ParityShards: meta.ParityShards,
+		OnlyParity: meta.OnlyParity, ShardSize: meta.ShardSize, Size: -1,
+	}
+	if meta.Size > 0 {
+		sl.Size = meta.Size
+	}
+	return sl
+}
+
+// stripeLength returns the number of shards in a stripe.
+func (sl stripeLayout) stripeLength() int { return int(sl.DataShards) + int(sl.ParityShards) }
+
+// shardCount returns the number of shards, -1 if the size is unknown.
+func (sl stripeLayout) shardCount() int64 {
+	if sl.Size < 0 {
+		return -1
+	}
+	stripeData := int64(sl.DataShards) * int64(sl.ShardSize)
+	return (sl.Size + stripeData - 1) / stripeData * int64(sl.stripeLength())
+}
+
+// shardSize returns the size of the index. (1-based) shard:
+// only the data shards of the last stripe may be shorter than ShardSize.
+func (sl stripeLayout) shardSize(index uint32) uint32 {
+	k := int64(index) - 1
+	stripe, i := k/int64(sl.stripeLength()), k%int64(sl.stripeLength())
+	if i >= int64(sl.DataShards) || sl.Size < 0 {
+		return sl.ShardSize
+	}
+	rest := sl.Size - (stripe*int64(sl.DataShards)+i)*int64(sl.ShardSize)
+	if rest <= 0 {
+		return 0
+	}
+	if rest < int64(sl.ShardSize) {
+		return uint32(rest)
+	}
+	return sl.ShardSize
+}
+
+// stored reports whether the content of the index. shard is in the parity file.
+func (sl stripeLayout) stored(index uint32) bool {
+	return !sl.OnlyParity || (int64(index)-1)%int64(sl.stripeLength()) >= int64(sl.DataShards)
+}
+
+// shardSource is the parity file of a stream format, read by a shardSequencer.
+type shardSource interface {
+	// header returns the next good shard header, false at the end.
+	header() (ShardMetadata, bool, error)
+	// content reads the content of the shard of the last header into p,
+	// returning errShardBroken if it is damaged.
+	content(sm ShardMetadata, p []byte, idx int) ([]byte, error)
+	// skip the content of the shard of the last header.
+	skip(sm ShardMetadata)
+}
+
+// firstShard returns the header of the first shard of src (zero, if it is lost).
+func firstShard(src shardSource) (ShardMetadata, error) {
+	for {
+		sm, ok, err := src.header()
+		if err != nil || !ok || sm.Index == 1 {
+			return sm, err
+		}
+	}
+}
+
+// shardSequencer returns the shards of a shardSource in order, for rsWriterTo.
+//
+// The shards whose header is lost are broken; when a later header is found,
+// it is kept until its turn comes.
+type shardSequencer struct {
+	src    shardSource
+	layout stripeLayout
+	data   io.Reader
+	// index is the index of the expected shard
+	index uint32
+	// pending is the found header of a later shard (its content is not read yet)
+	pending *ShardMetadata
+}
+
+func (s *shardSequencer) next(p []byte, idx int) (ShardMetadata, []byte, error) {
+	s.index++
+	want := ShardMetadata{Index: s.index, Size: s.layout.shardSize(s.index)}
+	for {
+		sm, ok := ShardMetadata{}, true
+		if s.pending != nil {
+			sm = *s.pending
+		} else {
+			var err error
+			if sm, ok, err = s.src.header(); err != nil {
+				return want, nil, err
+			}
+		}
+		if !ok {
+			if n := s.layout.shardCount(); n >= 0 && int64(s.index) <= n || n < 0 && idx != 0 {
+				return want, nil, s.broken(want, "%d. shard is missing", s.index)
+			}
+			return want, nil, io.EOF
+		}
+		if sm.Index < s.index {
+			// a stale copy
+			if s.layout.stored(sm.Index) {
+				s.src.skip(sm)
+			}
+			continue
+		}
+		if sm.Index > s.index {
+			s.pending = &sm
+			return want, nil, s.broken(want, "%d. shard header is missing", s.index)
+		}
+		s.pending = nil
+		if int(sm.Size) > len(p) {
+			return sm, nil, errors.Wrapf(errShardBroken, "%d. shard is too long (%d)", sm.Index, sm.Size)
+		}
+		if s.layout.stored(sm.Index) {
+			p, err := s.src.content(sm, p, idx)
+			return sm, p, err
+		}
+		hsh := crc32.New(crc32cTable)
+		if _, err := io.ReadFull(io.TeeReader(s.data, hsh), p[:sm.Size]); err != nil {
+			return sm, nil, errors.Wrapf(errShardBroken, "%d. shard: %v", sm.Index, err)
+		}
+		if got := hsh.Sum32(); got != sm.Hash32 {
+			return sm, nil, errors.Wrapf(errShardBroken, "%d. shard crc mismatch (got %d, wanted %d)", idx, got, sm.Hash32)
+		}
+		zero(p[sm.Size:])
+		return sm, p, nil
+	}
+}
+
+// broken returns errShardBroken, reading the content of a not stored data shard from the data.
+func (s *shardSequencer) broken(want ShardMetadata, format string, args ...interface{}) error {
+	if !s.layout.stored(want.Index) && want.Size != 0 {
+		io.CopyN(io.Discard, s.data, int64(want.Size))
+	}
+	return errors.Wrapf(errShardBroken, format, args...)
+}